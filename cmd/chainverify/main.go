@@ -0,0 +1,235 @@
+// Command chainverify exports the medical record blockchain to a signed
+// archive and verifies such archives offline, without the database or API.
+//
+// Usage:
+//
+//	chainverify keygen
+//	chainverify export -out chain.tar.gz
+//	chainverify verify -in chain.tar.gz [-pubkey BASE64]
+//	chainverify tsa -addr :3161 -key tsa-key.pem -cert tsa-cert.pem
+//
+// export reads the database settings from the same environment variables as
+// the API server and signs the archive with the key in CHAIN_EXPORT_KEY.
+//
+// tsa runs a local RFC 3161 time-stamp authority that stands in for a real
+// one in development and tests. Its key and certificate are created on first
+// run; point TSA_URL at it and TSA_CA_FILE at the certificate.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"diploma/internal/blockchain"
+	"diploma/internal/config"
+	"diploma/internal/repositories"
+	"diploma/internal/timestamp"
+)
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "keygen":
+		keygen()
+	case "export":
+		export(os.Args[2:])
+	case "verify":
+		verify(os.Args[2:])
+	case "tsa":
+		serveTSA(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: chainverify keygen | export -out FILE | verify -in FILE [-pubkey BASE64] | tsa -addr ADDR -key FILE -cert FILE")
+	os.Exit(2)
+}
+
+// keygen prints a new archive signing key pair
+func keygen() {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+	fmt.Printf("CHAIN_EXPORT_KEY=%s\n", base64.StdEncoding.EncodeToString(privateKey.Seed()))
+	fmt.Printf("public key: %s\n", base64.StdEncoding.EncodeToString(publicKey))
+}
+
+func export(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	out := flags.String("out", "chain.tar.gz", "archive file to write")
+	flags.Parse(args)
+
+	cfg := config.LoadConfig()
+	seed, err := base64.StdEncoding.DecodeString(cfg.ChainExportKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		log.Fatalf("CHAIN_EXPORT_KEY must be a base64 Ed25519 seed, run chainverify keygen")
+	}
+	signingKey := ed25519.NewKeyFromSeed(seed)
+
+	legacyLocation, err := time.LoadLocation(cfg.ChainLegacyTimezone)
+	if err != nil {
+		log.Fatalf("Invalid CHAIN_LEGACY_TIMEZONE: %v", err)
+	}
+
+	db, err := repositories.ConnectDB(cfg)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	file, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("Failed to create archive: %v", err)
+	}
+
+	// Listing public keys does not need the master key
+	manifest, err := blockchain.Export(db, repositories.NewKeyRepository(db, nil), signingKey, legacyLocation, file)
+	if err != nil {
+		file.Close()
+		os.Remove(*out)
+		log.Fatalf("Failed to export chain: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		log.Fatalf("Failed to write archive: %v", err)
+	}
+
+	log.Printf("Exported %d blocks to %s, head %d %s", manifest.BlockCount, *out, manifest.HeadIndex, manifest.HeadHash)
+	if manifest.UnreadableRows > 0 {
+		log.Printf("Warning: %d rows could not be read and are recorded in the archive as unreadable", manifest.UnreadableRows)
+	}
+}
+
+func verify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	in := flags.String("in", "chain.tar.gz", "archive file to verify")
+	pubkey := flags.String("pubkey", "", "base64 public key the archive must be signed with")
+	flags.Parse(args)
+
+	var trustedKey ed25519.PublicKey
+	if *pubkey != "" {
+		key, err := base64.StdEncoding.DecodeString(*pubkey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			log.Fatalf("-pubkey must be a base64 Ed25519 public key")
+		}
+		trustedKey = key
+	}
+
+	file, err := os.Open(*in)
+	if err != nil {
+		log.Fatalf("Failed to open archive: %v", err)
+	}
+	defer file.Close()
+
+	manifest, report, err := blockchain.VerifyArchive(file, trustedKey)
+	if err != nil {
+		log.Fatalf("Archive rejected: %v", err)
+	}
+	if trustedKey == nil {
+		log.Printf("Warning: no -pubkey given, archive was checked against its own key %s", manifest.SignerPublicKey)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+
+	if !report.Valid {
+		os.Exit(1)
+	}
+}
+
+// serveTSA runs a local time-stamp authority
+func serveTSA(args []string) {
+	flags := flag.NewFlagSet("tsa", flag.ExitOnError)
+	addr := flags.String("addr", ":3161", "address to listen on")
+	keyFile := flags.String("key", "tsa-key.pem", "PEM private key, created if missing")
+	certFile := flags.String("cert", "tsa-cert.pem", "PEM certificate, created if missing")
+	flags.Parse(args)
+
+	key, err := loadOrCreateTSAKey(*keyFile)
+	if err != nil {
+		log.Fatalf("Failed to load TSA key: %v", err)
+	}
+
+	var cert *x509.Certificate
+	if certPEM, err := os.ReadFile(*certFile); err == nil {
+		block, _ := pem.Decode(certPEM)
+		if block == nil {
+			log.Fatalf("%s is not a PEM certificate", *certFile)
+		}
+		if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+			log.Fatalf("Failed to parse TSA certificate: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("Failed to read TSA certificate: %v", err)
+	}
+
+	authority, err := timestamp.NewAuthority(key, cert)
+	if err != nil {
+		log.Fatalf("Failed to create TSA: %v", err)
+	}
+	if cert == nil {
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: authority.Certificate().Raw})
+		if err := os.WriteFile(*certFile, certPEM, 0644); err != nil {
+			log.Fatalf("Failed to write TSA certificate: %v", err)
+		}
+		log.Printf("Wrote TSA certificate to %s", *certFile)
+	}
+
+	log.Printf("Local time-stamp authority listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, authority))
+}
+
+func loadOrCreateTSAKey(path string) (*ecdsa.PrivateKey, error) {
+	keyPEM, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("Wrote new TSA key to %s", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ECDSA key", path)
+	}
+	return key, nil
+}
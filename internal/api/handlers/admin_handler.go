@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"diploma/internal/models"
+	"diploma/internal/repositories"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultLoginHistoryLimit is how many login attempts are listed unless asked otherwise
+const defaultLoginHistoryLimit = 100
+
+// AdminHandler lets administrators manage other users' accounts
+type AdminHandler struct {
+	userRepo *repositories.UserRepository
+	sessions *repositories.SessionRepository
+	resets   *repositories.PasswordResetRepository
+	events   *repositories.LoginEventRepository
+	resetTTL time.Duration
+}
+
+func NewAdminHandler(userRepo *repositories.UserRepository, sessions *repositories.SessionRepository, resets *repositories.PasswordResetRepository, events *repositories.LoginEventRepository, resetTTL time.Duration) *AdminHandler {
+	return &AdminHandler{userRepo: userRepo, sessions: sessions, resets: resets, events: events, resetTTL: resetTTL}
+}
+
+// targetUser loads the user named by the :id parameter, or writes the error
+// response and returns nil. Administrators may not act on their own account.
+func (h *AdminHandler) targetUser(c *gin.Context) *models.User {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return nil
+	}
+	if uint(id) == c.GetUint("user_id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Administrators cannot do this to their own account"})
+		return nil
+	}
+	user, err := h.userRepo.GetUserByID(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil
+	}
+	return user
+}
+
+// UpdateSpecialization godoc
+// @Summary      Change a doctor's specialization
+// @Description  Change the specialization of the doctor with the given user ID (admin only)
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        id path int true "User ID"
+// @Param        request body models.SpecializationRequest true "New specialization"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} map[string]string
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Failure      404 {object} map[string]string
+// @Router       /admin/users/{id}/specialization [put]
+func (h *AdminHandler) UpdateSpecialization(c *gin.Context) {
+	var req models.SpecializationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "Detailed": err.Error()})
+		return
+	}
+	user := h.targetUser(c)
+	if user == nil {
+		return
+	}
+
+	err := h.userRepo.UpdateSpecialization(user.UserId, req.Specialization)
+	switch {
+	case err == nil:
+		log.Printf("Admin %d changed the specialization of user %d", c.GetUint("user_id"), user.UserId)
+		c.JSON(http.StatusOK, gin.H{"message": "Specialization updated"})
+	case errors.Is(err, repositories.ErrDoctorNotFound):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update specialization", "Detailed": err.Error()})
+	}
+}
+
+// SuspendUser godoc
+// @Summary      Suspend an account
+// @Description  Bar a user from logging in and end all their sessions, until the account is reactivated (admin only)
+// @Tags         admin
+// @Accept       json
+// @Produce      json
+// @Param        id path int true "User ID"
+// @Param        request body models.SuspendUserRequest true "Reason"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} map[string]interface{}
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Failure      404 {object} map[string]string
+// @Router       /admin/users/{id}/suspend [post]
+func (h *AdminHandler) SuspendUser(c *gin.Context) {
+	var req models.SuspendUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "Detailed": err.Error()})
+		return
+	}
+	user := h.targetUser(c)
+	if user == nil {
+		return
+	}
+
+	adminID := int(c.GetUint("user_id"))
+	if err := h.userRepo.Suspend(user.UserId, adminID, req.Reason); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to suspend account", "Detailed": err.Error()})
+		return
+	}
+	ended, err := h.sessions.RevokeAll(user.UserId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end sessions", "Detailed": err.Error()})
+		return
+	}
+	log.Printf("Admin %d suspended user %d", adminID, user.UserId)
+
+	suspension, err := h.userRepo.GetSuspension(user.UserId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch suspension", "Detailed": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"suspension": suspension, "sessions_ended": ended})
+}
+
+// ReactivateUser godoc
+// @Summary      Reactivate an account
+// @Description  Lift a user's suspension so they can log in again (admin only)
+// @Tags         admin
+// @Produce      json
+// @Param        id path int true "User ID"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} map[string]string
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Failure      404 {object} map[string]string
+// @Failure      409 {object} map[string]string
+// @Router       /admin/users/{id}/reactivate [post]
+func (h *AdminHandler) ReactivateUser(c *gin.Context) {
+	user := h.targetUser(c)
+	if user == nil {
+		return
+	}
+
+	err := h.userRepo.Reactivate(user.UserId)
+	switch {
+	case err == nil:
+		log.Printf("Admin %d reactivated user %d", c.GetUint("user_id"), user.UserId)
+		c.JSON(http.StatusOK, gin.H{"message": "Account reactivated"})
+	case errors.Is(err, repositories.ErrNotSuspended):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reactivate account", "Detailed": err.Error()})
+	}
+}
+
+// ForcePasswordReset godoc
+// @Summary      Force a password reset
+// @Description  Make a user's password unusable, end all their sessions and email them a reset code for POST /users/reset-password, e.g. when the account may be compromised (admin only)
+// @Tags         admin
+// @Produce      json
+// @Param        id path int true "User ID"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} map[string]interface{}
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Failure      404 {object} map[string]string
+// @Router       /admin/users/{id}/force-password-reset [post]
+func (h *AdminHandler) ForcePasswordReset(c *gin.Context) {
+	user := h.targetUser(c)
+	if user == nil {
+		return
+	}
+
+	if err := h.userRepo.ForcePasswordReset(user.UserId); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password", "Detailed": err.Error()})
+		return
+	}
+	ended, err := h.sessions.RevokeAll(user.UserId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end sessions", "Detailed": err.Error()})
+		return
+	}
+	log.Printf("Admin %d forced a password reset of user %d", c.GetUint("user_id"), user.UserId)
+
+	// A code requested moments ago is still valid and reaches the same inbox
+	code, err := h.resets.Create(user.UserId, c.ClientIP())
+	switch {
+	case err == nil:
+		mailResetCode(user, code, h.resetTTL, "An administrator reset your password, so you must choose a new one before logging in.")
+	case !errors.Is(err, repositories.ErrPasswordResetTooSoon):
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create password reset", "Detailed": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset, a reset code has been emailed to the user", "sessions_ended": ended})
+}
+
+// GetLoginHistory godoc
+// @Summary      Get a user's login history
+// @Description  List a user's latest login attempts by password or face, newest first (admin only)
+// @Tags         admin
+// @Produce      json
+// @Param        id path int true "User ID"
+// @Param        limit query int false "Most attempts to list, 100 by default"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {array} models.LoginEvent
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Router       /admin/users/{id}/logins [get]
+func (h *AdminHandler) GetLoginHistory(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	limit := defaultLoginHistoryLimit
+	if raw := c.Query("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit <= 0 || limit > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Limit must be between 1 and 1000"})
+			return
+		}
+	}
+
+	events, err := h.events.ListByUser(id, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch login history", "Detailed": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
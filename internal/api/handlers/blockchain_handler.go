@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"diploma/internal/blockchain"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+type BlockchainHandler struct {
+	Chain *blockchain.Blockchain
+}
+
+func NewBlockchainHandler(chain *blockchain.Blockchain) *BlockchainHandler {
+	return &BlockchainHandler{Chain: chain}
+}
+
+// VerifyChain godoc
+// @Summary      Verify blockchain integrity
+// @Description  Recompute every block hash and check chain links, index gaps and unreadable rows (admin only)
+// @Tags         blockchain
+// @Produce      json
+// @Param        Authorization header string true "Bearer"
+// @Success      200  {object}  blockchain.VerificationReport
+// @Failure      401  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /blockchain/verify [get]
+func (h *BlockchainHandler) VerifyChain(c *gin.Context) {
+	report, err := h.Chain.Verify()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// GetMerkleRoot godoc
+// @Summary      Get the Merkle root of a batch of blocks
+// @Description  Return the published Merkle root of a batch, used to check record inclusion proofs offline
+// @Tags         blockchain
+// @Produce      json
+// @Param        batch  path  int  true  "Batch number"
+// @Success      200  {object}  blockchain.MerkleRoot
+// @Failure      400  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Router       /blockchain/merkle-roots/{batch} [get]
+func (h *BlockchainHandler) GetMerkleRoot(c *gin.Context) {
+	batch, err := strconv.Atoi(c.Param("batch"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid batch"})
+		return
+	}
+
+	root, err := h.Chain.MerkleRoot(batch)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Batch not found"})
+		return
+	}
+	c.JSON(http.StatusOK, root)
+}
+
+// GetAnchors godoc
+// @Summary      List time-stamp anchors of the chain head
+// @Description  Return the most recent RFC 3161 time-stamp tokens over chain head hashes, newest first
+// @Tags         blockchain
+// @Produce      json
+// @Param        limit  query  int  false  "Maximum number of anchors (default 50)"
+// @Success      200  {array}   blockchain.Anchor
+// @Failure      400  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /blockchain/anchors [get]
+func (h *BlockchainHandler) GetAnchors(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+
+	anchors, err := h.Chain.Anchors(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if anchors == nil {
+		anchors = []blockchain.Anchor{}
+	}
+	c.JSON(http.StatusOK, anchors)
+}
+
+// AnchorHead godoc
+// @Summary      Anchor the chain head now
+// @Description  Time-stamp the current chain head with the configured authority without waiting for the next scheduled anchor (admin only)
+// @Tags         blockchain
+// @Produce      json
+// @Param        Authorization header string true "Bearer"
+// @Success      200  {object}  blockchain.Anchor  "Head was already anchored"
+// @Success      201  {object}  blockchain.Anchor
+// @Failure      401  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
+// @Failure      502  {object}  map[string]string
+// @Router       /blockchain/anchors [post]
+func (h *BlockchainHandler) AnchorHead(c *gin.Context) {
+	anchor, created, err := h.Chain.AnchorHead()
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	if created {
+		c.JSON(http.StatusCreated, anchor)
+		return
+	}
+	c.JSON(http.StatusOK, anchor)
+}
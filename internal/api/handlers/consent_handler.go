@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"diploma/internal/models"
+	"diploma/internal/repositories"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ConsentHandler struct {
+	repo     *repositories.StandingConsentRepository
+	userRepo *repositories.UserRepository
+}
+
+func NewConsentHandler(repo *repositories.StandingConsentRepository, userRepo *repositories.UserRepository) *ConsentHandler {
+	return &ConsentHandler{repo: repo, userRepo: userRepo}
+}
+
+// CreateConsent godoc
+// @Summary      Create a standing consent
+// @Description  Give a doctor, or every doctor of a specialization, lasting access to some record categories without approving a request per visit (patient only). Without expires_at the consent lasts until revoked.
+// @Tags         access
+// @Accept       json
+// @Produce      json
+// @Param        request body models.StandingConsentRequest true "Doctor or specialization, record categories and optional expiry"
+// @Param        Authorization header string true "Bearer"
+// @Success      201 {object} models.StandingConsent
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Failure      404 {object} map[string]string
+// @Router       /access/consents [post]
+func (h *ConsentHandler) CreateConsent(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.StandingConsentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "Detailed": err.Error()})
+		return
+	}
+	req.Specialization = strings.TrimSpace(req.Specialization)
+	if (req.DoctorIIN == "") == (req.Specialization == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Exactly one of doctor_iin and specialization is required"})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	patientID, err := h.userRepo.GetPatientIDByUserID(int(userID))
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Patient profile not found"})
+		return
+	}
+
+	var doctorID int
+	if req.DoctorIIN != "" {
+		doctor, err := h.userRepo.GetUserInfoByIIN(req.DoctorIIN)
+		if err != nil || doctor.DoctorDetails == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Doctor not found"})
+			return
+		}
+		doctorID = doctor.DoctorDetails.DoctorId
+	}
+
+	consent, err := h.repo.Create(patientID, doctorID, req.Specialization, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create standing consent", "Detailed": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, consent)
+}
+
+// GetConsents godoc
+// @Summary      List standing consents
+// @Description  List the authenticated patient's standing consents that are neither revoked nor expired (patient only)
+// @Tags         access
+// @Produce      json
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {array} models.StandingConsent
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Router       /access/consents [get]
+func (h *ConsentHandler) GetConsents(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	patientID, err := h.userRepo.GetPatientIDByUserID(int(userID))
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Patient profile not found"})
+		return
+	}
+
+	consents, err := h.repo.ListByPatient(patientID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch standing consents", "Detailed": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, consents)
+}
+
+// RevokeConsent godoc
+// @Summary      Revoke a standing consent
+// @Description  End one of the authenticated patient's standing consents (patient only)
+// @Tags         access
+// @Produce      json
+// @Param        id path int true "Standing consent ID"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} map[string]string
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Failure      404 {object} map[string]string
+// @Router       /access/consents/{id} [delete]
+func (h *ConsentHandler) RevokeConsent(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid standing consent ID"})
+		return
+	}
+
+	patientID, err := h.userRepo.GetPatientIDByUserID(int(userID))
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Patient profile not found"})
+		return
+	}
+
+	err = h.repo.Revoke(id, patientID)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"message": "Standing consent revoked"})
+	case errors.Is(err, repositories.ErrConsentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Standing consent not found"})
+	case errors.Is(err, repositories.ErrConsentNotOwned):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke standing consent", "Detailed": err.Error()})
+	}
+}
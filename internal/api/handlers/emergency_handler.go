@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"diploma/internal/models"
+	"diploma/internal/repositories"
+	"diploma/internal/scripts"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type EmergencyHandler struct {
+	repo     *repositories.EmergencyAccessRepository
+	userRepo *repositories.UserRepository
+	duration time.Duration
+}
+
+func NewEmergencyHandler(repo *repositories.EmergencyAccessRepository, userRepo *repositories.UserRepository, duration time.Duration) *EmergencyHandler {
+	return &EmergencyHandler{repo: repo, userRepo: userRepo, duration: duration}
+}
+
+// BreakGlass godoc
+// @Summary      Emergency access to a patient's records
+// @Description  Gives a doctor access to a patient's records without consent for the configured emergency duration (doctor only). The justification is written to the blockchain, the patient is notified by email and the event waits for administrator review.
+// @Tags         access
+// @Accept       json
+// @Produce      json
+// @Param        request body models.EmergencyAccessRequest true "Patient IIN and justification"
+// @Param        Authorization header string true "Bearer"
+// @Success      201 {object} models.EmergencyAccess
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Failure      404 {object} map[string]string
+// @Failure      410 {object} map[string]string
+// @Router       /access/emergency [post]
+func (h *EmergencyHandler) BreakGlass(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.EmergencyAccessRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A patient IIN and a justification of at least 20 characters are required"})
+		return
+	}
+
+	doctorID, err := h.userRepo.GetDoctorIDByUserID(int(userID))
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Doctor profile not found"})
+		return
+	}
+
+	patient, err := h.userRepo.GetUserInfoByIIN(req.Iin)
+	if err != nil || patient.PatientDetails == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
+		return
+	}
+
+	access, err := h.repo.BreakGlass(doctorID, patient.PatientDetails.PatientId, req.Justification, h.duration)
+	if dataErased(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to grant emergency access", "Detailed": err.Error()})
+		return
+	}
+
+	// Access is already granted and logged, a slow or failing mail server must not hold up the doctor
+	go notifyPatientOfEmergency(patient.User, access)
+
+	c.JSON(http.StatusCreated, access)
+}
+
+func notifyPatientOfEmergency(patient models.User, access *models.EmergencyAccess) {
+	subject := "Emergency access to your medical records"
+	body := fmt.Sprintf("Dr. %s opened your medical records in an emergency on %s.\n"+
+		"Reason given: %s\n"+
+		"This access ends at %s and will be reviewed by an administrator.\n"+
+		"If you believe it was not justified, please contact the clinic.",
+		access.DoctorFullName, access.GrantedAt.Format("02.01.2006 15:04"),
+		access.Justification, access.ExpiresAt.Format("02.01.2006 15:04"))
+	if err := scripts.SendMail(patient.Email, subject, body); err != nil {
+		log.Printf("Failed to notify patient %d of emergency access %d: %v", patient.UserId, access.ID, err)
+	}
+}
+
+// GetEmergencyReviews godoc
+// @Summary      Emergency access review queue
+// @Description  List emergency accesses, oldest first (admin only). Defaults to those still pending review.
+// @Tags         access
+// @Produce      json
+// @Param        status query string false "Review status: pending, approved, flagged or all" default(pending)
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {array} models.EmergencyAccess
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Router       /access/emergency/reviews [get]
+func (h *EmergencyHandler) GetEmergencyReviews(c *gin.Context) {
+	status := c.DefaultQuery("status", "pending")
+	switch status {
+	case "pending", "approved", "flagged":
+	case "all":
+		status = ""
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Status must be pending, approved, flagged or all"})
+		return
+	}
+
+	accesses, err := h.repo.ListByReviewStatus(status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch emergency accesses", "Detailed": err.Error()})
+		return
+	}
+	if accesses == nil {
+		accesses = []models.EmergencyAccess{}
+	}
+	c.JSON(http.StatusOK, accesses)
+}
+
+// ReviewEmergencyAccess godoc
+// @Summary      Review an emergency access
+// @Description  Approve or flag a pending emergency access (admin only)
+// @Tags         access
+// @Accept       json
+// @Produce      json
+// @Param        id path int true "Emergency access ID"
+// @Param        request body models.EmergencyReviewRequest true "Review outcome"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} models.EmergencyAccess
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Failure      404 {object} map[string]string
+// @Failure      409 {object} map[string]string
+// @Router       /access/emergency/{id}/review [put]
+func (h *EmergencyHandler) ReviewEmergencyAccess(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid emergency access ID"})
+		return
+	}
+
+	var req models.EmergencyReviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Outcome must be approved or flagged"})
+		return
+	}
+
+	access, err := h.repo.Review(id, int(userID), req.Outcome, req.Notes)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, access)
+	case errors.Is(err, repositories.ErrEmergencyAccessNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Emergency access not found"})
+	case errors.Is(err, repositories.ErrEmergencyAlreadyReviewed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to review emergency access", "Detailed": err.Error()})
+	}
+}
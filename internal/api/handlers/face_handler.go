@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"diploma/internal/auth"
+	"diploma/internal/face"
+	"diploma/internal/repositories"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxPhotoSize bounds uploaded face photos
+const maxPhotoSize = 10 << 20
+
+// readPhoto reads the photo form file
+func readPhoto(c *gin.Context) ([]byte, error) {
+	file, err := c.FormFile("photo")
+	if err != nil {
+		return nil, errors.New("Photo is required")
+	}
+	if file.Size > maxPhotoSize {
+		return nil, errors.New("Photo is too large")
+	}
+
+	opened, err := file.Open()
+	if err != nil {
+		return nil, errors.New("Failed to open photo")
+	}
+	defer opened.Close()
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(opened, maxPhotoSize)); err != nil {
+		return nil, errors.New("Failed to read photo")
+	}
+	return buf.Bytes(), nil
+}
+
+// FaceOptions configures face verification
+type FaceOptions struct {
+	// Threshold is the largest face distance accepted as the same person
+	Threshold float64
+	// MaxAttempts is how many failed verifications a user may make within AttemptWindow
+	MaxAttempts   int
+	AttemptWindow time.Duration
+	// AccessTokenTTL is how long the tokens issued by step-up are valid
+	AccessTokenTTL time.Duration
+}
+
+type FaceHandler struct {
+	faces    *face.Client
+	repo     *repositories.FaceVerificationRepository
+	userRepo *repositories.UserRepository
+	logins   *LoginFlow
+	guard    *LoginGuard
+	options  FaceOptions
+}
+
+func NewFaceHandler(faces *face.Client, repo *repositories.FaceVerificationRepository, userRepo *repositories.UserRepository, logins *LoginFlow, guard *LoginGuard, options FaceOptions) *FaceHandler {
+	return &FaceHandler{faces: faces, repo: repo, userRepo: userRepo, logins: logins, guard: guard, options: options}
+}
+
+// FaceLogin godoc
+// @Summary      Log in with a face photo
+// @Description  Authenticate by comparing a live photo with the photo the user enrolled through POST /auth/upload-photo. Answers like POST /auth/login, including its second factor; the access token also counts as a recent face verification. Failed attempts are limited per user, and count towards the IIN and client IP lockout of POST /auth/login.
+// @Tags         auth
+// @Accept       multipart/form-data
+// @Produce      json
+// @Param        iin formData string true "IIN"
+// @Param        photo formData file true "Live photo"
+// @Success      200 {object} map[string]interface{}
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      429 {object} map[string]string
+// @Failure      502 {object} map[string]string
+// @Router       /auth/face-login [post]
+func (h *FaceHandler) FaceLogin(c *gin.Context) {
+	iin := c.PostForm("iin")
+	if iin == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "IIN is required"})
+		return
+	}
+	probe, err := readPhoto(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !h.guard.allow(c, iin) {
+		return
+	}
+
+	user, err := h.userRepo.GetUserByIin(iin)
+	if err != nil {
+		h.guard.failed(c, iin)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	// Only a photo the user enrolled themselves is a credential
+	reference, err := h.userRepo.GetEnrolledPhoto(user.UserId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load enrolled photo", "Detailed": err.Error()})
+		return
+	}
+	if len(reference) == 0 {
+		h.guard.failed(c, iin)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	if !h.verify(c, user.UserId, repositories.FacePurposeLogin, reference, probe) {
+		// Only a face that did not match is a failed login, not an unavailable service
+		if c.Writer.Status() == http.StatusUnauthorized {
+			h.guard.failed(c, iin)
+			h.logins.record(c, user.UserId, true, repositories.LoginFailed)
+		}
+		return
+	}
+	h.guard.succeeded(iin)
+
+	h.logins.Complete(c, user, true)
+}
+
+// StepUp godoc
+// @Summary      Verify face for a sensitive action
+// @Description  Compare a live photo with the authenticated user's enrolled photo. On a match a new access token is issued in the same session, marked with the time of the verification; routes that require a recent face verification accept it for a few minutes.
+// @Tags         auth
+// @Accept       multipart/form-data
+// @Produce      json
+// @Param        photo formData file true "Live photo"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} map[string]interface{}
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      429 {object} map[string]string
+// @Failure      502 {object} map[string]string
+// @Router       /auth/step-up [post]
+func (h *FaceHandler) StepUp(c *gin.Context) {
+	value, _ := c.Get("claims")
+	claims, ok := value.(*auth.Claims)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	probe, err := readPhoto(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	reference, err := h.userRepo.GetEnrolledPhoto(int(claims.UserID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load enrolled photo", "Detailed": err.Error()})
+		return
+	}
+	if len(reference) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No photo is enrolled for this user"})
+		return
+	}
+
+	if !h.verify(c, int(claims.UserID), repositories.FacePurposeStepUp, reference, probe) {
+		return
+	}
+
+	token, elevated, err := auth.GenerateStepUpToken(claims.UserID, claims.Role, claims.SessionID, h.options.AccessTokenTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"token":      token,
+		"expires_at": elevated.ExpiresAt.Time,
+		"step_up_at": elevated.StepUpAt.Time,
+	})
+}
+
+// verify compares a probe photo with a user's enrolled photo and records the
+// attempt. It writes the error response and returns false unless the faces match.
+func (h *FaceHandler) verify(c *gin.Context, userID int, purpose string, reference, probe []byte) bool {
+	// The attempt is reserved before the slow comparison, so concurrent
+	// requests cannot all be checked against the same failure count
+	attemptID, failures, err := h.repo.Reserve(userID, purpose, c.ClientIP(), h.options.MaxAttempts, h.options.AttemptWindow)
+	if errors.Is(err, repositories.ErrFaceAttemptsExceeded) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed face verifications, try again later"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check face verification attempts", "Detailed": err.Error()})
+		return false
+	}
+
+	result, err := h.faces.Compare(reference, probe, h.options.Threshold)
+	if err != nil {
+		if completeErr := h.repo.Complete(attemptID, repositories.FaceError, sql.NullFloat64{}); completeErr != nil {
+			log.Printf("Failed to record face verification of user %d: %v", userID, completeErr)
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Face verification is unavailable", "Detailed": err.Error()})
+		return false
+	}
+
+	// The service's own threshold may be looser than ours
+	matched := result.Match && result.Distance <= h.options.Threshold
+	status := repositories.FaceMismatched
+	if matched {
+		status = repositories.FaceMatched
+	}
+	if err := h.repo.Complete(attemptID, status, sql.NullFloat64{Float64: result.Distance, Valid: true}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record face verification", "Detailed": err.Error()})
+		return false
+	}
+
+	if !matched {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":              "Face does not match",
+			"attempts_remaining": h.options.MaxAttempts - failures - 1,
+		})
+		return false
+	}
+	return true
+}
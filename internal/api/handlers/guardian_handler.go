@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"diploma/internal/models"
+	"diploma/internal/repositories"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type GuardianHandler struct {
+	repo        *repositories.GuardianshipRepository
+	patientRepo *repositories.PatientRepository
+	userRepo    *repositories.UserRepository
+}
+
+func NewGuardianHandler(repo *repositories.GuardianshipRepository, patientRepo *repositories.PatientRepository, userRepo *repositories.UserRepository) *GuardianHandler {
+	return &GuardianHandler{repo: repo, patientRepo: patientRepo, userRepo: userRepo}
+}
+
+// OnBehalfOf lets a guardian call a patient route for a dependent by passing
+// the dependent's IIN in the on_behalf_of query parameter. The request then
+// runs as the dependent, with the guardian's user ID kept under
+// "guardian_user_id". Register it after AuthMiddleware and before
+// RoleMiddleware on the routes guardians may use.
+func (h *GuardianHandler) OnBehalfOf() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		iin := c.Query("on_behalf_of")
+		if iin == "" {
+			c.Next()
+			return
+		}
+
+		guardianUserID := c.GetUint("user_id")
+		dependent, err := h.userRepo.GetUserByIin(iin)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Dependent not found"})
+			return
+		}
+		patient, err := h.patientRepo.GetPatientByUserID(dependent.UserId)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Dependent not found"})
+			return
+		}
+
+		active, err := h.repo.IsActiveGuardian(int(guardianUserID), patient.PatientId)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !active {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "No active guardianship of this patient"})
+			return
+		}
+
+		log.Printf("User %d acting as guardian of patient %d: %s %s", guardianUserID, patient.PatientId, c.Request.Method, c.FullPath())
+		c.Set("guardian_user_id", guardianUserID)
+		c.Set("user_id", uint(dependent.UserId))
+		c.Set("role", "patient")
+		c.Next()
+	}
+}
+
+// RequestGuardianship godoc
+// @Summary      Request a guardianship
+// @Description  Ask to act for a dependent patient: a minor, until they come of age, or an adult who cannot act for themselves. The guardianship takes effect once an administrator verifies the supporting document. Guardians then pass on_behalf_of=<dependent IIN> to the patient routes for records, history, appointments and access requests.
+// @Tags         guardianships
+// @Accept       json
+// @Produce      json
+// @Param        request body models.GuardianshipRequest true "Dependent, relationship and supporting document"
+// @Param        Authorization header string true "Bearer"
+// @Success      201 {object} models.Guardianship
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      404 {object} map[string]string
+// @Failure      409 {object} map[string]string
+// @Router       /guardianships [post]
+func (h *GuardianHandler) RequestGuardianship(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.GuardianshipRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "Detailed": err.Error()})
+		return
+	}
+
+	guardianship, err := h.repo.Create(int(userID), req.DependentIIN, req.DependentType, req.Relationship, req.DocumentReference)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusCreated, guardianship)
+	case errors.Is(err, repositories.ErrGuardianshipDependentAbsent):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Dependent patient not found"})
+	case errors.Is(err, repositories.ErrGuardianOfSelf), errors.Is(err, repositories.ErrDependentNotMinor):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, repositories.ErrGuardianshipExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to request guardianship", "Detailed": err.Error()})
+	}
+}
+
+// GetGuardianships godoc
+// @Summary      List own guardianships
+// @Description  List the guardianships the authenticated user is the guardian or the dependent of, newest first
+// @Tags         guardianships
+// @Produce      json
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {array} models.Guardianship
+// @Failure      401 {object} map[string]string
+// @Router       /guardianships [get]
+func (h *GuardianHandler) GetGuardianships(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	guardianships, err := h.repo.ListByUser(int(userID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch guardianships", "Detailed": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, guardianships)
+}
+
+// GetGuardianshipReviews godoc
+// @Summary      Guardianship verification queue
+// @Description  List guardianships, oldest first (admin only). Defaults to those waiting for verification.
+// @Tags         guardianships
+// @Produce      json
+// @Param        status query string false "Status: pending, verified, rejected, revoked, ended or all" default(pending)
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {array} models.Guardianship
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Router       /guardianships/reviews [get]
+func (h *GuardianHandler) GetGuardianshipReviews(c *gin.Context) {
+	status := c.DefaultQuery("status", "pending")
+	switch status {
+	case "pending", "verified", "rejected", "revoked", "ended":
+	case "all":
+		status = ""
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Status must be pending, verified, rejected, revoked, ended or all"})
+		return
+	}
+
+	guardianships, err := h.repo.ListByStatus(status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch guardianships", "Detailed": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, guardianships)
+}
+
+// ReviewGuardianship godoc
+// @Summary      Verify a guardianship
+// @Description  Verify or reject a pending guardianship after checking its supporting document (admin only)
+// @Tags         guardianships
+// @Accept       json
+// @Produce      json
+// @Param        id path int true "Guardianship ID"
+// @Param        request body models.GuardianshipReviewRequest true "Review outcome"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} models.Guardianship
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Failure      404 {object} map[string]string
+// @Failure      409 {object} map[string]string
+// @Router       /guardianships/{id}/review [put]
+func (h *GuardianHandler) ReviewGuardianship(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid guardianship ID"})
+		return
+	}
+
+	var req models.GuardianshipReviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Outcome must be verified or rejected"})
+		return
+	}
+
+	guardianship, err := h.repo.Review(id, int(userID), req.Outcome, req.Notes)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, guardianship)
+	case errors.Is(err, repositories.ErrGuardianshipNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Guardianship not found"})
+	case errors.Is(err, repositories.ErrGuardianshipReviewed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to review guardianship", "Detailed": err.Error()})
+	}
+}
+
+// RevokeGuardianship godoc
+// @Summary      Revoke a guardianship
+// @Description  End a pending or verified guardianship (its guardian or an admin)
+// @Tags         guardianships
+// @Produce      json
+// @Param        id path int true "Guardianship ID"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} map[string]string
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Failure      404 {object} map[string]string
+// @Failure      409 {object} map[string]string
+// @Router       /guardianships/{id} [delete]
+func (h *GuardianHandler) RevokeGuardianship(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid guardianship ID"})
+		return
+	}
+
+	err = h.repo.Revoke(id, int(userID), c.GetString("role") == "admin")
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"message": "Guardianship revoked"})
+	case errors.Is(err, repositories.ErrGuardianshipNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Guardianship not found"})
+	case errors.Is(err, repositories.ErrGuardianshipNotOwned):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, repositories.ErrGuardianshipClosed):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke guardianship", "Detailed": err.Error()})
+	}
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"diploma/internal/auth"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+type JWKSHandler struct {
+	keys *auth.KeySet
+}
+
+func NewJWKSHandler(keys *auth.KeySet) *JWKSHandler {
+	return &JWKSHandler{keys: keys}
+}
+
+// GetJWKS godoc
+// @Summary      JSON Web Key Set
+// @Description  Public keys that validate the API's tokens, selected by the kid in the token header. HS256 secrets are not published.
+// @Tags         auth
+// @Produce      json
+// @Success      200 {object} auth.JWKS
+// @Router       /.well-known/jwks.json [get]
+func (h *JWKSHandler) GetJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.keys.JWKS())
+}
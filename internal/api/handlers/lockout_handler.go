@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"diploma/internal/repositories"
+	"diploma/internal/scripts"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// LoginGuard slows down and locks out repeated failed attempts to prove who
+// a user is: logins, reset codes and password changes
+type LoginGuard struct {
+	repo     *repositories.LoginThrottleRepository
+	userRepo *repositories.UserRepository
+	lockout  time.Duration
+}
+
+func NewLoginGuard(repo *repositories.LoginThrottleRepository, userRepo *repositories.UserRepository, lockout time.Duration) *LoginGuard {
+	return &LoginGuard{repo: repo, userRepo: userRepo, lockout: lockout}
+}
+
+// allow writes a 429 response and returns false if the IIN or client IP must
+// wait before another attempt
+func (g *LoginGuard) allow(c *gin.Context, iin string) bool {
+	wait, locked, err := g.repo.Check(iin, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts", "Detailed": err.Error()})
+		return false
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	message := "Too many failed attempts, try again later"
+	if locked {
+		message = "Account temporarily locked after too many failed attempts"
+	}
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": message, "retry_after": retryAfter})
+	return false
+}
+
+// failed counts a failed attempt. When it locks the IIN the user is told by
+// email, in case someone else is guessing their password.
+func (g *LoginGuard) failed(c *gin.Context, iin string) {
+	locked, err := g.repo.RecordFailure(iin, c.ClientIP())
+	if err != nil {
+		log.Printf("Failed to record failed attempt for %s: %v", c.ClientIP(), err)
+		return
+	}
+	if !locked {
+		return
+	}
+
+	log.Printf("Locked IIN %s after repeated failed attempts, last from %s", iin, c.ClientIP())
+	user, err := g.userRepo.GetUserByIin(iin)
+	if err != nil {
+		return
+	}
+	subject := "Your MedicineApp account has been locked"
+	body := fmt.Sprintf("There were too many failed attempts to sign in to your account, the last from %s.\n"+
+		"Signing in is blocked for %s. If this was not you, change your password once the lock ends "+
+		"or contact the clinic to have it lifted.", c.ClientIP(), g.lockout)
+	go func() {
+		if err := scripts.SendMail(user.Email, subject, body); err != nil {
+			log.Printf("Failed to notify user %d of lockout: %v", user.UserId, err)
+		}
+	}()
+}
+
+// succeeded clears the failures of an IIN
+func (g *LoginGuard) succeeded(iin string) {
+	if err := g.repo.RecordSuccess(iin); err != nil {
+		log.Printf("Failed to clear failed attempts: %v", err)
+	}
+}
+
+type LockoutHandler struct {
+	repo *repositories.LoginThrottleRepository
+}
+
+func NewLockoutHandler(repo *repositories.LoginThrottleRepository) *LockoutHandler {
+	return &LockoutHandler{repo: repo}
+}
+
+// GetLockouts godoc
+// @Summary      List lockouts
+// @Description  List the IINs and client IPs locked out after repeated failed attempts (admin only)
+// @Tags         auth
+// @Produce      json
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {array} models.Lockout
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Router       /lockouts [get]
+func (h *LockoutHandler) GetLockouts(c *gin.Context) {
+	lockouts, err := h.repo.ListLocked()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch lockouts", "Detailed": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, lockouts)
+}
+
+// Unlock godoc
+// @Summary      Lift a lockout
+// @Description  Unlock an IIN or client IP and forget its failed attempts (admin only)
+// @Tags         auth
+// @Produce      json
+// @Param        kind path string true "iin or ip"
+// @Param        subject path string true "IIN or IP address"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} map[string]string
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Failure      404 {object} map[string]string
+// @Router       /lockouts/{kind}/{subject} [delete]
+func (h *LockoutHandler) Unlock(c *gin.Context) {
+	kind := c.Param("kind")
+	if kind != repositories.ThrottleIIN && kind != repositories.ThrottleIP {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Kind must be iin or ip"})
+		return
+	}
+
+	err := h.repo.Unlock(kind, c.Param("subject"))
+	switch {
+	case err == nil:
+		log.Printf("Admin %d unlocked %s %s", c.GetUint("user_id"), kind, c.Param("subject"))
+		c.JSON(http.StatusOK, gin.H{"message": "Unlocked"})
+	case errors.Is(err, repositories.ErrLockoutNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock", "Detailed": err.Error()})
+	}
+}
@@ -0,0 +1,454 @@
+package handlers
+
+import (
+	"diploma/internal/auth"
+	"diploma/internal/models"
+	"diploma/internal/repositories"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+// LoginFlow finishes a login once its first factor, a password or a face,
+// has been checked. Users with a second factor, or whose role requires one,
+// get an MFA challenge token instead of a session.
+type LoginFlow struct {
+	sessions      *repositories.SessionRepository
+	totp          *repositories.TOTPRepository
+	users         *repositories.UserRepository
+	events        *repositories.LoginEventRepository
+	passwords     *Passwords
+	requiredRoles map[string]bool
+	accessTTL     time.Duration
+	challengeTTL  time.Duration
+}
+
+func NewLoginFlow(sessions *repositories.SessionRepository, totp *repositories.TOTPRepository, users *repositories.UserRepository, events *repositories.LoginEventRepository, passwords *Passwords, requiredRoles []string, accessTTL, challengeTTL time.Duration) *LoginFlow {
+	roles := make(map[string]bool, len(requiredRoles))
+	for _, role := range requiredRoles {
+		roles[role] = true
+	}
+	return &LoginFlow{sessions: sessions, totp: totp, users: users, events: events, passwords: passwords, requiredRoles: roles, accessTTL: accessTTL, challengeTTL: challengeTTL}
+}
+
+// Complete answers a login by the user with an MFA challenge or new tokens.
+// face marks logins whose first factor was the user's face.
+func (f *LoginFlow) Complete(c *gin.Context, user *models.User, face bool) {
+	suspension, err := f.users.GetSuspension(user.UserId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check account status", "Detailed": err.Error()})
+		return
+	}
+	if suspension != nil {
+		f.record(c, user.UserId, face, repositories.LoginSuspended)
+		c.JSON(http.StatusForbidden, gin.H{"error": repositories.ErrAccountSuspended.Error()})
+		return
+	}
+
+	// The initial password, or one past the maximum age for the role, must be
+	// changed before anything else. A face does not replace it.
+	expired, err := f.passwords.expired(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check password age", "Detailed": err.Error()})
+		return
+	}
+	if !user.PasswordChanged || expired {
+		message := "Password change required"
+		if expired {
+			message = "Password has expired and must be changed"
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":                 message,
+			"require_password_change": true,
+			"password_expired":        expired,
+			"token":                   nil,
+		})
+		return
+	}
+
+	enabled, err := f.totp.IsEnabled(user.UserId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check two-factor authentication", "Detailed": err.Error()})
+		return
+	}
+	if !enabled && !f.requiredRoles[user.Role] {
+		response, ok := f.startSession(c, uint(user.UserId), user.Role, face)
+		if ok {
+			response["user"] = user
+			c.JSON(http.StatusOK, response)
+		}
+		return
+	}
+
+	challenge, claims, err := auth.GenerateMFAChallenge(uint(user.UserId), user.Role, face, f.challengeTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	response := gin.H{"mfa_token": challenge, "expires_at": claims.ExpiresAt.Time}
+	if enabled {
+		response["message"] = "Enter the code from your authenticator app"
+		response["mfa_required"] = true
+	} else {
+		response["message"] = "Two-factor authentication must be set up before logging in"
+		response["mfa_enrollment_required"] = true
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// startSession creates a session and returns its tokens, or writes the error
+// response and returns false
+func (f *LoginFlow) startSession(c *gin.Context, userID uint, role string, face bool) (gin.H, bool) {
+	sessionID, refreshToken, err := f.sessions.Create(int(userID), c.Request.UserAgent(), c.ClientIP())
+	if errors.Is(err, repositories.ErrAccountSuspended) {
+		f.record(c, int(userID), face, repositories.LoginSuspended)
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session", "Detailed": err.Error()})
+		return nil, false
+	}
+	f.record(c, int(userID), face, repositories.LoginSucceeded)
+
+	generate := auth.GenerateToken
+	if face {
+		generate = auth.GenerateStepUpToken
+	}
+	token, claims, err := generate(userID, role, sessionID, f.accessTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return nil, false
+	}
+	return tokenResponse(token, claims, refreshToken), true
+}
+
+// record adds a login attempt to the user's login history
+func (f *LoginFlow) record(c *gin.Context, userID int, face bool, outcome string) {
+	method := repositories.LoginMethodPassword
+	if face {
+		method = repositories.LoginMethodFace
+	}
+	if err := f.events.Record(userID, method, outcome, c.ClientIP(), c.Request.UserAgent()); err != nil {
+		log.Printf("Failed to record login of user %d: %v", userID, err)
+	}
+}
+
+type MFAHandler struct {
+	totp     *repositories.TOTPRepository
+	userRepo *repositories.UserRepository
+	sessions *repositories.SessionRepository
+	logins   *LoginFlow
+	issuer   string
+}
+
+func NewMFAHandler(totp *repositories.TOTPRepository, userRepo *repositories.UserRepository, sessions *repositories.SessionRepository, logins *LoginFlow, issuer string) *MFAHandler {
+	return &MFAHandler{totp: totp, userRepo: userRepo, sessions: sessions, logins: logins, issuer: issuer}
+}
+
+// totpError writes the response for a failed second factor check
+func totpError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, repositories.ErrTOTPInvalidCode):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, repositories.ErrTOTPLocked):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	case errors.Is(err, repositories.ErrTOTPNotEnrolled):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, repositories.ErrTOTPAlreadyEnabled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check authentication code", "Detailed": err.Error()})
+	}
+}
+
+// enrollmentChallenge returns the MFA challenge a TOTP enrollment request was
+// made with, nil for an access token, and false after writing the error
+// response if the challenge may not enroll. A challenge proves only the
+// first factor, so it may set up the first authenticator of an account that
+// never had one, and only after a password: a face is not proof enough.
+func (h *MFAHandler) enrollmentChallenge(c *gin.Context) (*auth.Claims, bool) {
+	value, _ := c.Get("mfa_challenge")
+	challenge, ok := value.(*auth.Claims)
+	if !ok {
+		return nil, true
+	}
+	if challenge.StepUpAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Log in with your password to set up two-factor authentication"})
+		return nil, false
+	}
+	enrolled, err := h.totp.EverEnabled(int(challenge.UserID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check two-factor authentication", "Detailed": err.Error()})
+		return nil, false
+	}
+	if enrolled {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication was set up before on this account and cannot be set up again during login, contact an administrator"})
+		return nil, false
+	}
+	return challenge, true
+}
+
+// VerifyMFA godoc
+// @Summary      Complete login with a second factor
+// @Description  Exchange the mfa_token returned by login, and a code from the authenticator app or a recovery code, for the tokens login returns when no second factor is needed. Each challenge token works once.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        request body models.MFAVerifyRequest true "Challenge token and code"
+// @Success      200 {object} map[string]interface{}
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      429 {object} map[string]string
+// @Router       /auth/mfa/verify [post]
+func (h *MFAHandler) VerifyMFA(c *gin.Context) {
+	var req models.MFAVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "Detailed": err.Error()})
+		return
+	}
+
+	challenge, err := auth.ValidateMFAChallenge(req.MFAToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+	revoked, err := h.sessions.IsRevoked(challenge)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check MFA token", "Detailed": err.Error()})
+		return
+	}
+	if revoked {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "MFA token has already been used"})
+		return
+	}
+
+	usedRecovery, err := h.totp.Verify(int(challenge.UserID), req.Code)
+	if err != nil {
+		if errors.Is(err, repositories.ErrTOTPInvalidCode) {
+			h.logins.record(c, int(challenge.UserID), challenge.StepUpAt != nil, repositories.LoginMFAFailed)
+		}
+		totpError(c, err)
+		return
+	}
+	if usedRecovery {
+		log.Printf("User %d logged in with a recovery code", challenge.UserID)
+	}
+	h.finishChallenge(c, challenge, nil)
+}
+
+// finishChallenge spends a challenge token and answers with a new session's
+// tokens, merged with extra. Only the request that spends the token gets a
+// session; a concurrent one that checked it before is refused.
+func (h *MFAHandler) finishChallenge(c *gin.Context, challenge *auth.Claims, extra gin.H) {
+	spent, err := h.sessions.RevokeToken(challenge)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to spend MFA token", "Detailed": err.Error()})
+		return
+	}
+	if !spent {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "MFA token has already been used"})
+		return
+	}
+	response, ok := h.logins.startSession(c, challenge.UserID, challenge.Role, challenge.StepUpAt != nil)
+	if !ok {
+		return
+	}
+	for key, value := range extra {
+		response[key] = value
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetMFAStatus godoc
+// @Summary      Two-factor authentication status
+// @Description  Whether the authenticated user has TOTP enabled and whether their role requires it
+// @Tags         auth
+// @Produce      json
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} map[string]bool
+// @Failure      401 {object} map[string]string
+// @Router       /auth/mfa [get]
+func (h *MFAHandler) GetMFAStatus(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	enabled, err := h.totp.IsEnabled(int(userID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check two-factor authentication", "Detailed": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"totp_enabled": enabled,
+		"required":     h.logins.requiredRoles[c.GetString("role")],
+	})
+}
+
+// EnrollTOTP godoc
+// @Summary      Set up an authenticator app
+// @Description  Create a TOTP secret and return it with an otpauth:// provisioning URI to show as a QR code. It takes effect once confirmed with a code. Accepts an access token, or the mfa_token of a password login that requires enrollment; an mfa_token from a face login, or for an account that had TOTP before, is refused.
+// @Tags         auth
+// @Produce      json
+// @Param        Authorization header string true "Access token or MFA token"
+// @Success      200 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Failure      409 {object} map[string]string
+// @Router       /auth/mfa/totp [post]
+func (h *MFAHandler) EnrollTOTP(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	if _, ok := h.enrollmentChallenge(c); !ok {
+		return
+	}
+
+	user, err := h.userRepo.GetUserByID(int(userID))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	secret, err := h.totp.Enroll(user.UserId)
+	if err != nil {
+		totpError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           auth.TOTPEncoding.EncodeToString(secret),
+		"provisioning_uri": auth.TOTPProvisioningURI(h.issuer, user.Iin, secret),
+	})
+}
+
+// ConfirmTOTP godoc
+// @Summary      Confirm an authenticator app
+// @Description  Enable TOTP with a code from the newly set up app and return single-use recovery codes, shown only this once. When called with an mfa_token the login is completed and tokens are returned as well; the same mfa_token rules as for enrollment apply.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        request body models.TOTPCodeRequest true "Authenticator code"
+// @Param        Authorization header string true "Access token or MFA token"
+// @Success      200 {object} map[string]interface{}
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Failure      409 {object} map[string]string
+// @Failure      429 {object} map[string]string
+// @Router       /auth/mfa/totp/confirm [post]
+func (h *MFAHandler) ConfirmTOTP(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	challenge, ok := h.enrollmentChallenge(c)
+	if !ok {
+		return
+	}
+
+	var req models.TOTPCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "Detailed": err.Error()})
+		return
+	}
+
+	codes, err := h.totp.Confirm(int(userID), req.Code)
+	if err != nil {
+		totpError(c, err)
+		return
+	}
+
+	if challenge != nil {
+		h.finishChallenge(c, challenge, gin.H{"recovery_codes": codes})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// DisableTOTP godoc
+// @Summary      Turn off two-factor authentication
+// @Description  Remove the authenticator app and recovery codes after checking a current code. Not allowed for roles that require a second factor.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        request body models.TOTPCodeRequest true "Authenticator or recovery code"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} map[string]string
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Failure      429 {object} map[string]string
+// @Router       /auth/mfa/totp [delete]
+func (h *MFAHandler) DisableTOTP(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	if h.logins.requiredRoles[c.GetString("role")] {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for your role"})
+		return
+	}
+
+	var req models.TOTPCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "Detailed": err.Error()})
+		return
+	}
+	if _, err := h.totp.Verify(int(userID), req.Code); err != nil {
+		totpError(c, err)
+		return
+	}
+
+	if err := h.totp.Disable(int(userID)); err != nil {
+		totpError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication turned off"})
+}
+
+// RegenerateRecoveryCodes godoc
+// @Summary      Replace recovery codes
+// @Description  Replace all recovery codes, used or not, after checking a current code. The new codes are shown only this once.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        request body models.TOTPCodeRequest true "Authenticator code"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} map[string][]string
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      429 {object} map[string]string
+// @Router       /auth/mfa/recovery-codes [post]
+func (h *MFAHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.TOTPCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "Detailed": err.Error()})
+		return
+	}
+	if _, err := h.totp.Verify(int(userID), req.Code); err != nil {
+		totpError(c, err)
+		return
+	}
+
+	codes, err := h.totp.RegenerateRecoveryCodes(int(userID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recovery codes", "Detailed": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
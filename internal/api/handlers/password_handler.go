@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"diploma/internal/auth"
+	"diploma/internal/models"
+	"diploma/internal/repositories"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+// Passwords applies the password policy to the passwords users choose and
+// to the age of the one they log in with
+type Passwords struct {
+	policy   *auth.PasswordPolicy
+	userRepo *repositories.UserRepository
+}
+
+func NewPasswords(policy *auth.PasswordPolicy, userRepo *repositories.UserRepository) *Passwords {
+	return &Passwords{policy: policy, userRepo: userRepo}
+}
+
+// check returns a *auth.PasswordPolicyError if the user may not choose password
+func (p *Passwords) check(user *models.User, password string) error {
+	previous := []string{user.Password}
+	if p.policy.History > 1 {
+		history, err := p.userRepo.PasswordHistory(user.UserId, p.policy.History)
+		if err != nil {
+			return err
+		}
+		for _, hash := range history {
+			if hash != user.Password {
+				previous = append(previous, hash)
+			}
+		}
+	}
+	personal := []string{user.Iin, user.FirstName, user.LastName, user.Email}
+	return p.policy.Check(password, personal, previous)
+}
+
+// expired reports whether the user's password is older than their role allows
+func (p *Passwords) expired(user *models.User) (bool, error) {
+	if p.policy.MaxAge[user.Role] <= 0 {
+		return false, nil
+	}
+	changedAt, err := p.userRepo.PasswordChangedAt(user.UserId)
+	if err != nil {
+		return false, err
+	}
+	return p.policy.Expired(user.Role, changedAt, time.Now()), nil
+}
+
+// policyViolations writes a 400 response listing the broken rules and
+// returns true if err is a password policy error
+func policyViolations(c *gin.Context, err error) bool {
+	var policyErr *auth.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Password does not meet the password policy", "violations": policyErr.Violations})
+	return true
+}
+
+// GetPasswordPolicy godoc
+// @Summary      Get the password policy
+// @Description  The rules new passwords must follow, so clients can explain them before submitting. Maximum ages are in days by role.
+// @Tags         auth
+// @Produce      json
+// @Success      200 {object} map[string]interface{}
+// @Router       /auth/password-policy [get]
+func (p *Passwords) GetPasswordPolicy(c *gin.Context) {
+	maxAgeDays := make(map[string]int, len(p.policy.MaxAge))
+	for role, maxAge := range p.policy.MaxAge {
+		maxAgeDays[role] = int(maxAge / (24 * time.Hour))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"min_length":            p.policy.MinLength,
+		"min_character_classes": p.policy.MinClasses,
+		"history":               p.policy.History,
+		"max_age_days":          maxAgeDays,
+		"breach_check":          p.policy.Breached != nil,
+	})
+}
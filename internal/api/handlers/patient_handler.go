@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
 	"strconv"
 
@@ -12,19 +13,23 @@ import (
 )
 
 type PatientHandler struct {
-	repo *repositories.PatientRepository
+	repo        *repositories.PatientRepository
+	patientKeys *repositories.PatientKeyRepository
 }
 
-func NewPatientHandler(repo *repositories.PatientRepository) *PatientHandler {
-	return &PatientHandler{repo: repo}
+func NewPatientHandler(repo *repositories.PatientRepository, patientKeys *repositories.PatientKeyRepository) *PatientHandler {
+	return &PatientHandler{repo: repo, patientKeys: patientKeys}
 }
 
 // GetPatients godoc
 // @Summary      Get all patients
-// @Description  Fetch a list of all patients
+// @Description  Fetch a list of all patients (admin only)
 // @Tags         patients
 // @Produce      json
+// @Param        Authorization header string true "Bearer"
 // @Success      200  {array}  models.Patient
+// @Failure      401  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
 // @Router       /patients [get]
 func (h *PatientHandler) GetPatients(c *gin.Context) {
 	patients, err := h.repo.GetPatients()
@@ -37,11 +42,14 @@ func (h *PatientHandler) GetPatients(c *gin.Context) {
 
 // GetPatientByID godoc
 // @Summary      Get a patient by ID
-// @Description  Fetch a patient by its ID
+// @Description  Fetch a patient by its ID (admin only)
 // @Tags         patients
 // @Produce      json
 // @Param        id  path  int  true  "Patient ID"
+// @Param        Authorization header string true "Bearer"
 // @Success      200  {object}  models.Patient
+// @Failure      401  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
 // @Failure      404  {object}  map[string]string
 // @Router       /patients/{id} [get]
 func (h *PatientHandler) GetPatientByID(c *gin.Context) {
@@ -59,6 +67,48 @@ func (h *PatientHandler) GetPatientByID(c *gin.Context) {
 	c.JSON(http.StatusOK, patient)
 }
 
+// ShredPatientData godoc
+// @Summary      Crypto-shred a patient's on-chain record details
+// @Description  Destroy the patient's data key so the record details stored encrypted on the blockchain can never be read again, and nothing more can be recorded for the patient. The chain still verifies. Details in blocks written before encryption was introduced are stored in plaintext and cannot be removed without breaking the chain; plaintext_blocks counts them, and erased is true only if there are none (admin only).
+// @Tags         patients
+// @Produce      json
+// @Param        Authorization header string true "Bearer"
+// @Param        id  path  int  true  "Patient ID"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  map[string]string
+// @Failure      401  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Failure      500  {object}  map[string]string
+// @Router       /patients/{id}/data-key [delete]
+func (h *PatientHandler) ShredPatientData(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	if _, err := h.repo.GetPatientByID(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
+		return
+	}
+	if err := h.patientKeys.Shred(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	plaintext, err := h.patientKeys.PlaintextBlocks(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Patient data key shredded, but failed to count plaintext blocks", "Detailed": err.Error()})
+		return
+	}
+
+	message := "Patient data key shredded, all on-chain record details are erased"
+	if plaintext > 0 {
+		message = fmt.Sprintf("Patient data key shredded, but %d blocks written before encryption still hold record details in plaintext", plaintext)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": message, "erased": plaintext == 0, "plaintext_blocks": plaintext})
+}
+
 //// GetUserByIIN godoc
 //// @Summary      Get a user by IIN
 //// @Description  Fetch a user by its IIN
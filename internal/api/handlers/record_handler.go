@@ -3,6 +3,7 @@ package handlers
 import (
 	"diploma/internal/models"
 	"diploma/internal/repositories"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"strconv"
@@ -14,6 +15,17 @@ type RecordHandler struct {
 	PatientRepo *repositories.PatientRepository
 }
 
+// dataErased writes a 410 response and returns true if err shows the
+// patient's data key was shredded, after which nothing more can be stored
+// on-chain for them
+func dataErased(c *gin.Context, err error) bool {
+	if !errors.Is(err, repositories.ErrDataKeyShredded) {
+		return false
+	}
+	c.JSON(http.StatusGone, gin.H{"error": "The patient's data has been erased, nothing more can be recorded for them"})
+	return true
+}
+
 type CreateRecordRequest struct {
 	Record models.Record `json:"record"`
 }
@@ -30,16 +42,12 @@ func NewRecordHandler(recordRepo *repositories.RecordRepository, userRepo *repos
 // @Param        iin  path  string  true  "IIN"
 // @Param 		 Authorization header string true "Bearer"
 // @Success      200  {array}  models.RecordWithDetails
+// @Failure      403  {object}  map[string]string
 // @Failure      404  {object}  map[string]string
 // @Router       /records/{iin} [get]
 func (h *RecordHandler) GetRecordByIIN(c *gin.Context) {
 	userID := c.GetUint("user_id")
-	//doctor, err := h.UserRepo.GetDoctorByUserId(strconv.Itoa(int(userID)))
-	//if err != nil {
-	//	c.JSON(http.StatusUnauthorized, gin.H{"error": "Doctor not found"})
-	//	return
-	//}
-	_, err := h.UserRepo.GetDoctorByUserId(strconv.Itoa(int(userID)))
+	doctor, err := h.UserRepo.GetDoctorByUserId(strconv.Itoa(int(userID)))
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Doctor not found"})
 		return
@@ -52,30 +60,18 @@ func (h *RecordHandler) GetRecordByIIN(c *gin.Context) {
 		return
 	}
 
-	//patient, err := h.PatientRepo.GetPatientByUserID(user.UserId)
-	//if err != nil {
-	//	c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
-	//	return
-	//}
-	_, err = h.PatientRepo.GetPatientByUserID(user.UserId)
+	patient, err := h.PatientRepo.GetPatientByUserID(user.UserId)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
 		return
 	}
 
-	//// Check if doctor has valid access
-	//hasAccess, err := h.RecordRepo.HasValidAccess(doctor.DoctorId, patient.PatientId)
-	//if err != nil {
-	//	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-	//	return
-	//}
-	//
-	//if !hasAccess {
-	//	c.JSON(http.StatusForbidden, gin.H{"error": "No valid access to patient records"})
-	//	return
-	//}
+	scope, ok := h.requireAccess(c, doctor.DoctorId, patient.PatientId)
+	if !ok {
+		return
+	}
 
-	records, err := h.RecordRepo.GetRecordsByIIN(iin)
+	records, err := h.RecordRepo.GetRecordsByIIN(iin, scope)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Records not found"})
 		return
@@ -112,6 +108,8 @@ func (h *RecordHandler) GetRecordByClaim(c *gin.Context) {
 // @Param        Authorization header string true "Bearer"
 // @Success      201  {object}  map[string]interface{}
 // @Failure      400  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
+// @Failure      410  {object}  map[string]string
 // @Router       /records [post]
 func (h *RecordHandler) CreateRecord(c *gin.Context) {
 	var request models.RecordRequest
@@ -143,6 +141,11 @@ func (h *RecordHandler) CreateRecord(c *gin.Context) {
 		return
 	}
 
+	scope, ok := h.requireAccess(c, doctor.DoctorId, patient.PatientId)
+	if !ok {
+		return
+	}
+
 	record := models.Record{
 		PatientId:     patient.PatientId,
 		DoctorId:      doctor.DoctorId,
@@ -152,8 +155,19 @@ func (h *RecordHandler) CreateRecord(c *gin.Context) {
 		TestResult:    request.TestResult,
 	}
 
+	// A doctor may only write the categories they are allowed to read
+	restricted := record
+	scope.FilterRecord(&restricted)
+	if restricted != record {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No access to some of the record categories"})
+		return
+	}
+
 	// Create record
 	if err := h.RecordRepo.CreateRecord(&record); err != nil {
+		if dataErased(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -188,7 +202,9 @@ func (h *RecordHandler) CreateRecord(c *gin.Context) {
 // @Param 		 Authorization header string true "Bearer"
 // @Success      200  {object}  models.Record
 // @Failure      400  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
 // @Failure      404  {object}  map[string]string
+// @Failure      410  {object}  map[string]string
 // @Router       /records/{id} [put]
 func (h *RecordHandler) UpdateRecord(c *gin.Context) {
 	recordID, err := strconv.Atoi(c.Param("id"))
@@ -223,6 +239,11 @@ func (h *RecordHandler) UpdateRecord(c *gin.Context) {
 		return
 	}
 
+	scope, ok := h.requireAccess(c, doctor.DoctorId, existingRecord.PatientId)
+	if !ok {
+		return
+	}
+
 	updatedRecord := models.Record{
 		RecordId:      recordID,
 		PatientId:     existingRecord.PatientId,
@@ -234,8 +255,22 @@ func (h *RecordHandler) UpdateRecord(c *gin.Context) {
 		CreatedAt:     existingRecord.CreatedAt,
 	}
 
+	// Categories outside the doctor's scope were never shown to them and keep their value
+	if !scope[models.ScopeDiagnosis] {
+		updatedRecord.Diagnosis = existingRecord.Diagnosis
+	}
+	if !scope[models.ScopeTreatmentPlan] {
+		updatedRecord.TreatmentPlan = existingRecord.TreatmentPlan
+	}
+	if !scope[models.ScopeTestResult] {
+		updatedRecord.TestResult = existingRecord.TestResult
+	}
+
 	// Update the record
 	if err := h.RecordRepo.UpdateRecord(&updatedRecord); err != nil {
+		if dataErased(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -252,5 +287,209 @@ func (h *RecordHandler) UpdateRecord(c *gin.Context) {
 		return
 	}
 
+	scope.FilterRecord(&updatedRecord)
 	c.JSON(http.StatusOK, updatedRecord)
 }
+
+// GetRecordHistory godoc
+// @Summary      Get the history of a record
+// @Description  List every committed version of a record from the blockchain, with changes between consecutive versions
+// @Tags         medical records
+// @Produce      json
+// @Param        id   path  int  true  "Record ID"
+// @Param 		 Authorization header string true "Bearer"
+// @Success      200  {array}  models.RecordVersion
+// @Failure      400  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Router       /records/{id}/history [get]
+func (h *RecordHandler) GetRecordHistory(c *gin.Context) {
+	// The route shares its wildcard with /records/:iin, see routes.go
+	recordID, err := strconv.Atoi(c.Param("iin"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid record ID"})
+		return
+	}
+
+	record, err := h.RecordRepo.GetRecordByID(recordID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found"})
+		return
+	}
+
+	scope, ok := h.authorizeRecordRead(c, record.PatientId)
+	if !ok {
+		return
+	}
+
+	history, err := h.RecordRepo.GetRecordHistory(recordID, scope)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, history)
+}
+
+// GetOwnHistory godoc
+// @Summary      Get the history of the patient's records
+// @Description  List every committed version of every record of the authenticated patient
+// @Tags         medical records
+// @Produce      json
+// @Param 		 Authorization header string true "Bearer"
+// @Success      200  {array}  models.RecordVersion
+// @Failure      404  {object}  map[string]string
+// @Router       /records/history [get]
+func (h *RecordHandler) GetOwnHistory(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	patient, err := h.PatientRepo.GetPatientByUserID(int(userID))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
+		return
+	}
+
+	history, err := h.RecordRepo.GetPatientHistory(patient.PatientId, repositories.FullAccessScope())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, history)
+}
+
+// GetPatientHistory godoc
+// @Summary      Get the history of a patient's records by IIN
+// @Description  List every committed version of every record of a patient
+// @Tags         medical records
+// @Produce      json
+// @Param        iin  path  string  true  "Patient IIN"
+// @Param 		 Authorization header string true "Bearer"
+// @Success      200  {array}  models.RecordVersion
+// @Failure      403  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Router       /records/patients/{iin}/history [get]
+func (h *RecordHandler) GetPatientHistory(c *gin.Context) {
+	user, err := h.UserRepo.GetUserByIin(c.Param("iin"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
+		return
+	}
+
+	patient, err := h.PatientRepo.GetPatientByUserID(user.UserId)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Patient not found"})
+		return
+	}
+
+	scope, ok := h.authorizeRecordRead(c, patient.PatientId)
+	if !ok {
+		return
+	}
+
+	history, err := h.RecordRepo.GetPatientHistory(patient.PatientId, scope)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, history)
+}
+
+// authorizeRecordRead applies the record read rules for the authenticated user:
+// patients may read all of their own records and doctors what the patient
+// consented to. It returns the readable record categories, or writes the
+// error response and returns false when access is denied.
+func (h *RecordHandler) authorizeRecordRead(c *gin.Context, patientID int) (repositories.AccessScope, bool) {
+	userID := c.GetUint("user_id")
+
+	switch c.GetString("role") {
+	case "patient":
+		patient, err := h.PatientRepo.GetPatientByUserID(int(userID))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Patient not found"})
+			return nil, false
+		}
+		if patient.PatientId != patientID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Unauthorized to view this record"})
+			return nil, false
+		}
+		return repositories.FullAccessScope(), true
+
+	case "doctor":
+		doctor, err := h.UserRepo.GetDoctorByUserId(strconv.Itoa(int(userID)))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Doctor not found"})
+			return nil, false
+		}
+		return h.requireAccess(c, doctor.DoctorId, patientID)
+
+	default:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid role"})
+		return nil, false
+	}
+}
+
+// requireAccess returns the record categories the doctor may access, see
+// RecordRepository.AccessScope. It writes the error response and returns
+// false when the patient has not consented to any.
+func (h *RecordHandler) requireAccess(c *gin.Context, doctorID, patientID int) (repositories.AccessScope, bool) {
+	scope, err := h.RecordRepo.AccessScope(doctorID, patientID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if len(scope) == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "No valid access to patient records"})
+		return nil, false
+	}
+	return scope, true
+}
+
+// GetRecordProof godoc
+// @Summary      Get a Merkle inclusion proof for a record version
+// @Description  Return the header of the block holding a record version and a proof that it is included in its batch's Merkle root. Without block_index the latest version is used. The record data is not returned; read it from the record history, which applies the caller's consent scope.
+// @Tags         medical records
+// @Produce      json
+// @Param        id           path   int  true   "Record ID"
+// @Param        block_index  query  int  false  "Block index of the record version"
+// @Param 		 Authorization header string true "Bearer"
+// @Success      200  {object}  map[string]interface{}
+// @Failure      400  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
+// @Failure      404  {object}  map[string]string
+// @Router       /records/{id}/proof [get]
+func (h *RecordHandler) GetRecordProof(c *gin.Context) {
+	// The route shares its wildcard with /records/:iin, see routes.go
+	recordID, err := strconv.Atoi(c.Param("iin"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid record ID"})
+		return
+	}
+
+	blockIndex := -1
+	if value := c.Query("block_index"); value != "" {
+		blockIndex, err = strconv.Atoi(value)
+		if err != nil || blockIndex < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid block index"})
+			return
+		}
+	}
+
+	record, err := h.RecordRepo.GetRecordByID(recordID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found"})
+		return
+	}
+
+	if _, ok := h.authorizeRecordRead(c, record.PatientId); !ok {
+		return
+	}
+
+	block, proof, err := h.RecordRepo.GetRecordProof(recordID, blockIndex)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record version not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"block": block.Header(),
+		"proof": proof,
+	})
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"diploma/internal/auth"
+	"diploma/internal/models"
+	"diploma/internal/repositories"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+type SessionHandler struct {
+	repo      *repositories.SessionRepository
+	accessTTL time.Duration
+}
+
+func NewSessionHandler(repo *repositories.SessionRepository, accessTTL time.Duration) *SessionHandler {
+	return &SessionHandler{repo: repo, accessTTL: accessTTL}
+}
+
+// tokenResponse returns an access token with its session's refresh token
+func tokenResponse(token string, claims *auth.Claims, refreshToken string) gin.H {
+	return gin.H{
+		"token":         token,
+		"refresh_token": refreshToken,
+		"expires_at":    claims.ExpiresAt.Time,
+	}
+}
+
+// Refresh godoc
+// @Summary      Refresh tokens
+// @Description  Exchange a refresh token for a new access token and refresh token. Each refresh token works once; presenting one again revokes its whole session, since it must have been copied.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        request body models.RefreshTokenRequest true "Refresh token"
+// @Success      200 {object} map[string]interface{}
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Router       /auth/refresh [post]
+func (h *SessionHandler) Refresh(c *gin.Context) {
+	var req models.RefreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "Detailed": err.Error()})
+		return
+	}
+
+	user, sessionID, refreshToken, err := h.repo.Rotate(req.RefreshToken, c.Request.UserAgent(), c.ClientIP())
+	switch {
+	case err == nil:
+	case errors.Is(err, repositories.ErrRefreshTokenReused):
+		log.Printf("Refresh token reused from %s, its session was revoked", c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, repositories.ErrRefreshTokenInvalid):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, repositories.ErrAccountSuspended):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh tokens", "Detailed": err.Error()})
+		return
+	}
+
+	token, claims, err := auth.GenerateToken(uint(user.UserId), user.Role, sessionID, h.accessTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	c.JSON(http.StatusOK, tokenResponse(token, claims, refreshToken))
+}
+
+// Logout godoc
+// @Summary      Log out
+// @Description  Revoke the access token and end its session, or with all set end every session of the user
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        request body models.LogoutRequest false "Whether to end every session"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} map[string]string
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Router       /auth/logout [post]
+func (h *SessionHandler) Logout(c *gin.Context) {
+	value, _ := c.Get("claims")
+	claims, ok := value.(*auth.Claims)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.LogoutRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "Detailed": err.Error()})
+			return
+		}
+	}
+
+	if _, err := h.repo.RevokeToken(claims); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token", "Detailed": err.Error()})
+		return
+	}
+
+	if req.All {
+		if _, err := h.repo.RevokeAll(int(claims.UserID)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end sessions", "Detailed": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out of all sessions"})
+		return
+	}
+
+	if claims.SessionID != "" {
+		err := h.repo.Revoke(int(claims.UserID), claims.SessionID)
+		if err != nil && !errors.Is(err, repositories.ErrSessionNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end session", "Detailed": err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// GetSessions godoc
+// @Summary      List own sessions
+// @Description  List the authenticated user's active sessions with their devices, most recently used first
+// @Tags         auth
+// @Produce      json
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {array} models.Session
+// @Failure      401 {object} map[string]string
+// @Router       /auth/sessions [get]
+func (h *SessionHandler) GetSessions(c *gin.Context) {
+	value, _ := c.Get("claims")
+	claims, ok := value.(*auth.Claims)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	sessions, err := h.repo.ListActive(int(claims.UserID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions", "Detailed": err.Error()})
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == claims.SessionID
+	}
+	c.JSON(http.StatusOK, sessions)
+}
+
+// RevokeSession godoc
+// @Summary      End a session
+// @Description  Log out one of the authenticated user's sessions, such as a lost device
+// @Tags         auth
+// @Produce      json
+// @Param        id path string true "Session ID"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      404 {object} map[string]string
+// @Router       /auth/sessions/{id} [delete]
+func (h *SessionHandler) RevokeSession(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	if userID == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	err := h.repo.Revoke(int(userID), c.Param("id"))
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"message": "Session ended"})
+	case errors.Is(err, repositories.ErrSessionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end session", "Detailed": err.Error()})
+	}
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"diploma/internal/auth"
+	"diploma/internal/events"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"time"
+)
+
+// streamHeartbeat keeps idle streams open through proxies that close silent
+// connections. The token is checked again on each one.
+const streamHeartbeat = 25 * time.Second
+
+type StreamHandler struct {
+	broker *events.Broker
+}
+
+func NewStreamHandler(broker *events.Broker) *StreamHandler {
+	return &StreamHandler{broker: broker}
+}
+
+// StreamAccessRequests godoc
+// @Summary      Stream access request changes
+// @Description  Server-Sent Events stream of the access requests the authenticated user is a party to. Event names are created, status_changed, expiring, expired and resync; after resync, or when the stream ends, reload GET /access/requests. The token may be given in the token query parameter for EventSource clients. The stream ends with a revoked event when the token expires or is revoked, such as on logout.
+// @Tags         access
+// @Produce      text/event-stream
+// @Param        Authorization header string false "Bearer"
+// @Param        token query string false "JWT, for clients that cannot set headers"
+// @Success      200 {object} events.Event
+// @Failure      401 {object} map[string]string
+// @Router       /access/stream [get]
+func (h *StreamHandler) StreamAccessRequests(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	value, _ := c.Get("claims")
+	claims, ok := value.(*auth.Claims)
+	if userID == 0 || !ok || claims.ExpiresAt == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	stream, unsubscribe := h.broker.Subscribe(userID)
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	expiry := time.NewTimer(time.Until(claims.ExpiresAt.Time))
+	defer expiry.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-stream:
+			if !ok {
+				// Fell behind or the broker closed, the client reconnects and reloads
+				return false
+			}
+			c.SSEvent(event.Type, event)
+			return true
+		case <-heartbeat.C:
+			if !auth.StillValid(claims) {
+				c.SSEvent("revoked", gin.H{"error": "Token has expired or been revoked"})
+				return false
+			}
+			_, err := io.WriteString(w, ": heartbeat\n\n")
+			return err == nil
+		case <-expiry.C:
+			c.SSEvent("revoked", gin.H{"error": "Token has expired or been revoked"})
+			return false
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
@@ -1,36 +1,46 @@
 package handlers
 
 import (
-	"bytes"
 	"diploma/internal/auth"
+	"diploma/internal/face"
 	"diploma/internal/models"
 	"diploma/internal/repositories"
 	"diploma/internal/scripts"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"io"
-	"math/rand"
-	"mime/multipart"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
 )
 
 type UserHandler struct {
-	repo *repositories.UserRepository
+	repo                *repositories.UserRepository
+	sessions            *repositories.SessionRepository
+	logins              *LoginFlow
+	guard               *LoginGuard
+	passwords           *Passwords
+	resets              *repositories.PasswordResetRepository
+	resetTTL            time.Duration
+	faces               *face.Client
+	faceEnrollmentTTL   time.Duration
+	accessGrantDuration time.Duration
 }
 
-func NewUserHandler(repo *repositories.UserRepository) *UserHandler {
-	return &UserHandler{repo: repo}
+func NewUserHandler(repo *repositories.UserRepository, sessions *repositories.SessionRepository, logins *LoginFlow, guard *LoginGuard, passwords *Passwords, resets *repositories.PasswordResetRepository, resetTTL time.Duration, faces *face.Client, faceEnrollmentTTL, accessGrantDuration time.Duration) *UserHandler {
+	return &UserHandler{repo: repo, sessions: sessions, logins: logins, guard: guard, passwords: passwords, resets: resets, resetTTL: resetTTL, faces: faces, faceEnrollmentTTL: faceEnrollmentTTL, accessGrantDuration: accessGrantDuration}
 }
 
 // GetUsers godoc
 // @Summary      Get all users
-// @Description  Fetch a list of all users
+// @Description  Fetch a list of all users (admin only)
 // @Tags         users
 // @Produce      json
+// @Param        Authorization header string true "Bearer"
 // @Success      200  {array}  models.User
+// @Failure      401  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
 // @Router       /users [get]
 func (h *UserHandler) GetUsers(c *gin.Context) {
 	users, err := h.repo.GetUsers()
@@ -43,11 +53,14 @@ func (h *UserHandler) GetUsers(c *gin.Context) {
 
 // GetUserByID godoc
 // @Summary      Get a user by ID
-// @Description  Fetch a user by its ID
+// @Description  Fetch a user by its ID (admin only)
 // @Tags         users
 // @Produce      json
 // @Param        id  path  int  true  "User ID"
+// @Param        Authorization header string true "Bearer"
 // @Success      200  {object}  models.User
+// @Failure      401  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
 // @Failure      404  {object}  map[string]string
 // @Router       /users/{id} [get]
 func (h *UserHandler) GetUserByID(c *gin.Context) {
@@ -67,14 +80,16 @@ func (h *UserHandler) GetUserByID(c *gin.Context) {
 
 // CreateUser godoc
 // @Summary      Create a new user
-// @Description  Create a new user with the provided details
+// @Description  Create a new user with the provided details. Patients may register themselves through /auth/register; doctor and admin accounts are created by an administrator through POST /users.
 // @Tags         auth
 // @Accept       json
 // @Produce      json
 // @Param        user  body  models.UserRequest  true  "User request object"
 // @Success      201  {object}  models.UserRequest
 // @Failure      400  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
 // @Router       /auth/register [post]
+// @Router       /users [post]
 func (h *UserHandler) CreateUser(c *gin.Context) {
 	var userRequest models.UserRequest
 	if err := c.ShouldBindJSON(&userRequest); err != nil {
@@ -94,8 +109,16 @@ func (h *UserHandler) CreateUser(c *gin.Context) {
 		return
 	}
 
-	// Validate role
-	if userRequest.Role != "doctor" && userRequest.Role != "patient" {
+	// Validate role. Anyone may register as a patient; doctors and
+	// administrators are created by an administrator.
+	switch userRequest.Role {
+	case "patient":
+	case "doctor", "admin":
+		if c.GetString("role") != "admin" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only an administrator can create " + userRequest.Role + " accounts"})
+			return
+		}
+	default:
 		c.JSON(http.StatusBadRequest, models.ErrorResponse{Message: "Invalid role"})
 		return
 	}
@@ -127,94 +150,78 @@ func (h *UserHandler) CreateUser(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{
+	response := gin.H{
 		"message": "User created successfully. Please upload your photo for face verification.",
 		"user_id": userRequest.UserId,
-	})
+	}
+	// A user who registered themselves may enroll their face right away.
+	// Accounts created by an administrator enroll after their first login.
+	if c.GetString("role") != "admin" {
+		token, claims, err := auth.GenerateFaceEnrollmentToken(uint(userRequest.UserId), userRequest.Role, h.faceEnrollmentTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+		response["face_enrollment_token"] = token
+		response["face_enrollment_expires_at"] = claims.ExpiresAt.Time
+	}
+	c.JSON(http.StatusCreated, response)
 }
 
 // UploadPhoto godoc
-// @Summary      Upload user photo for face verification
-// @Description  Upload and verify user's photo
+// @Summary      Enroll user photo for face verification
+// @Description  Enroll the photo used for face login and step-up. Requires the user's access token, or the face_enrollment_token returned on registration, which works once. A photo can be enrolled once; an enrolled photo is not replaced.
 // @Tags         auth
 // @Accept       multipart/form-data
 // @Produce      json
-// @Param        user_id formData int true "User ID"
 // @Param        photo formData file true "User Photo"
+// @Param        Authorization header string true "Access token or face enrollment token"
 // @Success      200 {object} map[string]string
 // @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      409 {object} map[string]string
 // @Router       /auth/upload-photo [post]
 func (h *UserHandler) UploadPhoto(c *gin.Context) {
-	userID, err := strconv.Atoi(c.PostForm("user_id"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
-		return
-	}
+	userID := int(c.GetUint("user_id"))
 
-	// Get photo file
-	file, err := c.FormFile("photo")
+	photoBytes, err := readPhoto(c)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Photo is required"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Open the file
-	openedFile, err := file.Open()
+	detectResp, err := h.faces.Detect(photoBytes)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open photo"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate face", "Detailed": err.Error()})
 		return
 	}
-	defer openedFile.Close()
 
-	// Read file content
-	var buf bytes.Buffer
-	if _, err := io.Copy(&buf, openedFile); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read photo"})
+	if !detectResp.HasFace || detectResp.FaceCount != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Image must contain exactly one face"})
 		return
 	}
-	photoBytes := buf.Bytes()
 
-	// Send to Python face detection
-	var b bytes.Buffer
-	w := multipart.NewWriter(&b)
-	fw, err := w.CreateFormFile("file", file.Filename)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare photo for face detection"})
-		return
+	// An enrolled face logs the user in, so it is never replaced here
+	method := repositories.FaceEnrolledWithAccessToken
+	value, isEnrollment := c.Get("face_enrollment")
+	if isEnrollment {
+		method = repositories.FaceEnrolledOnRegistration
 	}
-	fw.Write(photoBytes)
-	w.Close()
-
-	req, err := http.NewRequest("POST", "http://134.122.84.85:8000/detect_face/", &b)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create face detection request"})
+	err = h.repo.EnrollPhoto(userID, photoBytes, method)
+	switch {
+	case errors.Is(err, repositories.ErrFaceAlreadyEnrolled):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 		return
-	}
-	req.Header.Set("Content-Type", w.FormDataContentType())
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != 200 {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate face"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save photo", "Detailed": err.Error()})
 		return
 	}
-	defer resp.Body.Close()
 
-	var detectResp models.DetectResponse
-	if err := json.NewDecoder(resp.Body).Decode(&detectResp); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode face detection response"})
-		return
-	}
-
-	if !detectResp.HasFace || detectResp.FaceCount != 1 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Image must contain exactly one face"})
-		return
-	}
-
-	// Update user's photo in database
-	err = h.repo.UpdateUserPhoto(userID, photoBytes)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save photo"})
-		return
+	// The enrollment token works once
+	if enrollment, ok := value.(*auth.Claims); ok {
+		if _, err := h.sessions.RevokeToken(enrollment); err != nil {
+			log.Printf("Failed to spend face enrollment token of user %d: %v", userID, err)
+		}
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Photo uploaded and verified successfully"})
@@ -222,13 +229,14 @@ func (h *UserHandler) UploadPhoto(c *gin.Context) {
 
 // Login godoc
 // @Summary      Authentication
-// @Description  Authenticate user
+// @Description  Authenticate user and start a session. Returns a short-lived access token and a refresh token for POST /auth/refresh, or, when a second factor is enabled or required for the user's role, an mfa_token for POST /auth/mfa/verify or for setting up an authenticator app.
 // @Tags         auth
 // @Accept       json
 // @Produce      json
 // @Param        user  body  models.LoginRequest  true  "Login request object"
 // @Success      201  {object}  models.LoginRequest
 // @Failure      400  {object}  map[string]string
+// @Failure      429  {object}  map[string]string
 // @Router       /auth/login [post]
 func (h *UserHandler) Login(c *gin.Context) {
 	var loginRequest models.LoginRequest
@@ -237,48 +245,38 @@ func (h *UserHandler) Login(c *gin.Context) {
 		return
 	}
 
+	if !h.guard.allow(c, loginRequest.Iin) {
+		return
+	}
+
 	user, err := h.repo.GetUserByIin(loginRequest.Iin)
 	if err != nil {
+		h.guard.failed(c, loginRequest.Iin)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
 	if !auth.CheckPasswordHash(loginRequest.Password, user.Password) {
+		h.guard.failed(c, loginRequest.Iin)
+		h.logins.record(c, user.UserId, false, repositories.LoginFailed)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
+	h.guard.succeeded(loginRequest.Iin)
 
-	// Check if password change is required
-	if !user.PasswordChanged {
-		c.JSON(http.StatusOK, gin.H{
-			"message":                 "Password change required",
-			"require_password_change": true,
-			"token":                   nil,
-		})
-		return
-	}
-
-	token, err := auth.GenerateToken(uint(user.UserId), user.Role)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"token": token,
-		"user":  user,
-	})
+	h.logins.Complete(c, user, false)
 }
 
 // ChangePassword godoc
 // @Summary      Change password
-// @Description  Change user's password
+// @Description  Change user's password. The new password must follow the password policy, see GET /auth/password-policy; a 400 lists the rules it breaks. Every session of the user is logged out.
 // @Tags         users
 // @Accept       json
 // @Produce      json
 // @Param        request  body  models.ChangePasswordRequest  true  "Change Password Request"
 // @Success      200  {object}  map[string]string
 // @Failure      400  {object}  map[string]string
+// @Failure      429  {object}  map[string]string
 // @Router       /users/change-password [post]
 func (h *UserHandler) ChangePassword(c *gin.Context) {
 	var request models.ChangePasswordRequest
@@ -287,36 +285,51 @@ func (h *UserHandler) ChangePassword(c *gin.Context) {
 		return
 	}
 
+	if !h.guard.allow(c, request.Iin) {
+		return
+	}
+
 	user, err := h.repo.GetUserByIin(request.Iin)
 	if err != nil {
+		h.guard.failed(c, request.Iin)
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
 	// Check if old password (OTP) matches
 	if !auth.CheckPasswordHash(request.OldPassword, user.Password) {
+		h.guard.failed(c, request.Iin)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OTP"})
 		return
 	}
+	h.guard.succeeded(request.Iin)
 
 	if request.NewPassword != request.VerifyPassword {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "New passwords do not match"})
 		return
 	}
 
+	if err := h.passwords.check(user, request.NewPassword); err != nil {
+		if !policyViolations(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check password", "Detailed": err.Error()})
+		}
+		return
+	}
+
 	hashedPassword, err := auth.HashPassword(request.NewPassword)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
 	}
 
-	if err := h.repo.UpdatePassword(request.Iin, hashedPassword); err != nil {
+	if err := h.repo.UpdatePassword(user.UserId, hashedPassword); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
 		return
 	}
 
-	if err := h.repo.SetPasswordChanged(request.Iin, true); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password_changed flag"})
+	// Sessions opened with the old password end with it
+	if _, err := h.sessions.RevokeAll(user.UserId); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end sessions", "Detailed": err.Error()})
 		return
 	}
 
@@ -325,11 +338,15 @@ func (h *UserHandler) ChangePassword(c *gin.Context) {
 
 // DeleteUser godoc
 // @Summary      Delete a user
-// @Description  Delete a user by its ID
+// @Description  Delete a user by its ID (admin only). Administrators cannot delete themselves.
 // @Tags         users
 // @Produce      json
 // @Param        id  path  int  true  "User ID"
+// @Param        Authorization header string true "Bearer"
 // @Success      204
+// @Failure      400  {object}  map[string]string
+// @Failure      401  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
 // @Failure      404  {object}  map[string]string
 // @Router       /users/{id} [delete]
 func (h *UserHandler) DeleteUser(c *gin.Context) {
@@ -338,6 +355,10 @@ func (h *UserHandler) DeleteUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
 		return
 	}
+	if uint(id) == c.GetUint("user_id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Administrators cannot delete their own account"})
+		return
+	}
 
 	user, err := h.repo.GetUserByID(id)
 	if err != nil {
@@ -365,7 +386,7 @@ func (h *UserHandler) DeleteUser(c *gin.Context) {
 
 // ForgotPassword godoc
 // @Summary      Request password reset
-// @Description  Send OTP to user's email for password reset
+// @Description  Email the user a single-use code for POST /users/reset-password. The answer is the same whether or not the IIN is registered.
 // @Tags         users
 // @Accept       json
 // @Produce      json
@@ -380,93 +401,111 @@ func (h *UserHandler) ForgotPassword(c *gin.Context) {
 		return
 	}
 
-	_, err := h.repo.GetUserByIin(request.Iin)
+	// Unknown IINs and repeated requests get the same answer, so the
+	// endpoint does not reveal who is registered
+	response := gin.H{"message": "If the IIN is registered, a reset code has been sent to its email"}
+
+	user, err := h.repo.GetUserByIin(request.Iin)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		c.JSON(http.StatusOK, response)
 		return
 	}
 
-	otp := generateOTP()
-	expiresAt := time.Now().Add(5 * time.Minute)
-
-	otpVerification := models.OTPVerification{
-		Iin:       request.Iin,
-		OTP:       otp,
-		ExpiresAt: expiresAt,
-	}
-
-	if err := h.repo.CreateOTPVerification(&otpVerification); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create OTP verification"})
+	code, err := h.resets.Create(user.UserId, c.ClientIP())
+	switch {
+	case errors.Is(err, repositories.ErrPasswordResetTooSoon):
+		c.JSON(http.StatusOK, response)
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create password reset", "Detailed": err.Error()})
 		return
 	}
 
-	// TODO: Send OTP via email
-	// For now, just return the OTP in the response
-	c.JSON(http.StatusOK, gin.H{
-		"message": "OTP sent to email",
-		"otp":     otp, // Remove this in production
-	})
+	mailResetCode(user, code, h.resetTTL, "If you did not ask to reset your password, ignore this email.")
+	c.JSON(http.StatusOK, response)
+}
+
+// mailResetCode emails a password reset code to the user in the background
+func mailResetCode(user *models.User, code string, ttl time.Duration, note string) {
+	subject := "Reset your MedicineApp password"
+	body := fmt.Sprintf("Your password reset code is: %s\n"+
+		"It can be used once and expires in %s. %s", code, ttl, note)
+	go func() {
+		if err := scripts.SendMail(user.Email, subject, body); err != nil {
+			log.Printf("Failed to send password reset to user %d: %v", user.UserId, err)
+		}
+	}()
 }
 
-// VerifyOTP godoc
-// @Summary      Verify OTP
-// @Description  Verify OTP and set password_changed flag to false
+// ResetPassword godoc
+// @Summary      Reset password
+// @Description  Set a new password with the code from POST /users/forgot-password. The new password must follow the password policy. The code can be used once, expires, and is given up after too many wrong guesses. Every session of the user is logged out.
 // @Tags         users
 // @Accept       json
 // @Produce      json
-// @Param        request  body  models.VerifyOTPRequest  true  "Verify OTP Request"
+// @Param        request  body  models.ResetPasswordRequest  true  "Reset Password Request"
 // @Success      200  {object}  map[string]string
 // @Failure      400  {object}  map[string]string
-// @Router       /users/verify-otp [post]
-func (h *UserHandler) VerifyOTP(c *gin.Context) {
-	var request models.VerifyOTPRequest
+// @Failure      429  {object}  map[string]string
+// @Router       /users/reset-password [post]
+func (h *UserHandler) ResetPassword(c *gin.Context) {
+	var request models.ResetPasswordRequest
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	otpVerification, err := h.repo.GetOTPVerification(request.Iin)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "OTP verification not found"})
+	if !h.guard.allow(c, request.Iin) {
 		return
 	}
 
-	if otpVerification.OTP != request.OTP {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OTP"})
+	// The new password is checked once the code is known to be valid, so the
+	// policy cannot be used to probe a user's old passwords
+	userID, err := h.resets.Consume(request.Iin, request.OTP, func(userID int) (string, error) {
+		user, err := h.repo.GetUserByID(userID)
+		if err != nil {
+			return "", err
+		}
+		if err := h.passwords.check(user, request.NewPassword); err != nil {
+			return "", err
+		}
+		return auth.HashPassword(request.NewPassword)
+	})
+	switch {
+	case errors.Is(err, repositories.ErrPasswordResetInvalid):
+		h.guard.failed(c, request.Iin)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
-	}
-
-	if time.Now().After(otpVerification.ExpiresAt) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "OTP has expired"})
+	case errors.Is(err, repositories.ErrPasswordResetExpired):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
-	}
-
-	if err := h.repo.SetPasswordChanged(request.Iin, false); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password_changed flag"})
+	case err != nil:
+		if !policyViolations(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password", "Detailed": err.Error()})
+		}
 		return
 	}
+	h.guard.succeeded(request.Iin)
 
-	if err := h.repo.DeleteOTPVerification(request.Iin); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete OTP verification"})
+	// A password reset logs out every session, whoever may have opened them
+	if _, err := h.sessions.RevokeAll(userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end sessions", "Detailed": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "OTP verified successfully"})
-}
-
-func generateOTP() string {
-	// Generate a 6-digit OTP
-	otp := rand.Intn(900000) + 100000
-	return fmt.Sprintf("%06d", otp)
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
 }
 
 // GetUserInfoByIIN godoc
 // @Summary      Get detailed user information by IIN
-// @Description  Get user information including role-specific details (doctor or patient)
+// @Description  Get user information including role-specific details (doctor or patient). Patients may only look up themselves.
 // @Tags         users
 // @Produce      json
 // @Param        iin  path  string  true  "User IIN"
+// @Param        Authorization header string true "Bearer"
 // @Success      200  {object}  models.UserInfoResponse
+// @Failure      401  {object}  map[string]string
+// @Failure      403  {object}  map[string]string
 // @Failure      404  {object}  map[string]string
 // @Router       /users/info/{iin} [get]
 func (h *UserHandler) GetUserInfoByIIN(c *gin.Context) {
@@ -476,6 +515,16 @@ func (h *UserHandler) GetUserInfoByIIN(c *gin.Context) {
 		return
 	}
 
+	// Patients may only look themselves up
+	role := c.GetString("role")
+	if role != "admin" && role != "doctor" {
+		self, err := h.repo.GetUserByID(int(c.GetUint("user_id")))
+		if err != nil || self.Iin != iin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+			return
+		}
+	}
+
 	userInfo, err := h.repo.GetUserInfoByIIN(iin)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found", "Detailed": err.Error()})
@@ -550,6 +599,7 @@ func (h *UserHandler) CreateAccessRequest(c *gin.Context) {
 // @Success      200 {array} models.AccessRequest
 // @Failure      401 {object} map[string]string
 // @Failure      403 {object} map[string]string
+// @Failure      500 {object} map[string]string
 // @Router       /access/requests [get]
 func (h *UserHandler) GetAccessRequests(c *gin.Context) {
 	// Get user ID from context
@@ -578,6 +628,7 @@ func (h *UserHandler) GetAccessRequests(c *gin.Context) {
 		requests, err = h.repo.GetDoctorAccessRequests(doctorID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get doctor access requests", "Detailed": err.Error()})
+			return
 		}
 	} else if role == "patient" {
 		// Get patient ID
@@ -587,6 +638,10 @@ func (h *UserHandler) GetAccessRequests(c *gin.Context) {
 			return
 		}
 		requests, err = h.repo.GetPatientAccessRequests(patientID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get patient access requests", "Detailed": err.Error()})
+			return
+		}
 	} else {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get access requests"})
 		return
@@ -594,3 +649,61 @@ func (h *UserHandler) GetAccessRequests(c *gin.Context) {
 
 	c.JSON(http.StatusOK, requests)
 }
+
+// UpdateAccessRequestStatus godoc
+// @Summary      Answer or revoke an access request
+// @Description  Grant or reject a pending access request, or revoke a granted one (patient only, own requests). Granting opens access for the configured grant duration, to the given record categories or to all of them when none are given.
+// @Tags         access
+// @Accept       json
+// @Produce      json
+// @Param        id path int true "Access request ID"
+// @Param        request body models.AccessRequestStatusUpdate true "New status"
+// @Param        Authorization header string true "Bearer"
+// @Success      200 {object} models.AccessRequest
+// @Failure      400 {object} map[string]string
+// @Failure      401 {object} map[string]string
+// @Failure      403 {object} map[string]string
+// @Failure      404 {object} map[string]string
+// @Failure      409 {object} map[string]string
+// @Router       /access/requests/{id} [put]
+func (h *UserHandler) UpdateAccessRequestStatus(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	requestID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request ID"})
+		return
+	}
+
+	var update models.AccessRequestStatusUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body", "Detailed": err.Error()})
+		return
+	}
+
+	patientID, err := h.repo.GetPatientIDByUserID(int(userID.(uint)))
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Patient profile not found"})
+		return
+	}
+
+	request, err := h.repo.UpdateAccessRequestStatus(requestID, patientID, update.Status, update.Scopes, h.accessGrantDuration)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, request)
+	case errors.Is(err, repositories.ErrInvalidAccessStatus):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Status must be granted, rejected or revoked"})
+	case errors.Is(err, repositories.ErrAccessRequestNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Access request not found"})
+	case errors.Is(err, repositories.ErrAccessRequestNotOwned):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access request belongs to another patient"})
+	case errors.Is(err, repositories.ErrAccessRequestExpired), errors.Is(err, repositories.ErrAccessStatusTransition):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update access request", "Detailed": err.Error()})
+	}
+}
@@ -1,13 +1,25 @@
 package routes
 
 import (
+	"context"
+	"crypto/x509"
 	"diploma/internal/api/handlers"
 	"diploma/internal/auth"
+	"diploma/internal/blockchain"
 	"diploma/internal/config"
+	"diploma/internal/events"
+	"diploma/internal/face"
+	"diploma/internal/jobs"
 	"diploma/internal/repositories"
+	"diploma/internal/timestamp"
+	"diploma/internal/vault"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
+	"log"
+	"os"
+	"time"
 )
 
 func SetupRouter() *gin.Engine {
@@ -22,22 +34,146 @@ func SetupRouter() *gin.Engine {
 		panic(err)
 	}
 
+	// Secrets stored in the database are encrypted with the master key
+	secrets, err := vault.NewFromBase64(cfg.MasterKey)
+	if err != nil {
+		panic(fmt.Errorf("invalid MASTER_KEY: %v", err))
+	}
+
+	// Tokens are signed with the configured keys, old keys keep validating during rotation
+	jwtKeys, err := auth.LoadKeySet(cfg.JWTSecret, cfg.JWTKeysFile)
+	if err != nil {
+		panic(err)
+	}
+	auth.UseKeySet(jwtKeys)
+	jwksHandler := handlers.NewJWKSHandler(jwtKeys)
+
 	// Initialize repository and handlers
-	userRepo := repositories.NewUserRepository(db)
-	userHandler := handlers.NewUserHandler(userRepo)
+	// Access tokens are checked against revoked tokens and sessions
+	sessionRepo := repositories.NewSessionRepository(db, cfg.RefreshTokenTTL)
+	auth.UseRevocationList(sessionRepo)
+	sessionHandler := handlers.NewSessionHandler(sessionRepo, cfg.AccessTokenTTL)
+
+	faceClient := face.NewClient(cfg.FaceServiceURL, 30*time.Second)
+
+	userRepo := repositories.NewUserRepository(db, secrets)
+
+	// New passwords follow the policy, and passwords past their maximum age
+	// must be changed at the next login
+	passwordPolicy := &auth.PasswordPolicy{
+		MinLength:  cfg.PasswordMinLength,
+		MinClasses: cfg.PasswordMinClasses,
+		History:    cfg.PasswordHistory,
+		MaxAge:     cfg.PasswordMaxAge,
+	}
+	if cfg.BreachedPasswordsDir != "" {
+		passwordPolicy.Breached, err = auth.NewBreachList(cfg.BreachedPasswordsDir)
+		if err != nil {
+			panic(err)
+		}
+	}
+	passwords := handlers.NewPasswords(passwordPolicy, userRepo)
+
+	// Logins by password or face ask for a second factor where one is enabled
+	// or required, and are kept in each account's login history
+	totpRepo := repositories.NewTOTPRepository(db, secrets, cfg.TOTPMaxAttempts, cfg.TOTPLockout)
+	loginEventRepo := repositories.NewLoginEventRepository(db)
+	logins := handlers.NewLoginFlow(sessionRepo, totpRepo, userRepo, loginEventRepo, passwords, cfg.MFARequiredRoles, cfg.AccessTokenTTL, cfg.MFAChallengeTTL)
+
+	// Failed logins, reset codes and password changes are throttled per IIN and per IP
+	throttleRepo := repositories.NewLoginThrottleRepository(db, repositories.ThrottlePolicy{
+		MaxFailures:   cfg.LoginMaxFailures,
+		IPMaxFailures: cfg.LoginIPMaxFailures,
+		Window:        cfg.LoginFailureWindow,
+		Lockout:       cfg.LoginLockout,
+		DelayBase:     cfg.LoginDelayBase,
+		DelayMax:      cfg.LoginDelayMax,
+	})
+	loginGuard := handlers.NewLoginGuard(throttleRepo, userRepo, cfg.LoginLockout)
+	lockoutHandler := handlers.NewLockoutHandler(throttleRepo)
+
+	resetRepo := repositories.NewPasswordResetRepository(db, cfg.PasswordResetTTL, cfg.PasswordResetMaxAttempts)
+
+	userHandler := handlers.NewUserHandler(userRepo, sessionRepo, logins, loginGuard, passwords, resetRepo, cfg.PasswordResetTTL, faceClient, cfg.FaceEnrollmentTTL, cfg.AccessGrantDuration)
+	adminHandler := handlers.NewAdminHandler(userRepo, sessionRepo, resetRepo, loginEventRepo, cfg.PasswordResetTTL)
+	mfaHandler := handlers.NewMFAHandler(totpRepo, userRepo, sessionRepo, logins, cfg.TOTPIssuer)
+
+	faceRepo := repositories.NewFaceVerificationRepository(db)
+	faceHandler := handlers.NewFaceHandler(faceClient, faceRepo, userRepo, logins, loginGuard, handlers.FaceOptions{
+		Threshold:      cfg.FaceMatchThreshold,
+		MaxAttempts:    cfg.FaceMaxAttempts,
+		AttemptWindow:  cfg.FaceAttemptWindow,
+		AccessTokenTTL: cfg.AccessTokenTTL,
+	})
+
+	// Access request changes are pushed to the parties through the database,
+	// so every instance sees changes made through any other
+	broker, err := events.NewBroker(repositories.ConnString(cfg))
+	if err != nil {
+		panic(fmt.Errorf("failed to listen for access request events: %v", err))
+	}
+	go broker.Run()
+	streamHandler := handlers.NewStreamHandler(broker)
 
 	patientRepo := repositories.NewPatientRepository(db)
-	patientHandler := handlers.NewPatientHandler(patientRepo)
+	patientKeyRepo := repositories.NewPatientKeyRepository(db, secrets)
+	patientHandler := handlers.NewPatientHandler(patientRepo, patientKeyRepo)
+
+	guardianshipRepo := repositories.NewGuardianshipRepository(db, cfg.GuardianAgeOfMajority)
+	guardianHandler := handlers.NewGuardianHandler(guardianshipRepo, patientRepo, userRepo)
+	// Guardians act for a dependent on these routes with ?on_behalf_of=<IIN>
+	onBehalfOf := guardianHandler.OnBehalfOf()
 
 	appointmentRepo := repositories.NewAppointmentRepository(db)
 	appointmentHandler := handlers.NewAppointmentHandler(appointmentRepo, userRepo, patientRepo)
 
-	recordRepo := repositories.NewRecordRepository(db)
+	keyRepo := repositories.NewKeyRepository(db, secrets)
+	legacyLocation, err := time.LoadLocation(cfg.ChainLegacyTimezone)
+	if err != nil {
+		panic(fmt.Errorf("invalid CHAIN_LEGACY_TIMEZONE: %v", err))
+	}
+	timestamper, err := newTimestamper(cfg)
+	if err != nil {
+		panic(err)
+	}
+	chain, err := blockchain.NewBlockchain(db, keyRepo, blockchain.Options{
+		CacheSize:      cfg.ChainCacheSize,
+		LegacyLocation: legacyLocation,
+		Timestamper:    timestamper,
+	})
+	if err != nil {
+		panic(err)
+	}
+	verifyChainOnStartup(chain, cfg)
+	blockchainHandler := handlers.NewBlockchainHandler(chain)
+
+	recordRepo := repositories.NewRecordRepository(db, chain, patientKeyRepo, repositories.AccessPolicy{
+		AppointmentGrantsAccess: cfg.AccessViaAppointment,
+		AppointmentWindow:       cfg.AccessAppointmentWindow,
+	})
 	recordHandler := handlers.NewRecordHandler(recordRepo, userRepo, patientRepo)
 
+	consentRepo := repositories.NewStandingConsentRepository(db)
+	consentHandler := handlers.NewConsentHandler(consentRepo, userRepo)
+
+	emergencyRepo := repositories.NewEmergencyAccessRepository(db, chain, patientKeyRepo)
+	emergencyHandler := handlers.NewEmergencyHandler(emergencyRepo, userRepo, cfg.EmergencyAccessDuration)
+	breakGlass := []gin.HandlerFunc{auth.RoleMiddleware([]string{"doctor"})}
+	if cfg.EmergencyRequiresStepUp {
+		breakGlass = append(breakGlass, auth.RequireStepUp(cfg.FaceStepUpMaxAge))
+	}
+	breakGlass = append(breakGlass, emergencyHandler.BreakGlass)
+
+	// Maintenance runs on whichever instance holds the job leader lock
+	runner := jobs.NewRunner(db, backgroundJobs(cfg, chain, timestamper != nil, userRepo, guardianshipRepo, sessionRepo, throttleRepo, resetRepo, loginEventRepo)...)
+	go runner.Run(context.Background())
+
 	// Swagger route
 	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
+	// Public keys for services that validate our tokens themselves
+	router.GET("/.well-known/jwks.json", jwksHandler.GetJWKS)
+
 	// API routes
 	v1 := router.Group("/api/v1")
 	{
@@ -45,32 +181,62 @@ func SetupRouter() *gin.Engine {
 		{
 			authGroup.POST("/register", userHandler.CreateUser)
 			authGroup.POST("/login", userHandler.Login)
-			authGroup.POST("/upload-photo", userHandler.UploadPhoto)
+			authGroup.GET("/password-policy", passwords.GetPasswordPolicy)
+			authGroup.POST("/refresh", sessionHandler.Refresh)
+			authGroup.POST("/logout", auth.AuthMiddleware(), sessionHandler.Logout)
+			authGroup.GET("/sessions", auth.AuthMiddleware(), sessionHandler.GetSessions)
+			authGroup.DELETE("/sessions/:id", auth.AuthMiddleware(), sessionHandler.RevokeSession)
+			authGroup.POST("/upload-photo", auth.FaceEnrollmentMiddleware(), userHandler.UploadPhoto)
+			authGroup.POST("/face-login", faceHandler.FaceLogin)
+			authGroup.POST("/step-up", auth.AuthMiddleware(), faceHandler.StepUp)
+			authGroup.POST("/mfa/verify", mfaHandler.VerifyMFA)
+			authGroup.GET("/mfa", auth.AuthMiddleware(), mfaHandler.GetMFAStatus)
+			// Users required to have a second factor set it up with their login's mfa_token
+			authGroup.POST("/mfa/totp", auth.MFAEnrollmentMiddleware(), mfaHandler.EnrollTOTP)
+			authGroup.POST("/mfa/totp/confirm", auth.MFAEnrollmentMiddleware(), mfaHandler.ConfirmTOTP)
+			authGroup.DELETE("/mfa/totp", auth.AuthMiddleware(), mfaHandler.DisableTOTP)
+			authGroup.POST("/mfa/recovery-codes", auth.AuthMiddleware(), mfaHandler.RegenerateRecoveryCodes)
 		}
 
 		usersGroup := v1.Group("/users")
 		{
-			usersGroup.GET("/", userHandler.GetUsers)
-			usersGroup.GET("/:id", userHandler.GetUserByID)
-			usersGroup.GET("/info/:iin", userHandler.GetUserInfoByIIN)
-			usersGroup.POST("/", userHandler.CreateUser)
-			usersGroup.DELETE("/:id", userHandler.DeleteUser)
+			usersGroup.GET("/", auth.AuthMiddleware(), auth.RoleMiddleware([]string{"admin"}), userHandler.GetUsers)
+			usersGroup.GET("/:id", auth.AuthMiddleware(), auth.RoleMiddleware([]string{"admin"}), userHandler.GetUserByID)
+			usersGroup.GET("/info/:iin", auth.AuthMiddleware(), userHandler.GetUserInfoByIIN)
+			usersGroup.POST("/", auth.AuthMiddleware(), auth.RoleMiddleware([]string{"admin"}), userHandler.CreateUser)
+			usersGroup.DELETE("/:id", auth.AuthMiddleware(), auth.RoleMiddleware([]string{"admin"}), userHandler.DeleteUser)
 			usersGroup.POST("/change-password", userHandler.ChangePassword)
 			usersGroup.POST("/forgot-password", userHandler.ForgotPassword)
-			usersGroup.POST("/verify-otp", userHandler.VerifyOTP)
+			usersGroup.POST("/reset-password", userHandler.ResetPassword)
 		}
 
 		patientsGroup := v1.Group("/patients")
 		{
-			patientsGroup.GET("/", patientHandler.GetPatients)
-			patientsGroup.GET("/:id", patientHandler.GetPatientByID)
+			patientsGroup.GET("/", auth.AuthMiddleware(), auth.RoleMiddleware([]string{"admin"}), patientHandler.GetPatients)
+			patientsGroup.GET("/:id", auth.AuthMiddleware(), auth.RoleMiddleware([]string{"admin"}), patientHandler.GetPatientByID)
+			patientsGroup.DELETE("/:id/data-key", auth.AuthMiddleware(), auth.RoleMiddleware([]string{"admin"}), patientHandler.ShredPatientData)
+		}
+
+		adminGroup := v1.Group("/admin")
+		adminGroup.Use(auth.AuthMiddleware(), auth.RoleMiddleware([]string{"admin"}))
+		{
+			adminGroup.PUT("/users/:id/specialization", adminHandler.UpdateSpecialization)
+			adminGroup.POST("/users/:id/suspend", adminHandler.SuspendUser)
+			adminGroup.POST("/users/:id/reactivate", adminHandler.ReactivateUser)
+			adminGroup.POST("/users/:id/force-password-reset", adminHandler.ForcePasswordReset)
+			adminGroup.GET("/users/:id/logins", adminHandler.GetLoginHistory)
 		}
 
 		recordsGroup := v1.Group("/records")
 		recordsGroup.Use(auth.AuthMiddleware())
 		{
-			recordsGroup.GET("/", auth.RoleMiddleware([]string{"patient"}), recordHandler.GetRecordByClaim)
+			recordsGroup.GET("/", onBehalfOf, auth.RoleMiddleware([]string{"patient"}), recordHandler.GetRecordByClaim)
+			recordsGroup.GET("/history", onBehalfOf, auth.RoleMiddleware([]string{"patient"}), recordHandler.GetOwnHistory)
+			recordsGroup.GET("/patients/:iin/history", auth.RoleMiddleware([]string{"doctor"}), recordHandler.GetPatientHistory)
 			recordsGroup.GET("/:iin", auth.RoleMiddleware([]string{"doctor"}), recordHandler.GetRecordByIIN)
+			// gin requires sibling wildcards to share a name, so the record ID is bound as :iin here
+			recordsGroup.GET("/:iin/history", onBehalfOf, auth.RoleMiddleware([]string{"doctor", "patient"}), recordHandler.GetRecordHistory)
+			recordsGroup.GET("/:iin/proof", onBehalfOf, auth.RoleMiddleware([]string{"doctor", "patient"}), recordHandler.GetRecordProof)
 			recordsGroup.POST("/", auth.RoleMiddleware([]string{"doctor"}), recordHandler.CreateRecord)
 			recordsGroup.PUT("/:id", auth.RoleMiddleware([]string{"doctor"}), recordHandler.UpdateRecord)
 		}
@@ -80,18 +246,205 @@ func SetupRouter() *gin.Engine {
 		{
 			appointmentsGroup.POST("/", auth.RoleMiddleware([]string{"doctor"}), appointmentHandler.CreateAppointment)
 			appointmentsGroup.DELETE("/:id", auth.RoleMiddleware([]string{"doctor"}), appointmentHandler.DeleteAppointment)
-			appointmentsGroup.GET("/", appointmentHandler.GetAppointments)
+			appointmentsGroup.GET("/", onBehalfOf, appointmentHandler.GetAppointments)
 		}
 
 		// Access routes
+		// EventSource cannot send headers, so the stream also takes the token from the query
+		v1.GET("/access/stream", auth.StreamAuthMiddleware(), streamHandler.StreamAccessRequests)
+
 		accessGroup := v1.Group("/access")
 		accessGroup.Use(auth.AuthMiddleware())
 		{
 			accessGroup.POST("/request", userHandler.CreateAccessRequest)
-			accessGroup.GET("/requests", userHandler.GetAccessRequests)
+			accessGroup.GET("/requests", onBehalfOf, userHandler.GetAccessRequests)
+			accessGroup.PUT("/requests/:id", onBehalfOf, auth.RoleMiddleware([]string{"patient"}), userHandler.UpdateAccessRequestStatus)
+			accessGroup.POST("/consents", onBehalfOf, auth.RoleMiddleware([]string{"patient"}), consentHandler.CreateConsent)
+			accessGroup.GET("/consents", onBehalfOf, auth.RoleMiddleware([]string{"patient"}), consentHandler.GetConsents)
+			accessGroup.DELETE("/consents/:id", onBehalfOf, auth.RoleMiddleware([]string{"patient"}), consentHandler.RevokeConsent)
+			accessGroup.POST("/emergency", breakGlass...)
+			accessGroup.GET("/emergency/reviews", auth.RoleMiddleware([]string{"admin"}), emergencyHandler.GetEmergencyReviews)
+			accessGroup.PUT("/emergency/:id/review", auth.RoleMiddleware([]string{"admin"}), emergencyHandler.ReviewEmergencyAccess)
+		}
+
+		guardianshipsGroup := v1.Group("/guardianships")
+		guardianshipsGroup.Use(auth.AuthMiddleware())
+		{
+			guardianshipsGroup.POST("/", guardianHandler.RequestGuardianship)
+			guardianshipsGroup.GET("/", guardianHandler.GetGuardianships)
+			guardianshipsGroup.GET("/reviews", auth.RoleMiddleware([]string{"admin"}), guardianHandler.GetGuardianshipReviews)
+			guardianshipsGroup.PUT("/:id/review", auth.RoleMiddleware([]string{"admin"}), guardianHandler.ReviewGuardianship)
+			guardianshipsGroup.DELETE("/:id", guardianHandler.RevokeGuardianship)
+		}
+
+		lockoutsGroup := v1.Group("/lockouts")
+		lockoutsGroup.Use(auth.AuthMiddleware(), auth.RoleMiddleware([]string{"admin"}))
+		{
+			lockoutsGroup.GET("/", lockoutHandler.GetLockouts)
+			lockoutsGroup.DELETE("/:kind/:subject", lockoutHandler.Unlock)
+		}
+
+		blockchainGroup := v1.Group("/blockchain")
+		{
+			// Merkle roots are published without authentication so receipts can be checked by anyone
+			blockchainGroup.GET("/merkle-roots/:batch", blockchainHandler.GetMerkleRoot)
+			blockchainGroup.GET("/anchors", blockchainHandler.GetAnchors)
+			blockchainGroup.POST("/anchors", auth.AuthMiddleware(), auth.RoleMiddleware([]string{"admin"}), blockchainHandler.AnchorHead)
+			blockchainGroup.GET("/verify", auth.AuthMiddleware(), auth.RoleMiddleware([]string{"admin"}), blockchainHandler.VerifyChain)
 		}
 
 	}
 
 	return router
 }
+
+// verifyChainOnStartup checks the stored chain at startup. Problems are always
+// logged; with fail-fast enabled the check runs before the server accepts
+// requests and stops startup, otherwise it runs in the background.
+func verifyChainOnStartup(chain *blockchain.Blockchain, cfg *config.Config) {
+	if !cfg.ChainVerifyOnStartup {
+		return
+	}
+	if !cfg.ChainVerifyFailFast {
+		go verifyChain(chain, cfg)
+		return
+	}
+	verifyChain(chain, cfg)
+}
+
+// verifyChain runs the startup verification and logs its outcome
+func verifyChain(chain *blockchain.Blockchain, cfg *config.Config) {
+	report, err := chain.Verify()
+	if err != nil {
+		if cfg.ChainVerifyFailFast {
+			panic(err)
+		}
+		log.Printf("Blockchain verification could not run: %v", err)
+		return
+	}
+
+	if report.AnchorTokensUnchecked > 0 {
+		log.Printf("Warning: %d time-stamp anchor tokens were not checked, no TSA is configured", report.AnchorTokensUnchecked)
+	}
+	if report.Valid {
+		log.Printf("Blockchain verified: %d blocks, head %s", report.BlocksChecked, report.HeadHash)
+		return
+	}
+
+	for _, issue := range report.Issues {
+		log.Printf("Blockchain issue at block %d (index %d): %s: %s", issue.BlockID, issue.Index, issue.Kind, issue.Message)
+	}
+	if cfg.ChainVerifyFailFast {
+		panic(fmt.Errorf("blockchain verification failed with %d issues", len(report.Issues)))
+	}
+}
+
+// newTimestamper creates the time-stamp client the chain head is anchored
+// with, or nil when no authority is configured
+func newTimestamper(cfg *config.Config) (blockchain.Timestamper, error) {
+	if cfg.TSAURL == "" {
+		return nil, nil
+	}
+	if cfg.TSACAFile == "" {
+		log.Printf("TSA_CA_FILE is not set, time-stamp tokens are trusted on their embedded certificate")
+		return timestamp.NewClient(cfg.TSAURL, nil), nil
+	}
+
+	pemCerts, err := os.ReadFile(cfg.TSACAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TSA_CA_FILE: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("TSA_CA_FILE contains no certificates")
+	}
+	return timestamp.NewClient(cfg.TSAURL, roots), nil
+}
+
+// backgroundJobs lists the maintenance jobs of the job runner
+func backgroundJobs(cfg *config.Config, chain *blockchain.Blockchain, anchoring bool, userRepo *repositories.UserRepository, guardianshipRepo *repositories.GuardianshipRepository, sessionRepo *repositories.SessionRepository, throttleRepo *repositories.LoginThrottleRepository, resetRepo *repositories.PasswordResetRepository, loginEventRepo *repositories.LoginEventRepository) []jobs.Job {
+	list := []jobs.Job{
+		{
+			// Expiring a request also notifies its parties
+			Name:     "expire-access-requests",
+			Interval: cfg.AccessExpiryInterval,
+			Run:      logCount("Marked %d access requests expired", userRepo.ExpireAccessRequests),
+		},
+		{
+			Name:     "warn-expiring-access",
+			Interval: cfg.AccessExpiryInterval,
+			Run: logCount("Warned of %d grants about to expire", func() (int64, error) {
+				return userRepo.WarnExpiringAccess(cfg.AccessExpiryWarning)
+			}),
+		},
+		{
+			Name:     "delete-expired-password-resets",
+			Interval: time.Hour,
+			Run: logCount("Deleted %d expired password resets", func() (int64, error) {
+				return resetRepo.DeleteExpired(cfg.PasswordResetRetention)
+			}),
+		},
+		{
+			// Access checks already exclude dependents who came of age, this keeps the status accurate
+			Name:     "end-aged-out-guardianships",
+			Interval: time.Hour,
+			Run:      logCount("Ended %d guardianships of dependents who came of age", guardianshipRepo.EndAgedOut),
+		},
+		{
+			Name:     "delete-ended-sessions",
+			Interval: time.Hour,
+			Run: logCount("Deleted %d ended sessions", func() (int64, error) {
+				return sessionRepo.DeleteExpired(cfg.SessionRetention)
+			}),
+		},
+		{
+			Name:     "delete-old-login-events",
+			Interval: 24 * time.Hour,
+			Run: logCount("Deleted %d old login events", func() (int64, error) {
+				return loginEventRepo.DeleteOlderThan(cfg.LoginHistoryRetention)
+			}),
+		},
+		{
+			Name:     "delete-stale-login-failures",
+			Interval: time.Hour,
+			Run:      logCount("Deleted %d stale failed login counters", throttleRepo.DeleteStale),
+		},
+	}
+
+	if cfg.AccessRequestRetention > 0 {
+		list = append(list, jobs.Job{
+			Name:     "delete-closed-access-requests",
+			Interval: 24 * time.Hour,
+			Run: logCount("Deleted %d closed access requests", func() (int64, error) {
+				return userRepo.DeleteClosedAccessRequests(cfg.AccessRequestRetention)
+			}),
+		})
+	}
+
+	if anchoring {
+		list = append(list, jobs.Job{
+			Name:     "anchor-chain-head",
+			Interval: cfg.ChainAnchorInterval,
+			Run: func() error {
+				anchor, created, err := chain.AnchorHead()
+				if created {
+					log.Printf("Anchored block %d at %s, serial %s", anchor.BlockIndex, anchor.GenTime, anchor.SerialNumber)
+				}
+				return err
+			},
+		})
+	}
+	return list
+}
+
+// logCount adapts a job that returns how many rows it changed, logging the
+// count when there were any
+func logCount(format string, run func() (int64, error)) func() error {
+	return func() error {
+		count, err := run()
+		if count > 0 {
+			log.Printf(format, count)
+		}
+		return err
+	}
+}
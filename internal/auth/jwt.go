@@ -1,40 +1,151 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"github.com/golang-jwt/jwt/v5"
 	"time"
 )
 
-var jwtSecret = []byte("sibsila") // Replace with a secure secret key
+// keys signs and validates tokens, set at startup with UseKeySet
+var keys *KeySet
+
+// UseKeySet sets the keys that sign and validate tokens
+func UseKeySet(ks *KeySet) {
+	keys = ks
+}
+
+var errNoKeys = errors.New("JWT keys are not configured")
 
 // Claims represents the JWT claims
 type Claims struct {
-	UserID uint   `json:"user_id"`
-	Role   string `json:"role"`
+	UserID    uint   `json:"user_id"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid,omitempty"` // Session whose refresh token obtained the token
+	// StepUpAt is when the user last proved their identity with their face,
+	// set on tokens issued by face login or step-up
+	StepUpAt *jwt.NumericDate `json:"step_up_at,omitempty"`
+	// Purpose is empty for access tokens. Other tokens, such as MFA
+	// challenges, are refused where an access token is expected.
+	Purpose string `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// GenerateToken generates a new JWT token for a user
-func GenerateToken(userID uint, role string) (string, error) {
-	claims := &Claims{
-		UserID: userID,
-		Role:   role,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(30 * time.Minute)), // Token expires in 24 hours
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			Issuer:    "medicine app",
-		},
+// PurposeMFA marks a challenge token, issued after the first login factor,
+// that is exchanged for an access token with a second factor
+const PurposeMFA = "mfa"
+
+// PurposeFaceEnrollment marks a token, issued on registration, that lets the
+// new user enroll the face photo used for face login before they first log in
+const PurposeFaceEnrollment = "face_enrollment"
+
+// GenerateToken generates a new JWT token for a user in a session. The
+// returned claims carry the token's jti and expiry for later revocation.
+func GenerateToken(userID uint, role, sessionID string, ttl time.Duration) (string, *Claims, error) {
+	return signToken(&Claims{UserID: userID, Role: role, SessionID: sessionID}, ttl)
+}
+
+// GenerateStepUpToken generates a token like GenerateToken, marked as issued
+// just after the user verified their face
+func GenerateStepUpToken(userID uint, role, sessionID string, ttl time.Duration) (string, *Claims, error) {
+	return signToken(&Claims{
+		UserID:    userID,
+		Role:      role,
+		SessionID: sessionID,
+		StepUpAt:  jwt.NewNumericDate(time.Now()),
+	}, ttl)
+}
+
+// GenerateMFAChallenge generates a challenge token for a user who passed the
+// first login factor. With face set the first factor was the user's face,
+// which carries over to the access token issued for the challenge.
+func GenerateMFAChallenge(userID uint, role string, face bool, ttl time.Duration) (string, *Claims, error) {
+	claims := &Claims{UserID: userID, Role: role, Purpose: PurposeMFA}
+	if face {
+		claims.StepUpAt = jwt.NewNumericDate(time.Now())
 	}
+	return signToken(claims, ttl)
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+// GenerateFaceEnrollmentToken generates a token that lets a newly registered
+// user enroll their face photo
+func GenerateFaceEnrollmentToken(userID uint, role string, ttl time.Duration) (string, *Claims, error) {
+	return signToken(&Claims{UserID: userID, Role: role, Purpose: PurposeFaceEnrollment}, ttl)
 }
 
-// ValidateToken validates a JWT token
+// signToken fills in the registered claims and signs the token
+func signToken(claims *Claims, ttl time.Duration) (string, *Claims, error) {
+	if keys == nil {
+		return "", nil, errNoKeys
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ID:        hex.EncodeToString(jti),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		IssuedAt:  jwt.NewNumericDate(now),
+		Issuer:    "medicine app",
+	}
+
+	// The kid lets validators pick the right key while keys are rotated
+	token := jwt.NewWithClaims(keys.signing.method(), claims)
+	token.Header["kid"] = keys.signing.ID
+	signed, err := token.SignedString(keys.signing.signKey)
+	if err != nil {
+		return "", nil, err
+	}
+	return signed, claims, nil
+}
+
+// ValidateToken validates a JWT access token
 func ValidateToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, errors.New("not an access token")
+	}
+	return claims, nil
+}
+
+// ValidateMFAChallenge validates a challenge token from GenerateMFAChallenge
+func ValidateMFAChallenge(tokenString string) (*Claims, error) {
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != PurposeMFA {
+		return nil, errors.New("not an MFA challenge token")
+	}
+	return claims, nil
+}
+
+// ValidateFaceEnrollmentToken validates a token from GenerateFaceEnrollmentToken
+func ValidateFaceEnrollmentToken(tokenString string) (*Claims, error) {
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != PurposeFaceEnrollment {
+		return nil, errors.New("not a face enrollment token")
+	}
+	return claims, nil
+}
+
+func parseToken(tokenString string) (*Claims, error) {
+	if keys == nil {
+		return nil, errNoKeys
+	}
+
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, keys.lookup,
+		jwt.WithValidMethods([]string{AlgHS256, AlgRS256, AlgEdDSA}))
 	if err != nil {
 		return nil, err
 	}
@@ -42,5 +153,18 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
 		return claims, nil
 	}
-	return nil, err
+	return nil, errors.New("invalid token")
+}
+
+// RevocationList reports whether a valid token has been revoked before it expired
+type RevocationList interface {
+	IsRevoked(claims *Claims) (bool, error)
+}
+
+// revocations is consulted by the auth middlewares, set at startup with UseRevocationList
+var revocations RevocationList
+
+// UseRevocationList sets the list the auth middlewares check tokens against
+func UseRevocationList(list RevocationList) {
+	revocations = list
 }
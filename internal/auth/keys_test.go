@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/golang-jwt/jwt/v5"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testKey struct {
+	KID        string `json:"kid"`
+	Alg        string `json:"alg"`
+	PrivateKey string `json:"private_key,omitempty"`
+	PublicKey  string `json:"public_key,omitempty"`
+	Secret     string `json:"secret,omitempty"`
+}
+
+func newEd25519Key(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey, string, string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private,
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+}
+
+func keyFileJSON(t *testing.T, signingKID string, keys ...testKey) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]interface{}{"signing_kid": signingKID, "keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// useTestKeySet installs ks for the test and restores the previous keys after
+func useTestKeySet(t *testing.T, ks *KeySet) {
+	t.Helper()
+	previous := keys
+	UseKeySet(ks)
+	t.Cleanup(func() { UseKeySet(previous) })
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	t.Helper()
+	now := time.Now()
+	token := jwt.NewWithClaims(method, &Claims{
+		UserID: 1,
+		Role:   "doctor",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestKeySetValidatesByKid(t *testing.T) {
+	currentPublic, _, currentPrivatePEM, _ := newEd25519Key(t)
+	_, retiredPrivate, _, retiredPublicPEM := newEd25519Key(t)
+	secret := []byte(strings.Repeat("s", minSecretSize))
+
+	ks, err := ParseKeySet(keyFileJSON(t, "current",
+		testKey{KID: "current", Alg: AlgEdDSA, PrivateKey: currentPrivatePEM},
+		testKey{KID: "retired", Alg: AlgEdDSA, PublicKey: retiredPublicPEM},
+		testKey{KID: "shared", Alg: AlgHS256, Secret: base64.StdEncoding.EncodeToString(secret)},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestKeySet(t, ks)
+
+	issued, _, err := GenerateToken(1, "doctor", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"issued with the signing key", issued, true},
+		{"signed with a retired key", signTestToken(t, jwt.SigningMethodEdDSA, "retired", retiredPrivate), true},
+		{"HS256 key", signTestToken(t, jwt.SigningMethodHS256, "shared", secret), true},
+		{"HS256 under an EdDSA kid", signTestToken(t, jwt.SigningMethodHS256, "current", secret), false},
+		{"public key used as HMAC secret", signTestToken(t, jwt.SigningMethodHS256, "current", []byte(currentPublic)), false},
+		{"EdDSA under an HS256 kid", signTestToken(t, jwt.SigningMethodEdDSA, "shared", retiredPrivate), false},
+		{"retired kid, other key", signTestToken(t, jwt.SigningMethodEdDSA, "current", retiredPrivate), false},
+		{"unknown kid", signTestToken(t, jwt.SigningMethodEdDSA, "unknown", retiredPrivate), false},
+		{"no kid", signTestToken(t, jwt.SigningMethodEdDSA, "", retiredPrivate), false},
+		{"unsigned", signTestToken(t, jwt.SigningMethodNone, "current", jwt.UnsafeAllowNoneSignatureType), false},
+	}
+	for _, tt := range tests {
+		_, err := ValidateToken(tt.token)
+		if tt.valid && err != nil {
+			t.Errorf("%s: refused: %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+}
+
+func TestParseKeySetRejects(t *testing.T) {
+	_, _, privatePEM, publicPEM := newEd25519Key(t)
+	secret := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("s", minSecretSize)))
+
+	tests := []struct {
+		name       string
+		signingKID string
+		keys       []testKey
+		want       string
+	}{
+		{"missing kid", "a", []testKey{{Alg: AlgEdDSA, PrivateKey: privatePEM}}, "without kid"},
+		{"duplicate kid", "a", []testKey{{KID: "a", Alg: AlgEdDSA, PrivateKey: privatePEM}, {KID: "a", Alg: AlgEdDSA, PublicKey: publicPEM}}, "duplicate"},
+		{"unsupported algorithm", "a", []testKey{{KID: "a", Alg: "ES256", PrivateKey: privatePEM}}, "unsupported algorithm"},
+		{"Ed25519 key declared RS256", "a", []testKey{{KID: "a", Alg: AlgRS256, PrivateKey: privatePEM}}, "cannot be used with RS256"},
+		{"short secret", "a", []testKey{{KID: "a", Alg: AlgHS256, Secret: base64.StdEncoding.EncodeToString([]byte("short"))}}, "at least"},
+		{"no key material", "a", []testKey{{KID: "a", Alg: AlgEdDSA}}, "required"},
+		{"not PEM", "a", []testKey{{KID: "a", Alg: AlgEdDSA, PublicKey: "garbage"}}, "not PEM"},
+		{"unknown signing kid", "b", []testKey{{KID: "a", Alg: AlgHS256, Secret: secret}}, "names no key"},
+		{"public signing key", "a", []testKey{{KID: "a", Alg: AlgEdDSA, PublicKey: publicPEM}}, "no private key"},
+	}
+	for _, tt := range tests {
+		_, err := ParseKeySet(keyFileJSON(t, tt.signingKID, tt.keys...))
+		if err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		} else if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %q does not mention %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestJWKSPublishesOnlyPublicKeys(t *testing.T) {
+	public, _, privatePEM, _ := newEd25519Key(t)
+	ks, err := ParseKeySet(keyFileJSON(t, "ed",
+		testKey{KID: "ed", Alg: AlgEdDSA, PrivateKey: privatePEM},
+		testKey{KID: "hs", Alg: AlgHS256, Secret: base64.StdEncoding.EncodeToString([]byte(strings.Repeat("s", minSecretSize)))},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := ks.JWKS()
+	if len(set.Keys) != 1 {
+		t.Fatalf("JWKS has %d keys, want 1", len(set.Keys))
+	}
+	jwk := set.Keys[0]
+	if jwk.KeyID != "ed" || jwk.KeyType != "OKP" || jwk.Curve != "Ed25519" || jwk.Algorithm != AlgEdDSA {
+		t.Errorf("unexpected JWK %+v", jwk)
+	}
+	if jwk.X != base64.RawURLEncoding.EncodeToString(public) {
+		t.Error("JWK x is not the public key")
+	}
+}
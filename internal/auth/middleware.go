@@ -3,26 +3,145 @@ package auth
 import (
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"time"
 )
 
 // AuthMiddleware validates the JWT token
 func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authenticate(c, c.GetHeader("Authorization"))
+	}
+}
+
+// StreamAuthMiddleware validates the JWT token like AuthMiddleware, but also
+// accepts it in the token query parameter, since browsers cannot set headers
+// on an EventSource. Use it only on streaming routes, query strings end up
+// in access logs.
+func StreamAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		tokenString := c.GetHeader("Authorization")
 		if tokenString == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			tokenString = c.Query("token")
+		}
+		authenticate(c, tokenString)
+	}
+}
+
+func authenticate(c *gin.Context, tokenString string) {
+	if tokenString == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	claims, err := ValidateToken(tokenString)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+
+	if !checkRevocation(c, claims) {
+		return
+	}
+
+	// Set user ID in context for use in handlers
+	c.Set("user_id", claims.UserID)
+	c.Set("role", claims.Role)
+	c.Set("claims", claims)
+	c.Next()
+}
+
+// checkRevocation aborts the request if the token has been revoked. Logged
+// out tokens stay valid until they expire, so the revocation list is checked;
+// if it cannot be, the token is refused.
+func checkRevocation(c *gin.Context, claims *Claims) bool {
+	if revocations == nil {
+		return true
+	}
+	revoked, err := revocations.IsRevoked(claims)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Could not check token revocation"})
+		return false
+	}
+	if revoked {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+		return false
+	}
+	return true
+}
+
+// StillValid reports whether a token accepted by the auth middleware is
+// neither expired nor revoked since, for requests that outlive their
+// authentication such as event streams. If the revocation list cannot be
+// checked the token is not valid.
+func StillValid(claims *Claims) bool {
+	if claims.ExpiresAt != nil && !time.Now().Before(claims.ExpiresAt.Time) {
+		return false
+	}
+	if revocations == nil {
+		return true
+	}
+	revoked, err := revocations.IsRevoked(claims)
+	return err == nil && !revoked
+}
+
+// MFAEnrollmentMiddleware accepts an access token like AuthMiddleware, or an
+// MFA challenge token, so that users who must enroll a second factor before
+// they can log in reach the enrollment routes. A challenge token is stored
+// in the context as "mfa_challenge" instead of "claims". Handlers must only
+// let a challenge from a password login enroll an account's first factor.
+func MFAEnrollmentMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := c.GetHeader("Authorization")
+		challenge, err := ValidateMFAChallenge(tokenString)
+		if err != nil {
+			authenticate(c, tokenString)
 			return
 		}
+		if !checkRevocation(c, challenge) {
+			return
+		}
+
+		c.Set("user_id", challenge.UserID)
+		c.Set("role", challenge.Role)
+		c.Set("mfa_challenge", challenge)
+		c.Next()
+	}
+}
 
-		claims, err := ValidateToken(tokenString)
+// FaceEnrollmentMiddleware accepts an access token like AuthMiddleware, or
+// the face enrollment token returned on registration, so that new users can
+// enroll their face before they first log in. An enrollment token is stored
+// in the context as "face_enrollment" instead of "claims".
+func FaceEnrollmentMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := c.GetHeader("Authorization")
+		enrollment, err := ValidateFaceEnrollmentToken(tokenString)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			authenticate(c, tokenString)
+			return
+		}
+		if !checkRevocation(c, enrollment) {
 			return
 		}
 
-		// Set user ID in context for use in handlers
-		c.Set("user_id", claims.UserID)
-		c.Set("role", claims.Role)
+		c.Set("user_id", enrollment.UserID)
+		c.Set("role", enrollment.Role)
+		c.Set("face_enrollment", enrollment)
+		c.Next()
+	}
+}
+
+// RequireStepUp refuses tokens whose face verification is missing or older
+// than maxAge, so sensitive routes need a recent POST /auth/step-up. Register
+// it after AuthMiddleware.
+func RequireStepUp(maxAge time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, _ := c.Get("claims")
+		claims, ok := value.(*Claims)
+		if !ok || claims.StepUpAt == nil || time.Since(claims.StepUpAt.Time) > maxAge {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Face verification required", "step_up_required": true})
+			return
+		}
 		c.Next()
 	}
 }
@@ -0,0 +1,211 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// bcryptMaxLength is the most bytes of a password bcrypt takes into account
+const bcryptMaxLength = 72
+
+// Rules reported in password policy violations
+const (
+	RuleMinLength        = "min_length"
+	RuleMaxLength        = "max_length"
+	RuleCharacterClasses = "character_classes"
+	RulePersonalInfo     = "personal_info"
+	RuleHistory          = "history"
+	RuleBreached         = "breached"
+)
+
+// PasswordViolation is a rule a new password breaks
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a new password breaks
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// PasswordPolicy decides which new passwords are acceptable and how long a
+// password may be used
+type PasswordPolicy struct {
+	// MinLength is the fewest characters a password may have
+	MinLength int
+	// MinClasses is how many of lowercase letters, uppercase letters, digits
+	// and symbols a password must mix
+	MinClasses int
+	// History is how many of the user's latest passwords, the current one
+	// included, a new password must differ from
+	History int
+	// MaxAge is how long a password may be used before it must be changed, by
+	// role. Roles not listed have no limit.
+	MaxAge map[string]time.Duration
+	// Breached rejects passwords known from breaches, nil skips the check
+	Breached *BreachList
+}
+
+// Check returns a *PasswordPolicyError listing every rule password breaks.
+// personal holds the user's IIN, names and email, which a password must not
+// contain; previous holds the bcrypt hashes of their latest passwords.
+func (p *PasswordPolicy) Check(password string, personal, previous []string) error {
+	var violations []PasswordViolation
+	add := func(rule, format string, args ...interface{}) {
+		violations = append(violations, PasswordViolation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if n := len([]rune(password)); n < p.MinLength {
+		add(RuleMinLength, "Password must be at least %d characters long", p.MinLength)
+	}
+	if len(password) > bcryptMaxLength {
+		add(RuleMaxLength, "Password must be at most %d bytes long", bcryptMaxLength)
+	}
+	if classes := characterClasses(password); classes < p.MinClasses {
+		add(RuleCharacterClasses, "Password must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses)
+	}
+	if containsPersonal(password, personal) {
+		add(RulePersonalInfo, "Password must not contain your IIN, name or email")
+	}
+	if p.History > 0 {
+		for i, hash := range previous {
+			if i == p.History {
+				break
+			}
+			if CheckPasswordHash(password, hash) {
+				add(RuleHistory, "Password must differ from your last %d passwords", p.History)
+				break
+			}
+		}
+	}
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			add(RuleBreached, "Password appears in a list of breached passwords, choose another")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// Expired reports whether a password set at changedAt is too old for role
+func (p *PasswordPolicy) Expired(role string, changedAt, now time.Time) bool {
+	maxAge, ok := p.MaxAge[role]
+	return ok && maxAge > 0 && now.Sub(changedAt) > maxAge
+}
+
+// characterClasses counts the kinds of characters in a password
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	count := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			count++
+		}
+	}
+	return count
+}
+
+// containsPersonal reports whether a password contains any of the personal
+// values, ignoring case. An email counts in full and by its local part; values
+// shorter than three characters are ignored.
+func containsPersonal(password string, personal []string) bool {
+	lower := strings.ToLower(password)
+	for _, value := range personal {
+		value = strings.ToLower(strings.TrimSpace(value))
+		candidates := []string{value}
+		if at := strings.Index(value, "@"); at > 0 {
+			candidates = append(candidates, value[:at])
+		}
+		for _, candidate := range candidates {
+			if len([]rune(candidate)) >= 3 && strings.Contains(lower, candidate) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BreachList looks passwords up in an offline copy of a breached password
+// corpus split by hash prefix, the layout of the Pwned Passwords range API:
+// one file per first five hex digits of the SHA-1, named like 5BAA6.txt, with
+// a SUFFIX:COUNT line for each hash. Only the file of the password's prefix
+// is read.
+type BreachList struct {
+	dir string
+}
+
+// NewBreachList opens the breached password files in dir
+func NewBreachList(dir string) (*BreachList, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("breached password list: %v", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("breached password list: %s is not a directory", dir)
+	}
+	return &BreachList{dir: dir}, nil
+}
+
+// Contains reports whether a password is in the list
+func (b *BreachList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(b.dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if colon := strings.IndexByte(line, ':'); colon >= 0 {
+			line = line[:colon]
+		}
+		if strings.EqualFold(line, suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// breachListFixture writes a breached password corpus in the range API
+// layout. The hashes are SHA-1 of "Winter-Garden-2024" and "password".
+func breachListFixture(t *testing.T) *BreachList {
+	t.Helper()
+	dir := t.TempDir()
+	files := map[string]string{
+		"354FA.txt": "0018A45C4D1DEF81644B54AB7F969B88D65:1\nAB6F332E563138BBF451DCB15C18D253033:12\n",
+		// Lowercase, with Windows line endings and no count
+		"5BAA6.txt": "003d68eb55068c33ace09247ee4c639306b:3\r\n1e4c9b93f3f0682250b6cf8331b7ee68fd8\r\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := NewBreachList(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func hashTestPassword(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 12, MinClasses: 3, History: 2, Breached: breachListFixture(t)}
+	personal := []string{"010101500123", "Aigerim", "Nurlanova", "a.nurlanova@clinic.kz", "Li"}
+	previous := []string{
+		hashTestPassword(t, "Current-Pass-11"),
+		hashTestPassword(t, "Earlier-Pass-22"),
+		hashTestPassword(t, "Oldest-Pass-33"),
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		want     []string
+	}{
+		{"acceptable", "Quiet-Harbor-719", nil},
+		{"exactly the minimum length", "Quiet-Harb7!", nil},
+		{"too short", "Qu-Harb7!", []string{RuleMinLength}},
+		{"length counts characters, not bytes", "Пароль-Тихий1", nil},
+		{"longer than bcrypt reads", "Quiet-Harbor-719-" + strings.Repeat("x", 60), []string{RuleMaxLength}},
+		{"two character classes", "quiet-harbor-lane", []string{RuleCharacterClasses}},
+		{"contains the IIN", "Pass-010101500123", []string{RulePersonalInfo}},
+		{"contains a name in another case", "AIGERIM-harbor-7", []string{RulePersonalInfo}},
+		{"contains the email", "x-A.Nurlanova@clinic.kz", []string{RulePersonalInfo}},
+		{"contains the email local part", "My-a.nurlanova-9", []string{RulePersonalInfo}},
+		{"short personal values are ignored", "Quiet-Li-Harbor-7", nil},
+		{"current password", "Current-Pass-11", []string{RuleHistory}},
+		{"previous password", "Earlier-Pass-22", []string{RuleHistory}},
+		{"older than the history", "Oldest-Pass-33", nil},
+		{"breached", "Winter-Garden-2024", []string{RuleBreached}},
+		{"breached, listed in lowercase", "password", []string{RuleMinLength, RuleCharacterClasses, RuleBreached}},
+		{"several rules", "aigerim", []string{RuleMinLength, RuleCharacterClasses, RulePersonalInfo}},
+	}
+	for _, tt := range tests {
+		err := policy.Check(tt.password, personal, previous)
+		var got []string
+		if err != nil {
+			policyErr, ok := err.(*PasswordPolicyError)
+			if !ok {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+				continue
+			}
+			for _, v := range policyErr.Violations {
+				got = append(got, v.Rule)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: violations %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPasswordPolicyMessages(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 12, MinClasses: 3, History: 1, Breached: breachListFixture(t)}
+	err := policy.Check("password", []string{"password"}, []string{hashTestPassword(t, "password")})
+	policyErr, ok := err.(*PasswordPolicyError)
+	if !ok {
+		t.Fatalf("Check returned %v", err)
+	}
+
+	want := []PasswordViolation{
+		{RuleMinLength, "Password must be at least 12 characters long"},
+		{RuleCharacterClasses, "Password must mix at least 3 of lowercase letters, uppercase letters, digits and symbols"},
+		{RulePersonalInfo, "Password must not contain your IIN, name or email"},
+		{RuleHistory, "Password must differ from your last 1 passwords"},
+		{RuleBreached, "Password appears in a list of breached passwords, choose another"},
+	}
+	if !reflect.DeepEqual(policyErr.Violations, want) {
+		t.Errorf("violations %+v, want %+v", policyErr.Violations, want)
+	}
+	if got := policyErr.Error(); got != want[0].Message+"; "+want[1].Message+"; "+want[2].Message+"; "+want[3].Message+"; "+want[4].Message {
+		t.Errorf("Error() = %q", got)
+	}
+
+	long := &PasswordPolicy{}
+	if err := long.Check(strings.Repeat("a", bcryptMaxLength+1), nil, nil); err == nil || err.Error() != "Password must be at most 72 bytes long" {
+		t.Errorf("overlong password: %v", err)
+	}
+}
+
+func TestPasswordPolicyExpired(t *testing.T) {
+	policy := &PasswordPolicy{MaxAge: map[string]time.Duration{
+		"doctor":  90 * 24 * time.Hour,
+		"patient": 0,
+	}}
+	changed := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		role string
+		now  time.Time
+		want bool
+	}{
+		{"within the maximum age", "doctor", changed.Add(89 * 24 * time.Hour), false},
+		{"exactly the maximum age", "doctor", changed.Add(90 * 24 * time.Hour), false},
+		{"past the maximum age", "doctor", changed.Add(90*24*time.Hour + time.Second), true},
+		{"zero age means no limit", "patient", changed.Add(10 * 365 * 24 * time.Hour), false},
+		{"role not listed", "admin", changed.Add(10 * 365 * 24 * time.Hour), false},
+	}
+	for _, tt := range tests {
+		if got := policy.Expired(tt.role, changed, tt.now); got != tt.want {
+			t.Errorf("%s: Expired = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBreachList(t *testing.T) {
+	list := breachListFixture(t)
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"Winter-Garden-2024", true},
+		{"password", true},
+		{"Password", false},
+		{"Quiet-Harbor-719", false},
+	}
+	for _, tt := range tests {
+		got, err := list.Contains(tt.password)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.password, err)
+		}
+		if got != tt.want {
+			t.Errorf("Contains(%q) = %v, want %v", tt.password, got, tt.want)
+		}
+	}
+
+	if _, err := NewBreachList(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("NewBreachList accepted a missing directory")
+	}
+	file := filepath.Join(t.TempDir(), "5BAA6.txt")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBreachList(file); err == nil {
+		t.Error("NewBreachList accepted a file")
+	}
+}
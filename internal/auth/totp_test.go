@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the HMAC-SHA1 key of the RFC 6238 Appendix B test vectors
+var rfc6238Secret = []byte("12345678901234567890")
+
+// The Appendix B vectors are eight digits; six-digit codes are their last six
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		step := TOTPStep(time.Unix(v.unix, 0))
+		if got := TOTPCode(rfc6238Secret, step); got != v.code {
+			t.Errorf("code at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		now := time.Unix(v.unix, 0)
+		step, ok := ValidateTOTP(rfc6238Secret, v.code, now, 0)
+		if !ok || step != TOTPStep(now) {
+			t.Errorf("code at %d: step %d, ok %v", v.unix, step, ok)
+		}
+	}
+
+	now := time.Unix(1111111111, 0)
+	current := TOTPStep(now)
+	code := TOTPCode(rfc6238Secret, current)
+	tests := []struct {
+		name     string
+		code     string
+		at       time.Time
+		lastStep int64
+		want     bool
+	}{
+		{"current step", code, now, 0, true},
+		{"one step early clock", code, now.Add(-TOTPPeriod * time.Second), 0, true},
+		{"one step late clock", code, now.Add(TOTPPeriod * time.Second), 0, true},
+		{"two steps off", code, now.Add(2 * TOTPPeriod * time.Second), 0, false},
+		{"replayed", code, now, current, false},
+		{"replayed after a later code", code, now, current + 1, false},
+		{"wrong code", "000000", now, 0, false},
+		{"too short", code[:5], now, 0, false},
+		{"too long", code + "0", now, 0, false},
+		{"empty", "", now, 0, false},
+	}
+	for _, tt := range tests {
+		step, ok := ValidateTOTP(rfc6238Secret, tt.code, tt.at, tt.lastStep)
+		if ok != tt.want {
+			t.Errorf("%s: ok = %v, want %v", tt.name, ok, tt.want)
+		}
+		if ok && step != current {
+			t.Errorf("%s: matched step %d, want %d", tt.name, step, current)
+		}
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri, err := url.Parse(TOTPProvisioningURI("Medicine App", "010101500123", rfc6238Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" {
+		t.Errorf("URI %s is not otpauth://totp", uri)
+	}
+	if label := strings.TrimPrefix(uri.Path, "/"); label != "Medicine App:010101500123" {
+		t.Errorf("label = %q", label)
+	}
+	query := uri.Query()
+	if secret, err := TOTPEncoding.DecodeString(query.Get("secret")); err != nil || string(secret) != string(rfc6238Secret) {
+		t.Errorf("secret %q does not decode to the key", query.Get("secret"))
+	}
+	if query.Get("digits") != "6" || query.Get("period") != "30" || query.Get("algorithm") != "SHA1" {
+		t.Errorf("unexpected parameters %v", query)
+	}
+}
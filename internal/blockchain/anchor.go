@@ -0,0 +1,165 @@
+package blockchain
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"diploma/internal/timestamp"
+)
+
+// Timestamper obtains and checks RFC 3161 time-stamp tokens for SHA-256 digests
+type Timestamper interface {
+	URL() string
+	Timestamp(digest []byte) (*timestamp.Token, error)
+	Verify(token, digest []byte) (*timestamp.Token, error)
+}
+
+// Anchor is a time-stamp token over the hash of a block. The token's message
+// imprint is the block hash itself, so it proves the chain reached that block
+// no later than GenTime, even if the whole table is later rewritten.
+type Anchor struct {
+	ID           int       `json:"id"`
+	BlockIndex   int       `json:"block_index"`
+	BlockHash    string    `json:"block_hash"`
+	TSAURL       string    `json:"tsa_url"`
+	Token        []byte    `json:"token"` // DER time-stamp token, base64 in JSON
+	GenTime      time.Time `json:"gen_time"`
+	SerialNumber string    `json:"serial_number"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// AnchorHead time-stamps the current chain head. If the head is already
+// anchored it returns the existing anchor and false.
+func (bc *Blockchain) AnchorHead() (*Anchor, bool, error) {
+	if bc.timestamper == nil {
+		return nil, false, fmt.Errorf("no time-stamp authority configured")
+	}
+
+	head, err := bc.Head()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read chain head: %v", err)
+	}
+
+	latest, err := bc.latestAnchor()
+	if err != nil && err != sql.ErrNoRows {
+		return nil, false, err
+	}
+	if err == nil && latest.BlockIndex == head.Index && latest.BlockHash == head.Hash {
+		return latest, false, nil
+	}
+
+	digest, err := hex.DecodeString(head.Hash)
+	if err != nil {
+		return nil, false, fmt.Errorf("block %d has a malformed hash: %v", head.Index, err)
+	}
+	token, err := bc.timestamper.Timestamp(digest)
+	if err != nil {
+		return nil, false, err
+	}
+
+	anchor := &Anchor{
+		BlockIndex:   head.Index,
+		BlockHash:    head.Hash,
+		TSAURL:       bc.timestamper.URL(),
+		Token:        token.Raw,
+		GenTime:      token.GenTime,
+		SerialNumber: token.SerialNumber.String(),
+	}
+	err = bc.db.QueryRow(`
+		INSERT INTO public.chain_anchors (block_index, block_hash, tsa_url, token, gen_time, serial_number)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`,
+		anchor.BlockIndex, anchor.BlockHash, anchor.TSAURL, anchor.Token, anchor.GenTime, anchor.SerialNumber,
+	).Scan(&anchor.ID, &anchor.CreatedAt)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to save anchor: %v", err)
+	}
+	return anchor, true, nil
+}
+
+// Anchors returns the most recent anchors, newest first
+func (bc *Blockchain) Anchors(limit int) ([]Anchor, error) {
+	return bc.queryAnchors(`
+		SELECT `+anchorColumns+`
+		FROM public.chain_anchors
+		ORDER BY id DESC LIMIT $1`, limit)
+}
+
+func (bc *Blockchain) latestAnchor() (*Anchor, error) {
+	anchors, err := bc.Anchors(1)
+	if err != nil {
+		return nil, err
+	}
+	if len(anchors) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &anchors[0], nil
+}
+
+const anchorColumns = `id, block_index, block_hash, tsa_url, token, gen_time, serial_number, created_at`
+
+func (bc *Blockchain) queryAnchors(query string, args ...interface{}) ([]Anchor, error) {
+	rows, err := bc.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var anchors []Anchor
+	for rows.Next() {
+		var a Anchor
+		if err := rows.Scan(&a.ID, &a.BlockIndex, &a.BlockHash, &a.TSAURL, &a.Token, &a.GenTime, &a.SerialNumber, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		anchors = append(anchors, a)
+	}
+	return anchors, rows.Err()
+}
+
+// verifyAnchors checks that the block every anchor names still has the
+// anchored hash, and the anchor's token. Without a time-stamp authority
+// configured the tokens cannot be checked; they are counted as unchecked.
+func (bc *Blockchain) verifyAnchors(v *Verifier) error {
+	anchors, err := bc.queryAnchors(`
+		SELECT ` + anchorColumns + `
+		FROM public.chain_anchors
+		ORDER BY id ASC`)
+	if err != nil {
+		return fmt.Errorf("failed to read anchors: %v", err)
+	}
+
+	for _, anchor := range anchors {
+		v.report.AnchorsChecked++
+
+		if bc.timestamper == nil {
+			v.report.AnchorTokensUnchecked++
+		} else {
+			digest, err := hex.DecodeString(anchor.BlockHash)
+			if err == nil {
+				_, err = bc.timestamper.Verify(anchor.Token, digest)
+			}
+			if err != nil {
+				v.Issue(0, anchor.BlockIndex, IssueInvalidAnchor,
+					fmt.Sprintf("anchor %d: %v", anchor.ID, err))
+			}
+		}
+
+		// Read past the cache, the stored row is what is being checked
+		var hash string
+		err = bc.db.QueryRow("SELECT hash FROM public.blocks WHERE index = $1", anchor.BlockIndex).Scan(&hash)
+		switch {
+		case err == sql.ErrNoRows:
+			v.Issue(0, anchor.BlockIndex, IssueAnchorMismatch,
+				fmt.Sprintf("anchor %d names block %d, which no longer exists", anchor.ID, anchor.BlockIndex))
+		case err != nil:
+			return fmt.Errorf("failed to read block %d: %v", anchor.BlockIndex, err)
+		case hash != anchor.BlockHash:
+			v.Issue(0, anchor.BlockIndex, IssueAnchorMismatch,
+				fmt.Sprintf("anchor %d time-stamped hash %s at %s, block now has hash %s",
+					anchor.ID, anchor.BlockHash, anchor.GenTime.Format(time.RFC3339), hash))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,382 @@
+package blockchain
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// An archive is a gzip-compressed tar file holding, in this order:
+//
+//	manifest.json  the Manifest, signed with the exporter's Ed25519 key
+//	keys.jsonl     one PublicKeyRecord per line, every doctor signing key
+//	blocks.jsonl   one Block per line, in index order
+//
+// A row that could not be read from the database is exported as an
+// unreadableRow line in its place, so the archive records the failure and
+// verifying it reports the row. The manifest signature covers the JSON
+// encoding of the manifest with an empty signature field. The manifest pins
+// the SHA-256 of the other two files.
+const (
+	ArchiveFormat  = "diploma-chain-archive"
+	ArchiveVersion = 3
+	// minArchiveVersion is the oldest version still verified. Version 2
+	// archives only differ in never holding unreadable rows.
+	minArchiveVersion = 2
+
+	manifestFile = "manifest.json"
+	keysFile     = "keys.jsonl"
+	blocksFile   = "blocks.jsonl"
+)
+
+// Manifest describes the contents of a chain archive
+type Manifest struct {
+	Format          string    `json:"format"`
+	Version         int       `json:"version"`
+	CreatedAt       time.Time `json:"created_at"`
+	BlockCount      int       `json:"block_count"`
+	UnreadableRows  int       `json:"unreadable_rows,omitempty"` // Rows exported as unreadableRow lines instead of blocks
+	HeadIndex       int       `json:"head_index"`
+	HeadHash        string    `json:"head_hash"`
+	BlocksSHA256    string    `json:"blocks_sha256"`
+	KeysSHA256      string    `json:"keys_sha256"`
+	LegacyTimezone  string    `json:"legacy_timezone"`   // Zone version 1 blocks were written in
+	SignerPublicKey string    `json:"signer_public_key"` // Base64 Ed25519 public key of the exporter
+	Signature       string    `json:"signature"`         // Base64 Ed25519 signature of the manifest
+}
+
+// PublicKeyRecord is a doctor signing key as stored in an archive
+type PublicKeyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	DoctorID    int    `json:"doctor_id"`
+	PublicKey   []byte `json:"public_key"`
+}
+
+// unreadableRow stands in blocks.jsonl for a row that could not be exported
+type unreadableRow struct {
+	Unreadable *VerificationIssue `json:"unreadable"`
+}
+
+// archiveLine is one line of blocks.jsonl, a block or an unreadableRow
+type archiveLine struct {
+	Block
+	Unreadable *VerificationIssue `json:"unreadable,omitempty"`
+}
+
+// KeyLister lists every doctor signing key, including revoked ones
+type KeyLister interface {
+	PublicKeys() ([]PublicKeyRecord, error)
+}
+
+// Export writes the whole stored chain and the doctor keys needed to check
+// its signatures as an archive signed with signingKey. legacyLocation is the
+// zone version 1 blocks were written in, recorded so they can be verified.
+func Export(db *sql.DB, keys KeyLister, signingKey ed25519.PrivateKey, legacyLocation *time.Location, w io.Writer) (*Manifest, error) {
+	manifest := &Manifest{
+		Format:          ArchiveFormat,
+		Version:         ArchiveVersion,
+		CreatedAt:       time.Now().UTC(),
+		HeadIndex:       -1,
+		LegacyTimezone:  legacyLocation.String(),
+		SignerPublicKey: base64.StdEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey)),
+	}
+
+	keyRecords, err := keys.PublicKeys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys: %v", err)
+	}
+	var keysData bytes.Buffer
+	encoder := json.NewEncoder(&keysData)
+	for _, record := range keyRecords {
+		if err := encoder.Encode(record); err != nil {
+			return nil, err
+		}
+	}
+	manifest.KeysSHA256 = sha256Hex(keysData.Bytes())
+
+	// Blocks are spooled to a temporary file, tar needs their size up front
+	blocksData, err := os.CreateTemp("", "blocks-*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(blocksData.Name())
+	defer blocksData.Close()
+
+	if err := exportBlocks(db, blocksData, manifest); err != nil {
+		return nil, err
+	}
+	blocksSize, err := blocksData.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := blocksData.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	signature := ed25519.Sign(signingKey, manifestPayload(manifest))
+	manifest.Signature = base64.StdEncoding.EncodeToString(signature)
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := writeTarFile(tw, manifestFile, int64(len(manifestData)), bytes.NewReader(manifestData)); err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(tw, keysFile, int64(keysData.Len()), &keysData); err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(tw, blocksFile, blocksSize, blocksData); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// exportBlocks streams every block to w as JSON lines and fills in the
+// manifest's block count, head and digest. Rows that cannot be read are
+// written as unreadableRow lines and counted, rather than ending the export.
+func exportBlocks(db *sql.DB, w io.Writer, manifest *Manifest) error {
+	rows, err := db.Query(`
+		SELECT ` + rowColumns + `
+		FROM public.blocks
+		ORDER BY index ASC, block_id ASC`)
+	if err != nil {
+		return fmt.Errorf("failed to read blocks: %v", err)
+	}
+	defer rows.Close()
+
+	digest := sha256.New()
+	buffered := bufio.NewWriter(io.MultiWriter(w, digest))
+	encoder := json.NewEncoder(buffered)
+	for rows.Next() {
+		_, block, issue := readRow(rows)
+		if issue != nil {
+			if err := encoder.Encode(unreadableRow{Unreadable: issue}); err != nil {
+				return err
+			}
+			manifest.UnreadableRows++
+			continue
+		}
+		if err := encoder.Encode(block); err != nil {
+			return err
+		}
+		manifest.BlockCount++
+		manifest.HeadIndex = block.Index
+		manifest.HeadHash = block.Hash
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+
+	manifest.BlocksSHA256 = hex.EncodeToString(digest.Sum(nil))
+	return nil
+}
+
+// VerifyArchive checks an archive offline: the manifest signature, the file
+// digests and the chain itself, using the same checks as Blockchain.Verify.
+// When trustedKey is nil the key embedded in the manifest is used, which only
+// proves the archive is intact, not who produced it.
+func VerifyArchive(r io.Reader, trustedKey ed25519.PublicKey) (*Manifest, *VerificationReport, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("archive is not gzip compressed: %v", err)
+	}
+	tr := tar.NewReader(gz)
+
+	var manifest *Manifest
+	keys := archiveKeys{}
+	var report *VerificationReport
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read archive: %v", err)
+		}
+
+		switch header.Name {
+		case manifestFile:
+			if manifest, err = readManifest(tr, trustedKey); err != nil {
+				return nil, nil, err
+			}
+		case keysFile:
+			if manifest == nil {
+				return nil, nil, errors.New("archive does not start with a manifest")
+			}
+			if err := keys.read(tr, manifest.KeysSHA256); err != nil {
+				return nil, nil, err
+			}
+		case blocksFile:
+			if manifest == nil {
+				return nil, nil, errors.New("archive does not start with a manifest")
+			}
+			if report, err = verifyArchiveBlocks(tr, keys, manifest); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if manifest == nil || report == nil {
+		return nil, nil, errors.New("archive is incomplete")
+	}
+	return manifest, report, nil
+}
+
+func readManifest(r io.Reader, trustedKey ed25519.PublicKey) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if manifest.Format != ArchiveFormat || manifest.Version < minArchiveVersion || manifest.Version > ArchiveVersion {
+		return nil, fmt.Errorf("unsupported archive format %s version %d", manifest.Format, manifest.Version)
+	}
+
+	embeddedKey, err := base64.StdEncoding.DecodeString(manifest.SignerPublicKey)
+	if err != nil || len(embeddedKey) != ed25519.PublicKeySize {
+		return nil, errors.New("manifest has an invalid signer public key")
+	}
+	if trustedKey != nil && !bytes.Equal(trustedKey, embeddedKey) {
+		return nil, errors.New("archive was not signed by the trusted key")
+	}
+	signature, err := base64.StdEncoding.DecodeString(manifest.Signature)
+	if err != nil {
+		return nil, errors.New("manifest signature is not valid base64")
+	}
+	if !ed25519.Verify(embeddedKey, manifestPayload(&manifest), signature) {
+		return nil, errors.New("manifest signature is invalid")
+	}
+	return &manifest, nil
+}
+
+func verifyArchiveBlocks(r io.Reader, keys KeyResolver, manifest *Manifest) (*VerificationReport, error) {
+	digest := sha256.New()
+	scanner := bufio.NewScanner(io.TeeReader(r, digest))
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	legacyLocation, err := time.LoadLocation(manifest.LegacyTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown legacy timezone %q: %v", manifest.LegacyTimezone, err)
+	}
+
+	verifier := NewVerifier(keys, legacyLocation)
+	line := 0
+	for scanner.Scan() {
+		line++
+		// Archives have no block IDs, issues refer to the line number instead
+		var entry archiveLine
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			verifier.Issue(line, -1, IssueUnreadableRow, err.Error())
+			continue
+		}
+		if issue := entry.Unreadable; issue != nil {
+			verifier.Issue(line, issue.Index, issue.Kind,
+				fmt.Sprintf("block_id %d could not be exported: %s", issue.BlockID, issue.Message))
+			continue
+		}
+		verifier.Check(line, entry.Block)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read blocks: %v", err)
+	}
+	// Drain anything the scanner left so the digest covers the whole file
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, err
+	}
+
+	if got := hex.EncodeToString(digest.Sum(nil)); got != manifest.BlocksSHA256 {
+		return nil, fmt.Errorf("blocks digest %s does not match manifest %s", got, manifest.BlocksSHA256)
+	}
+
+	report := verifier.Finish()
+	if report.BlocksChecked != manifest.BlockCount || report.HeadHash != manifest.HeadHash {
+		report.Valid = false
+		report.Issues = append(report.Issues, VerificationIssue{
+			Index:   report.HeadIndex,
+			Kind:    IssueManifestMismatch,
+			Message: fmt.Sprintf("archive head %s (%d blocks) does not match manifest head %s (%d blocks)", report.HeadHash, report.BlocksChecked, manifest.HeadHash, manifest.BlockCount),
+		})
+	}
+	return report, nil
+}
+
+// archiveKeys resolves doctor keys from an archive's keys.jsonl
+type archiveKeys map[string]PublicKeyRecord
+
+func (k archiveKeys) read(r io.Reader, expectedSHA256 string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if got := sha256Hex(data); got != expectedSHA256 {
+		return fmt.Errorf("keys digest %s does not match manifest %s", got, expectedSHA256)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		var record PublicKeyRecord
+		if err := decoder.Decode(&record); err != nil {
+			return fmt.Errorf("invalid key record: %v", err)
+		}
+		k[record.Fingerprint] = record
+	}
+	return nil
+}
+
+func (k archiveKeys) PublicKey(fingerprint string) (int, ed25519.PublicKey, error) {
+	record, ok := k[fingerprint]
+	if !ok {
+		return 0, nil, errors.New("key is not in the archive")
+	}
+	return record.DoctorID, ed25519.PublicKey(record.PublicKey), nil
+}
+
+// manifestPayload is the byte string the exporter signs
+func manifestPayload(manifest *Manifest) []byte {
+	unsigned := *manifest
+	unsigned.Signature = ""
+	data, _ := json.Marshal(unsigned)
+	return data
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
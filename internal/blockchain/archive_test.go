@@ -0,0 +1,81 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestVerifyArchiveBlocksReportsUnreadableRows(t *testing.T) {
+	genesis := GenesisBlock()
+	var blocks bytes.Buffer
+	encoder := json.NewEncoder(&blocks)
+	if err := encoder.Encode(genesis); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Encode(unreadableRow{Unreadable: &VerificationIssue{
+		BlockID: 42,
+		Index:   1,
+		Kind:    IssueInvalidTransaction,
+		Message: "unexpected end of JSON input",
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := &Manifest{
+		BlockCount:     1,
+		UnreadableRows: 1,
+		HeadIndex:      genesis.Index,
+		HeadHash:       genesis.Hash,
+		BlocksSHA256:   sha256Hex(blocks.Bytes()),
+		LegacyTimezone: "UTC",
+	}
+	report, err := verifyArchiveBlocks(&blocks, archiveKeys{}, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Valid {
+		t.Error("archive with an unreadable row verified as valid")
+	}
+	if report.BlocksChecked != 1 || report.HeadHash != genesis.Hash {
+		t.Errorf("checked %d blocks up to %s, want 1 up to %s", report.BlocksChecked, report.HeadHash, genesis.Hash)
+	}
+	if len(report.Issues) != 1 {
+		t.Fatalf("got %d issues, want 1: %+v", len(report.Issues), report.Issues)
+	}
+	issue := report.Issues[0]
+	if issue.BlockID != 2 || issue.Index != 1 || issue.Kind != IssueInvalidTransaction || !strings.Contains(issue.Message, "block_id 42") {
+		t.Errorf("unexpected issue %+v", issue)
+	}
+}
+
+func TestVerifyArchiveBlocksReportsManifestMismatch(t *testing.T) {
+	genesis := GenesisBlock()
+	data, err := json.Marshal(genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := append(data, '\n')
+
+	// The manifest of a longer chain, with its later blocks cut off
+	manifest := &Manifest{
+		BlockCount:     2,
+		HeadIndex:      1,
+		HeadHash:       strings.Repeat("ab", 32),
+		BlocksSHA256:   sha256Hex(blocks),
+		LegacyTimezone: "UTC",
+	}
+	report, err := verifyArchiveBlocks(bytes.NewReader(blocks), archiveKeys{}, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Valid {
+		t.Error("truncated archive verified as valid")
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Kind != IssueManifestMismatch {
+		t.Fatalf("got issues %+v, want one %s", report.Issues, IssueManifestMismatch)
+	}
+}
@@ -1,133 +1,339 @@
 package blockchain
 
 import (
-	"crypto/sha256"
+	"crypto/ed25519"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq" // PostgreSQL driver
 )
 
 type Block struct {
-	Index        int         `json:"index"`
-	Timestamp    time.Time   `json:"timestamp"`
-	Transaction  Transaction `json:"transaction"`
-	PreviousHash string      `json:"previous_hash"`
-	Hash         string      `json:"hash"`
+	Version        int         `json:"schema_version"` // Hashing format, see canonical.go
+	Index          int         `json:"index"`
+	Timestamp      time.Time   `json:"timestamp"`
+	Transaction    Transaction `json:"transaction"`
+	PreviousHash   string      `json:"previous_hash"`
+	Hash           string      `json:"hash"`
+	Signature      string      `json:"signature,omitempty"`       // Base64 Ed25519 signature of the transaction
+	KeyFingerprint string      `json:"key_fingerprint,omitempty"` // Fingerprint of the doctor's public key
 }
 
 type Transaction struct {
-	Action    string    `json:"action"`     // "Create" or "Update"
+	Action    string    `json:"action"`     // "Create", "Update" or "EmergencyAccess"
 	RecordID  int       `json:"record_id"`  // ID of the medical record
 	DoctorID  int       `json:"doctor_id"`  // Doctor who performed the action
 	PatientID int       `json:"patient_id"` // Patient associated with the record
 	Timestamp time.Time `json:"timestamp"`
-	Details   string    `json:"details"` // JSON string of record data
+	Details   string    `json:"details"` // JSON string of record data, empty from schema version 3
+
+	// From schema version 3 the record data is stored encrypted with the
+	// patient's data key, and only its keyed hash is covered by the block hash
+	DetailsHash      string `json:"details_hash,omitempty"`      // Hex HMAC-SHA256 of the record JSON under the patient's data key
+	EncryptedDetails string `json:"encrypted_details,omitempty"` // Base64 AES-256-GCM ciphertext of the record JSON
+}
+
+// BlockHeader holds the fields that link a block into the chain, without the
+// transaction and its record data
+type BlockHeader struct {
+	Version      int       `json:"schema_version"`
+	Index        int       `json:"index"`
+	Timestamp    time.Time `json:"timestamp"`
+	PreviousHash string    `json:"previous_hash"`
+	Hash         string    `json:"hash"`
+}
+
+// Header returns the block's header
+func (b *Block) Header() BlockHeader {
+	return BlockHeader{
+		Version:      b.Version,
+		Index:        b.Index,
+		Timestamp:    b.Timestamp,
+		PreviousHash: b.PreviousHash,
+		Hash:         b.Hash,
+	}
+}
+
+// KeyResolver looks up the public key behind a key fingerprint and the doctor who owns it
+type KeyResolver interface {
+	PublicKey(fingerprint string) (doctorID int, key ed25519.PublicKey, err error)
+}
+
+// Signer signs transaction payloads with a doctor's private key
+type Signer interface {
+	KeyResolver
+	Sign(doctorID int, payload []byte) (signature []byte, fingerprint string, err error)
 }
 
+// Blockchain appends to and reads from the chain stored in public.blocks.
+// It keeps no copy of the chain: the tip is read from the database under a
+// lock on every append, so any number of API instances can share one chain.
 type Blockchain struct {
-	db    *sql.DB
-	Chain []Block
+	db             *sql.DB
+	signer         Signer
+	legacyLocation *time.Location
+	timestamper    Timestamper
+	mu             sync.Mutex // Serializes appends within this process
+	cache          *blockCache
 }
 
-func NewBlockchain(db *sql.DB) *Blockchain {
-	bc := &Blockchain{db: db, Chain: make([]Block, 0)}
-	bc.loadFromDB() // Load existing blocks from DB on initialization
-	if len(bc.Chain) == 0 {
-		bc.Chain = append(bc.Chain, GenesisBlock())
-		bc.saveBlock(GenesisBlock()) // Save genesis block to DB
+// Options configures a Blockchain
+type Options struct {
+	// CacheSize is the maximum number of blocks kept in memory
+	CacheSize int
+	// LegacyLocation is the time zone the server ran in while it wrote
+	// version 1 blocks, needed to verify them. Defaults to time.Local.
+	LegacyLocation *time.Location
+	// Timestamper anchors the chain head to a time-stamp authority, nil disables anchoring
+	Timestamper Timestamper
+}
+
+// NewBlockchain connects to the stored chain, creating the genesis block if
+// the chain is empty
+func NewBlockchain(db *sql.DB, signer Signer, options Options) (*Blockchain, error) {
+	if options.LegacyLocation == nil {
+		options.LegacyLocation = time.Local
+	}
+	bc := &Blockchain{
+		db:             db,
+		signer:         signer,
+		legacyLocation: options.LegacyLocation,
+		timestamper:    options.Timestamper,
+		cache:          newBlockCache(options.CacheSize),
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM public.blocks)").Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to read blocks: %v", err)
 	}
-	return bc
+	if !exists {
+		// Another instance may create the genesis block at the same time
+		if err := bc.saveBlock(db, GenesisBlock(), "ON CONFLICT (index) DO NOTHING"); err != nil {
+			return nil, fmt.Errorf("failed to save genesis block: %v", err)
+		}
+	}
+	return bc, nil
 }
 
 func GenesisBlock() Block {
-	return Block{
+	timestamp := canonicalNow()
+	genesis := Block{
+		Version:      CurrentSchema,
 		Index:        0,
-		Timestamp:    time.Now(),
-		Transaction:  Transaction{},
+		Timestamp:    timestamp,
+		Transaction:  Transaction{Timestamp: timestamp},
 		PreviousHash: "0",
-		Hash:         calculateHash(0, time.Now(), Transaction{}, "0"),
 	}
+	genesis.Hash, _ = blockHash(genesis)
+	return genesis
 }
 
-func calculateHash(index int, timestamp time.Time, transaction Transaction, previousHash string) string {
-	record := struct {
-		Index        int
-		Timestamp    time.Time
-		Transaction  Transaction
-		PreviousHash string
-	}{
-		Index:        index,
-		Timestamp:    timestamp,
-		Transaction:  transaction,
-		PreviousHash: previousHash,
+// verifySignature checks a block's signature against the doctor key it names
+func verifySignature(keys KeyResolver, block Block) error {
+	doctorID, publicKey, err := keys.PublicKey(block.KeyFingerprint)
+	if err != nil {
+		return fmt.Errorf("unknown signing key %s: %v", block.KeyFingerprint, err)
+	}
+	if doctorID != block.Transaction.DoctorID {
+		return fmt.Errorf("key %s belongs to doctor %d, not doctor %d", block.KeyFingerprint, doctorID, block.Transaction.DoctorID)
 	}
 
-	data, _ := json.Marshal(record)
-	hash := sha256.Sum256(data)
-	return fmt.Sprintf("%x", hash)
+	signature, err := base64.StdEncoding.DecodeString(block.Signature)
+	if err != nil {
+		return fmt.Errorf("signature is not valid base64: %v", err)
+	}
+	payload, err := signingPayload(block)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, payload, signature) {
+		return fmt.Errorf("signature does not match transaction")
+	}
+	return nil
 }
 
-func (bc *Blockchain) AddBlock(action string, recordID, doctorID, patientID int, details string) {
-	previousBlock := bc.Chain[len(bc.Chain)-1]
+// chainLockKey is the Postgres advisory lock that serializes appends across all API instances
+const chainLockKey = 727274001
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Append runs write inside a database transaction and appends a signed block
+// for the transaction it returns. The record write and the block insert are
+// committed together, and appends are serialized by a mutex within the
+// process and by an advisory lock across processes, so the chain cannot fork.
+func (bc *Blockchain) Append(write func(tx *sql.Tx) (Transaction, error)) (*Block, error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	tx, err := bc.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", chainLockKey); err != nil {
+		return nil, fmt.Errorf("failed to lock chain: %v", err)
+	}
+
+	transaction, err := write(tx)
+	if err != nil {
+		return nil, err
+	}
+	transaction.Timestamp = canonicalNow()
+	if transaction.Details != "" {
+		return nil, fmt.Errorf("plaintext transaction details cannot be stored on-chain, encrypt them first")
+	}
+
+	// Read the tip under the lock, other instances append to the same chain
+	var previousBlock Block
+	err = tx.QueryRow(`
+		SELECT index, hash FROM public.blocks
+		ORDER BY index DESC LIMIT 1`).Scan(&previousBlock.Index, &previousBlock.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chain tip: %v", err)
+	}
+
 	newBlock := Block{
-		Index:     previousBlock.Index + 1,
-		Timestamp: time.Time{},
-		Transaction: Transaction{
-			Action:    action,
-			RecordID:  recordID,
-			DoctorID:  doctorID,
-			PatientID: patientID,
-			Timestamp: time.Now(),
-			Details:   details,
-		},
+		Version:      CurrentSchema,
+		Index:        previousBlock.Index + 1,
+		Transaction:  transaction,
 		PreviousHash: previousBlock.Hash,
-		Hash:         "",
 	}
 
-	newBlock.Timestamp = time.Now()
-	newBlock.Hash = calculateHash(newBlock.Index, newBlock.Timestamp, newBlock.Transaction, newBlock.PreviousHash)
+	payload, err := signingPayload(newBlock)
+	if err != nil {
+		return nil, err
+	}
+	signature, fingerprint, err := bc.signer.Sign(transaction.DoctorID, payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign transaction: %v", err)
+	}
+	newBlock.Signature = base64.StdEncoding.EncodeToString(signature)
+	newBlock.KeyFingerprint = fingerprint
+
+	newBlock.Timestamp = canonicalNow()
+	if newBlock.Hash, err = blockHash(newBlock); err != nil {
+		return nil, err
+	}
+
+	if err := bc.saveBlock(tx, newBlock, ""); err != nil {
+		return nil, fmt.Errorf("failed to save block: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
 
-	bc.Chain = append(bc.Chain, newBlock)
-	bc.saveBlock(newBlock) // Save to DB
+	bc.cache.put(newBlock)
+	return &newBlock, nil
 }
 
-func (bc *Blockchain) saveBlock(block Block) error {
+// saveBlock inserts a block, onConflict is appended to the INSERT statement
+func (bc *Blockchain) saveBlock(exec execer, block Block, onConflict string) error {
 	transactionJSON, err := json.Marshal(block.Transaction)
 	if err != nil {
 		return err
 	}
 
-	_, err = bc.db.Exec(`
-        INSERT INTO public.blocks (index, timestamp, transaction, previous_hash, hash)
-        VALUES ($1, $2, $3, $4, $5)`,
-		block.Index, block.Timestamp, transactionJSON, block.PreviousHash, block.Hash)
+	_, err = exec.Exec(`
+        INSERT INTO public.blocks (schema_version, index, timestamp, transaction, previous_hash, hash, signature, key_fingerprint)
+        VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''))
+        `+onConflict,
+		block.Version, block.Index, block.Timestamp, transactionJSON, block.PreviousHash, block.Hash, block.Signature, block.KeyFingerprint)
 	return err
 }
 
-func (bc *Blockchain) loadFromDB() {
-	rows, err := bc.db.Query("SELECT index, timestamp, transaction, previous_hash, hash FROM public.blocks ORDER BY index ASC")
+// blockColumns are the columns scanBlock expects, in order
+const blockColumns = `schema_version, index, timestamp, transaction, previous_hash, hash,
+		COALESCE(signature, ''), COALESCE(key_fingerprint, '')`
+
+// scanBlock reads a row selected with blockColumns
+func scanBlock(scan func(dest ...interface{}) error) (Block, error) {
+	var block Block
+	var transactionJSON []byte
+	if err := scan(&block.Version, &block.Index, &block.Timestamp, &transactionJSON, &block.PreviousHash, &block.Hash, &block.Signature, &block.KeyFingerprint); err != nil {
+		return block, err
+	}
+	if err := json.Unmarshal(transactionJSON, &block.Transaction); err != nil {
+		return block, fmt.Errorf("block %d has invalid transaction: %v", block.Index, err)
+	}
+	return block, nil
+}
+
+// Head returns the current tip of the chain
+func (bc *Blockchain) Head() (*Block, error) {
+	blocks, err := bc.queryBlocks(`
+		SELECT ` + blockColumns + `
+		FROM public.blocks
+		ORDER BY index DESC LIMIT 1`)
 	if err != nil {
-		return // Handle error appropriately in production
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	bc.cache.put(blocks[0])
+	return &blocks[0], nil
+}
+
+// BlockByIndex returns the block stored at the given index
+func (bc *Blockchain) BlockByIndex(index int) (*Block, error) {
+	if block, ok := bc.cache.get(index); ok {
+		return &block, nil
+	}
+
+	blocks, err := bc.queryBlocks(`
+		SELECT `+blockColumns+`
+		FROM public.blocks
+		WHERE index = $1`, index)
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	bc.cache.put(blocks[0])
+	return &blocks[0], nil
+}
+
+// BlocksByRecordID returns every block whose transaction touches the given record, oldest first
+func (bc *Blockchain) BlocksByRecordID(recordID int) ([]Block, error) {
+	return bc.queryBlocks(`
+		SELECT `+blockColumns+`
+		FROM public.blocks
+		WHERE (transaction->>'record_id')::int = $1
+		ORDER BY index ASC`, recordID)
+}
+
+// BlocksByPatientID returns every block whose transaction belongs to the given patient, oldest first
+func (bc *Blockchain) BlocksByPatientID(patientID int) ([]Block, error) {
+	return bc.queryBlocks(`
+		SELECT `+blockColumns+`
+		FROM public.blocks
+		WHERE (transaction->>'patient_id')::int = $1
+		ORDER BY index ASC`, patientID)
+}
+
+func (bc *Blockchain) queryBlocks(query string, args ...interface{}) ([]Block, error) {
+	rows, err := bc.db.Query(query, args...)
+	if err != nil {
+		return nil, err
 	}
 	defer rows.Close()
 
+	var blocks []Block
 	for rows.Next() {
-		var block Block
-		var transactionJSON []byte
-		err := rows.Scan(&block.Index, &block.Timestamp, &transactionJSON, &block.PreviousHash, &block.Hash)
+		block, err := scanBlock(rows.Scan)
 		if err != nil {
-			continue // Skip invalid blocks
-		}
-
-		var transaction Transaction
-		if err := json.Unmarshal(transactionJSON, &transaction); err != nil {
-			continue // Skip if transaction JSON is invalid
+			return nil, err
 		}
-
-		block.Transaction = transaction
-		bc.Chain = append(bc.Chain, block)
+		blocks = append(blocks, block)
 	}
+	return blocks, rows.Err()
 }
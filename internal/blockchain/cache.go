@@ -0,0 +1,60 @@
+package blockchain
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultCacheSize is the number of blocks kept in memory when no size is configured
+const DefaultCacheSize = 256
+
+// blockCache is a bounded least-recently-used cache of blocks keyed by index.
+// Stored blocks never change, so cached copies never go stale; the database
+// remains the source of truth for the chain tip.
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // Front is the most recently used
+	entries  map[int]*list.Element
+}
+
+func newBlockCache(capacity int) *blockCache {
+	if capacity <= 0 {
+		capacity = DefaultCacheSize
+	}
+	return &blockCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[int]*list.Element),
+	}
+}
+
+func (c *blockCache) get(index int) (Block, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[index]
+	if !ok {
+		return Block{}, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(Block), true
+}
+
+func (c *blockCache) put(block Block) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[block.Index]; ok {
+		element.Value = block
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[block.Index] = c.order.PushFront(block)
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(Block).Index)
+	}
+}
@@ -0,0 +1,200 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Block hashing formats, recorded per block in public.blocks.schema_version.
+//
+// Version 3 (current) is version 2 with the literals "block/3" and
+// "transaction/3", and with field 10 replaced by the transaction's
+// details_hash. The record details are stored encrypted with the patient's
+// data key and are not part of the hash or signature, so deleting that key
+// makes them unreadable without breaking the chain.
+//
+// Version 2 is a canonical byte encoding that any language can reproduce. The hash input is a sequence of fields, each written as the
+// decimal byte length of its value, a colon, the UTF-8 value and a newline:
+//
+//	len ":" value "\n"
+//
+// The fields, in this order, are:
+//
+//  1. the literal "block/2"
+//  2. index, in decimal
+//  3. block timestamp
+//  4. previous_hash
+//  5. transaction action
+//  6. transaction record_id, in decimal
+//  7. transaction doctor_id, in decimal
+//  8. transaction patient_id, in decimal
+//  9. transaction timestamp
+//  10. transaction details
+//  11. key_fingerprint, empty if unsigned
+//  12. signature (base64), empty if unsigned
+//
+// Timestamps are UTC in RFC 3339 with exactly six fractional digits, the
+// precision Postgres stores, e.g. "2024-03-14T12:00:00.123456Z". The block
+// hash is the lowercase hex SHA-256 of the encoding. A doctor signs the
+// encoding of the literal "transaction/2" followed by fields 5 to 10.
+//
+// Version 1 (legacy) hashed Go's encoding/json output for the struct
+// {Index, Timestamp, Transaction, PreviousHash} with the block timestamp at
+// nanosecond precision in the server's local zone, and signed Go's JSON for
+// the transaction. Postgres keeps neither, so legacy blocks are verified by
+// searching the sub-microsecond digits Postgres rounded away, in the zone the
+// server ran in. Legacy blocks are never rewritten: the first version 2 block
+// links to the last legacy hash, so the chain stays continuous.
+const (
+	SchemaLegacy    = 1
+	SchemaCanonical = 2
+	SchemaEncrypted = 3
+
+	// CurrentSchema is the format used for new blocks
+	CurrentSchema = SchemaEncrypted
+
+	canonicalTimeLayout = "2006-01-02T15:04:05.000000Z"
+)
+
+// canonicalTime formats a timestamp for hashing and truncates nothing:
+// callers store timestamps already truncated to microseconds
+func canonicalTime(t time.Time) string {
+	return t.UTC().Format(canonicalTimeLayout)
+}
+
+// canonicalNow returns the current time at the precision Postgres stores
+func canonicalNow() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+type canonicalEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *canonicalEncoder) field(value string) {
+	e.buf.WriteString(strconv.Itoa(len(value)))
+	e.buf.WriteByte(':')
+	e.buf.WriteString(value)
+	e.buf.WriteByte('\n')
+}
+
+func (e *canonicalEncoder) transaction(version int, t Transaction) {
+	e.field(t.Action)
+	e.field(strconv.Itoa(t.RecordID))
+	e.field(strconv.Itoa(t.DoctorID))
+	e.field(strconv.Itoa(t.PatientID))
+	e.field(canonicalTime(t.Timestamp))
+	if version == SchemaCanonical {
+		e.field(t.Details)
+	} else {
+		e.field(t.DetailsHash)
+	}
+}
+
+// CanonicalBytes returns the hash input of a version 2 or 3 block
+func CanonicalBytes(block Block) []byte {
+	var e canonicalEncoder
+	e.field("block/" + strconv.Itoa(block.Version))
+	e.field(strconv.Itoa(block.Index))
+	e.field(canonicalTime(block.Timestamp))
+	e.field(block.PreviousHash)
+	e.transaction(block.Version, block.Transaction)
+	e.field(block.KeyFingerprint)
+	e.field(block.Signature)
+	return e.buf.Bytes()
+}
+
+// blockHash computes the hash of a block in the format of its schema version.
+// Legacy blocks are hashed exactly as given, see verifyLegacyHash.
+func blockHash(block Block) (string, error) {
+	switch block.Version {
+	case SchemaCanonical, SchemaEncrypted:
+		sum := sha256.Sum256(CanonicalBytes(block))
+		return hex.EncodeToString(sum[:]), nil
+	case SchemaLegacy:
+		return calculateHash(block.Index, block.Timestamp, block.Transaction, block.PreviousHash), nil
+	default:
+		return "", fmt.Errorf("unknown block schema version %d", block.Version)
+	}
+}
+
+// signingPayload is the byte string a doctor signs for a block's transaction
+func signingPayload(block Block) ([]byte, error) {
+	switch block.Version {
+	case SchemaCanonical, SchemaEncrypted:
+		var e canonicalEncoder
+		e.field("transaction/" + strconv.Itoa(block.Version))
+		e.transaction(block.Version, block.Transaction)
+		return e.buf.Bytes(), nil
+	case SchemaLegacy:
+		return json.Marshal(block.Transaction)
+	default:
+		return nil, fmt.Errorf("unknown block schema version %d", block.Version)
+	}
+}
+
+// calculateHash is the legacy (version 1) block hash
+func calculateHash(index int, timestamp time.Time, transaction Transaction, previousHash string) string {
+	record := struct {
+		Index        int
+		Timestamp    time.Time
+		Transaction  Transaction
+		PreviousHash string
+	}{
+		Index:        index,
+		Timestamp:    timestamp,
+		Transaction:  transaction,
+		PreviousHash: previousHash,
+	}
+
+	data, _ := json.Marshal(record)
+	hash := sha256.Sum256(data)
+	return fmt.Sprintf("%x", hash)
+}
+
+// verifyLegacyHash checks a version 1 block read back from Postgres. The
+// stored timestamp is the writer's local wall clock rounded to microseconds,
+// so the original is rebuilt in location and each nanosecond offset that
+// rounds to the stored value is tried. The legacy genesis block is the
+// expected exception and is accepted as is, see isLegacyGenesis.
+func verifyLegacyHash(block Block, location *time.Location) bool {
+	if isLegacyGenesis(block) {
+		return true
+	}
+
+	stored := block.Timestamp
+	if calculateHash(block.Index, stored, block.Transaction, block.PreviousHash) == block.Hash {
+		return true
+	}
+
+	wallClock := time.Date(stored.Year(), stored.Month(), stored.Day(),
+		stored.Hour(), stored.Minute(), stored.Second(), stored.Nanosecond(), location)
+	for offset := -500; offset < 500; offset++ {
+		candidate := wallClock.Add(time.Duration(offset))
+		if calculateHash(block.Index, candidate, block.Transaction, block.PreviousHash) == block.Hash {
+			return true
+		}
+	}
+	return false
+}
+
+// isLegacyGenesis reports whether block is a genesis block written by the
+// version 1 code. It hashed a second time.Now() rather than the timestamp it
+// stored, so its hash cannot be reproduced. The block holds no transaction and
+// later blocks link to its hash, so accepting that hash loses nothing.
+func isLegacyGenesis(block Block) bool {
+	if block.Version != SchemaLegacy || block.Index != 0 || block.PreviousHash != "0" {
+		return false
+	}
+	if t := block.Transaction; t.Action != "" || t.RecordID != 0 || t.DoctorID != 0 || t.PatientID != 0 ||
+		!t.Timestamp.IsZero() || t.Details != "" || t.DetailsHash != "" || t.EncryptedDetails != "" {
+		return false
+	}
+	hash, err := hex.DecodeString(block.Hash)
+	return err == nil && len(hash) == sha256.Size
+}
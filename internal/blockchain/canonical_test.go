@@ -0,0 +1,157 @@
+package blockchain
+
+import (
+	"testing"
+	"time"
+)
+
+const goldenPreviousHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+// goldenBlock is the block behind the golden hashes below, in the given
+// schema version. The hashes were computed from the documented encodings
+// outside Go, so a change to the encoding cannot also change what is expected.
+func goldenBlock(version int) Block {
+	blockTime := time.Date(2024, 3, 14, 12, 0, 0, 123456000, time.UTC)
+	block := Block{
+		Version:      version,
+		Index:        5,
+		Timestamp:    blockTime,
+		PreviousHash: goldenPreviousHash,
+		Transaction: Transaction{
+			Action:    "Create",
+			RecordID:  7,
+			DoctorID:  3,
+			PatientID: 9,
+			Timestamp: time.Date(2024, 3, 14, 12, 0, 0, 123000000, time.UTC),
+		},
+		KeyFingerprint: "fp",
+		Signature:      "c2ln",
+	}
+	switch version {
+	case SchemaLegacy:
+		// Version 1 hashed the writer's local time at full precision, unsigned
+		zone := time.FixedZone("", 5*60*60)
+		block.Timestamp = time.Date(2024, 3, 14, 17, 0, 0, 123456789, zone)
+		block.Transaction.Timestamp = block.Transaction.Timestamp.In(zone)
+		block.Transaction.Details = `{"diagnosis":"Flu"}`
+		block.KeyFingerprint, block.Signature = "", ""
+	case SchemaCanonical:
+		block.Transaction.Details = `{"diagnosis":"Flu"}`
+	case SchemaEncrypted:
+		block.Transaction.DetailsHash = "d1"
+		block.Transaction.EncryptedDetails = "ignored by the hash"
+	}
+	return block
+}
+
+func TestBlockHashGolden(t *testing.T) {
+	tests := []struct {
+		version int
+		want    string
+	}{
+		{SchemaLegacy, "31ec2caf6635bc084b501c9b1160cbb08a4fa13950f4b0f05115b01856fc9f1a"},
+		{SchemaCanonical, "f1d5bc012013ba200bff4e2cb9a867612c7eaad8e2b58671f511142abf9570b0"},
+		{SchemaEncrypted, "d5fe946a8c7305b0a23b5b7bf27d3c95d08cbe86a13ed878486e6647fa377986"},
+	}
+	for _, tt := range tests {
+		got, err := blockHash(goldenBlock(tt.version))
+		if err != nil {
+			t.Fatalf("version %d: %v", tt.version, err)
+		}
+		if got != tt.want {
+			t.Errorf("version %d hash = %s, want %s", tt.version, got, tt.want)
+		}
+	}
+
+	if _, err := blockHash(goldenBlock(4)); err == nil {
+		t.Error("blockHash accepted an unknown schema version")
+	}
+}
+
+func TestCanonicalBytes(t *testing.T) {
+	want := "7:block/2\n1:5\n27:2024-03-14T12:00:00.123456Z\n64:" + goldenPreviousHash + "\n" +
+		"6:Create\n1:7\n1:3\n1:9\n27:2024-03-14T12:00:00.123000Z\n19:{\"diagnosis\":\"Flu\"}\n" +
+		"2:fp\n4:c2ln\n"
+	if got := string(CanonicalBytes(goldenBlock(SchemaCanonical))); got != want {
+		t.Errorf("CanonicalBytes = %q, want %q", got, want)
+	}
+
+	// Timestamps hash the same whatever zone they are held in
+	block := goldenBlock(SchemaCanonical)
+	block.Timestamp = block.Timestamp.In(time.FixedZone("", -3*60*60))
+	if got := string(CanonicalBytes(block)); got != want {
+		t.Errorf("CanonicalBytes in another zone = %q, want %q", got, want)
+	}
+}
+
+func TestSigningPayload(t *testing.T) {
+	tests := []struct {
+		version int
+		want    string
+	}{
+		{SchemaCanonical, "13:transaction/2\n6:Create\n1:7\n1:3\n1:9\n27:2024-03-14T12:00:00.123000Z\n19:{\"diagnosis\":\"Flu\"}\n"},
+		{SchemaEncrypted, "13:transaction/3\n6:Create\n1:7\n1:3\n1:9\n27:2024-03-14T12:00:00.123000Z\n2:d1\n"},
+	}
+	for _, tt := range tests {
+		got, err := signingPayload(goldenBlock(tt.version))
+		if err != nil {
+			t.Fatalf("version %d: %v", tt.version, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("version %d payload = %q, want %q", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyLegacyHash(t *testing.T) {
+	written := goldenBlock(SchemaLegacy)
+	written.Hash = "31ec2caf6635bc084b501c9b1160cbb08a4fa13950f4b0f05115b01856fc9f1a"
+
+	// Postgres keeps the local wall clock at microsecond precision, read back as UTC
+	stored := written
+	stored.Timestamp = time.Date(2024, 3, 14, 17, 0, 0, 123457000, time.UTC)
+
+	zone := written.Timestamp.Location()
+	tests := []struct {
+		name     string
+		block    Block
+		location *time.Location
+		want     bool
+	}{
+		{"as written", written, zone, true},
+		{"read back", stored, zone, true},
+		{"read back in another zone", stored, time.UTC, false},
+		{"changed details", withDetails(stored, `{"diagnosis":"Cold"}`), zone, false},
+		{"legacy genesis", legacyGenesis(), zone, true},
+		{"legacy genesis with a transaction", withDetails(legacyGenesis(), "{}"), zone, false},
+		{"legacy genesis with a malformed hash", withHash(legacyGenesis(), "0"), zone, false},
+		{"later block posing as genesis", withHash(withDetails(stored, ""), legacyGenesis().Hash), zone, false},
+	}
+	for _, tt := range tests {
+		if got := verifyLegacyHash(tt.block, tt.location); got != tt.want {
+			t.Errorf("%s: verifyLegacyHash = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func withDetails(block Block, details string) Block {
+	block.Transaction.Details = details
+	return block
+}
+
+// legacyGenesis is a genesis block as the version 1 code stored it, with a
+// hash of a slightly later time than its timestamp
+func legacyGenesis() Block {
+	return Block{
+		Version:      SchemaLegacy,
+		Index:        0,
+		Timestamp:    time.Date(2024, 1, 10, 9, 30, 0, 123457000, time.UTC),
+		PreviousHash: "0",
+		Hash:         "8a1b3f0e5c2d4e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7",
+	}
+}
+
+func withHash(block Block, hash string) Block {
+	block.Hash = hash
+	return block
+}
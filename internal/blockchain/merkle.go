@@ -0,0 +1,204 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+)
+
+// MerkleBatchSize is the number of consecutive blocks covered by one Merkle tree.
+// Batch n holds the blocks with index n*MerkleBatchSize up to (n+1)*MerkleBatchSize-1.
+const MerkleBatchSize = 1024
+
+// The tree follows RFC 6962: a leaf is SHA-256(0x00 || block hash) and an
+// interior node is SHA-256(0x01 || left || right), where the block hash is
+// taken as the ASCII bytes of its hex string. The last batch grows as blocks
+// are appended, so a root is only meaningful together with its tree size.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleRoot is the root of one batch of blocks at a given tree size
+type MerkleRoot struct {
+	Batch      int    `json:"batch"`
+	FirstIndex int    `json:"first_index"`
+	TreeSize   int    `json:"tree_size"`
+	Complete   bool   `json:"complete"`
+	Root       string `json:"root"`
+}
+
+// InclusionProof shows that a block hash is a leaf of a batch's Merkle tree
+type InclusionProof struct {
+	BlockIndex int      `json:"block_index"`
+	BlockHash  string   `json:"block_hash"`
+	Batch      int      `json:"batch"`
+	LeafIndex  int      `json:"leaf_index"`
+	TreeSize   int      `json:"tree_size"`
+	AuditPath  []string `json:"audit_path"`
+	Root       string   `json:"root"`
+}
+
+// MerkleRoot returns the current root of the given batch
+func (bc *Blockchain) MerkleRoot(batch int) (*MerkleRoot, error) {
+	leaves, err := bc.batchLeaves(batch)
+	if err != nil {
+		return nil, err
+	}
+	if len(leaves) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return &MerkleRoot{
+		Batch:      batch,
+		FirstIndex: batch * MerkleBatchSize,
+		TreeSize:   len(leaves),
+		Complete:   len(leaves) == MerkleBatchSize,
+		Root:       hex.EncodeToString(merkleTreeHash(leaves)),
+	}, nil
+}
+
+// InclusionProof builds a proof that the block at blockIndex is committed in
+// its batch's Merkle tree, against the batch root at its current size
+func (bc *Blockchain) InclusionProof(blockIndex int) (*InclusionProof, error) {
+	batch := blockIndex / MerkleBatchSize
+	leaves, err := bc.batchLeaves(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	leafIndex := blockIndex - batch*MerkleBatchSize
+	if leafIndex >= len(leaves) {
+		return nil, sql.ErrNoRows
+	}
+
+	path := merkleAuditPath(leafIndex, leaves)
+	auditPath := make([]string, len(path))
+	for i, node := range path {
+		auditPath[i] = hex.EncodeToString(node)
+	}
+
+	return &InclusionProof{
+		BlockIndex: blockIndex,
+		BlockHash:  string(leaves[leafIndex]),
+		Batch:      batch,
+		LeafIndex:  leafIndex,
+		TreeSize:   len(leaves),
+		AuditPath:  auditPath,
+		Root:       hex.EncodeToString(merkleTreeHash(leaves)),
+	}, nil
+}
+
+// VerifyInclusion checks a proof against a root hash obtained independently,
+// for example one published earlier. It needs no access to the chain.
+func VerifyInclusion(proof *InclusionProof, root string) error {
+	if proof.LeafIndex < 0 || proof.LeafIndex >= proof.TreeSize {
+		return fmt.Errorf("leaf index %d out of range for tree size %d", proof.LeafIndex, proof.TreeSize)
+	}
+
+	hash := merkleLeafHash([]byte(proof.BlockHash))
+	index, last := proof.LeafIndex, proof.TreeSize-1
+	for _, encoded := range proof.AuditPath {
+		node, err := hex.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("invalid audit path node %q: %v", encoded, err)
+		}
+		if last == 0 {
+			return fmt.Errorf("audit path is longer than the tree")
+		}
+		if index%2 == 1 || index == last {
+			hash = merkleNodeHash(node, hash)
+			for index%2 == 0 && index != 0 {
+				index /= 2
+				last /= 2
+			}
+		} else {
+			hash = merkleNodeHash(hash, node)
+		}
+		index /= 2
+		last /= 2
+	}
+
+	if last != 0 {
+		return fmt.Errorf("audit path is shorter than the tree")
+	}
+	if hex.EncodeToString(hash) != root {
+		return fmt.Errorf("computed root %x does not match %s", hash, root)
+	}
+	return nil
+}
+
+// batchLeaves returns the block hashes of a batch in index order
+func (bc *Blockchain) batchLeaves(batch int) ([][]byte, error) {
+	if batch < 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	rows, err := bc.db.Query(`
+		SELECT hash FROM public.blocks
+		WHERE index >= $1 AND index < $2
+		ORDER BY index ASC`, batch*MerkleBatchSize, (batch+1)*MerkleBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var leaves [][]byte
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		leaves = append(leaves, []byte(hash))
+	}
+	return leaves, rows.Err()
+}
+
+func merkleLeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func merkleNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleSplit returns the largest power of two smaller than n
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+func merkleTreeHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return merkleLeafHash(leaves[0])
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNodeHash(merkleTreeHash(leaves[:k]), merkleTreeHash(leaves[k:]))
+}
+
+// merkleAuditPath returns the sibling hashes from the leaf up to the root
+func merkleAuditPath(index int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := merkleSplit(len(leaves))
+	if index < k {
+		return append(merkleAuditPath(index, leaves[:k]), merkleTreeHash(leaves[k:]))
+	}
+	return append(merkleAuditPath(index-k, leaves[k:]), merkleTreeHash(leaves[:k]))
+}
@@ -0,0 +1,135 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// Leaves and roots of the RFC 6962 test vectors used by Certificate
+// Transparency implementations. roots[i] is the root of the first i+1 leaves.
+var (
+	rfc6962Leaves = []string{
+		"",
+		"00",
+		"10",
+		"2021",
+		"3031",
+		"40414243",
+		"5051525354555657",
+		"606162636465666768696a6b6c6d6e6f",
+	}
+	rfc6962Roots = []string{
+		"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+		"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+		"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+		"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+	}
+)
+
+func rfc6962TestLeaves(t *testing.T) [][]byte {
+	t.Helper()
+	leaves := make([][]byte, len(rfc6962Leaves))
+	for i, leaf := range rfc6962Leaves {
+		var err error
+		if leaves[i], err = hex.DecodeString(leaf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return leaves
+}
+
+// testProof builds the inclusion proof of leaf index in leaves
+func testProof(leaves [][]byte, index int) *InclusionProof {
+	path := merkleAuditPath(index, leaves)
+	auditPath := make([]string, len(path))
+	for i, node := range path {
+		auditPath[i] = hex.EncodeToString(node)
+	}
+	return &InclusionProof{
+		BlockHash: string(leaves[index]),
+		LeafIndex: index,
+		TreeSize:  len(leaves),
+		AuditPath: auditPath,
+	}
+}
+
+func TestMerkleTreeHash(t *testing.T) {
+	if got := hex.EncodeToString(merkleTreeHash(nil)); got != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("empty tree hash = %s", got)
+	}
+
+	leaves := rfc6962TestLeaves(t)
+	for i, want := range rfc6962Roots {
+		if got := hex.EncodeToString(merkleTreeHash(leaves[:i+1])); got != want {
+			t.Errorf("root of %d leaves = %s, want %s", i+1, got, want)
+		}
+	}
+}
+
+func TestMerkleAuditPath(t *testing.T) {
+	leaves := rfc6962TestLeaves(t)
+	want := []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}
+	got := testProof(leaves, 0).AuditPath
+	if len(got) != len(want) {
+		t.Fatalf("audit path of leaf 0 in 8 has %d nodes, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("audit path node %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestVerifyInclusion(t *testing.T) {
+	leaves := rfc6962TestLeaves(t)
+	for size := 1; size <= len(leaves); size++ {
+		root := rfc6962Roots[size-1]
+		for index := 0; index < size; index++ {
+			proof := testProof(leaves[:size], index)
+			if err := VerifyInclusion(proof, root); err != nil {
+				t.Errorf("leaf %d of %d: %v", index, size, err)
+			}
+		}
+	}
+}
+
+func TestVerifyInclusionRejects(t *testing.T) {
+	leaves := rfc6962TestLeaves(t)
+	root := rfc6962Roots[len(leaves)-1]
+
+	tests := []struct {
+		name   string
+		tamper func(p *InclusionProof)
+	}{
+		{"other leaf", func(p *InclusionProof) { p.BlockHash = "ff" }},
+		{"wrong index", func(p *InclusionProof) { p.LeafIndex = 4 }},
+		{"index out of range", func(p *InclusionProof) { p.LeafIndex = p.TreeSize }},
+		{"negative index", func(p *InclusionProof) { p.LeafIndex = -1 }},
+		{"wrong tree size", func(p *InclusionProof) { p.TreeSize = 6 }},
+		{"path too short", func(p *InclusionProof) { p.AuditPath = p.AuditPath[:2] }},
+		{"path too long", func(p *InclusionProof) { p.AuditPath = append(p.AuditPath, p.AuditPath[0]) }},
+		{"changed node", func(p *InclusionProof) { p.AuditPath[1] = rfc6962Roots[0] }},
+		{"invalid node", func(p *InclusionProof) { p.AuditPath[0] = "not hex" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proof := testProof(leaves, 5)
+			tt.tamper(proof)
+			if err := VerifyInclusion(proof, root); err == nil {
+				t.Error("VerifyInclusion accepted the proof")
+			}
+		})
+	}
+
+	if err := VerifyInclusion(testProof(leaves, 5), rfc6962Roots[6]); err == nil {
+		t.Error("VerifyInclusion accepted the root of a smaller tree")
+	}
+}
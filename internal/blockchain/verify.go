@@ -0,0 +1,203 @@
+package blockchain
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Kinds of problems reported by Verify and VerifyArchive
+const (
+	IssueUnreadableRow      = "unreadable_row"
+	IssueInvalidTransaction = "invalid_transaction"
+	IssueInvalidGenesis     = "invalid_genesis"
+	IssueHashMismatch       = "hash_mismatch"
+	IssueBrokenLink         = "broken_link"
+	IssueIndexGap           = "index_gap"
+	IssueDuplicateIndex     = "duplicate_index"
+	IssueInvalidSignature   = "invalid_signature"
+	IssueInvalidAnchor      = "invalid_anchor"
+	IssueAnchorMismatch     = "anchor_mismatch"
+	// IssueManifestMismatch means an archive's blocks end at another head, or
+	// number differently, than its manifest says: the archive was truncated or
+	// its manifest does not belong to it, not a break inside the chain
+	IssueManifestMismatch = "manifest_mismatch"
+)
+
+// VerificationIssue describes a single problem found in the stored chain
+type VerificationIssue struct {
+	BlockID int    `json:"block_id"`
+	Index   int    `json:"index"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// VerificationReport is the result of walking the whole chain
+type VerificationReport struct {
+	Valid                 bool                `json:"valid"`
+	BlocksChecked         int                 `json:"blocks_checked"`
+	UnsignedBlocks        int                 `json:"unsigned_blocks"`         // Non-genesis blocks written before transactions were signed
+	LegacyBlocks          int                 `json:"legacy_blocks"`           // Blocks hashed with schema version 1
+	LegacyGenesis         bool                `json:"legacy_genesis"`          // The genesis block is a version 1 one, whose hash cannot be recomputed
+	AnchorsChecked        int                 `json:"anchors_checked"`         // Time-stamp anchors checked against the blocks they name
+	AnchorTokensUnchecked int                 `json:"anchor_tokens_unchecked"` // Anchors whose token was not checked, no time-stamp authority being configured
+	HeadIndex             int                 `json:"head_index"`
+	HeadHash              string              `json:"head_hash"`
+	Issues                []VerificationIssue `json:"issues"`
+	CheckedAt             time.Time           `json:"checked_at"`
+}
+
+// Verify reads every row of public.blocks, recomputes each hash and checks
+// that the blocks form one unbroken chain starting at the genesis block.
+// Signed blocks must carry a valid signature from the doctor named in their
+// transaction. Rows that cannot be scanned or decoded are reported instead of skipped.
+// Time-stamp anchors must still match the blocks they name.
+func (bc *Blockchain) Verify() (*VerificationReport, error) {
+	rows, err := bc.db.Query(`
+		SELECT ` + rowColumns + `
+		FROM public.blocks
+		ORDER BY index ASC, block_id ASC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blocks: %v", err)
+	}
+	defer rows.Close()
+
+	v := NewVerifier(bc.signer, bc.legacyLocation)
+	for rows.Next() {
+		blockID, block, issue := readRow(rows)
+		if issue != nil {
+			v.Issue(issue.BlockID, issue.Index, issue.Kind, issue.Message)
+			continue
+		}
+		v.Check(blockID, block)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read blocks: %v", err)
+	}
+	if err := bc.verifyAnchors(v); err != nil {
+		return nil, err
+	}
+
+	return v.Finish(), nil
+}
+
+// rowColumns are the columns readRow expects, in order. Unlike blockColumns
+// they include the row's block_id and tolerate NULLs, to read damaged rows.
+const rowColumns = `block_id, schema_version, index, timestamp, transaction, previous_hash, hash, signature, key_fingerprint`
+
+// readRow reads a row selected with rowColumns. A row that cannot be scanned
+// or decoded is returned as an issue instead of a block.
+func readRow(rows *sql.Rows) (int, Block, *VerificationIssue) {
+	var blockID, version int
+	var index sql.NullInt64
+	var timestamp sql.NullTime
+	var transactionJSON []byte
+	var previousHash, hash, signature, fingerprint sql.NullString
+	if err := rows.Scan(&blockID, &version, &index, &timestamp, &transactionJSON, &previousHash, &hash, &signature, &fingerprint); err != nil {
+		return blockID, Block{}, &VerificationIssue{BlockID: blockID, Index: -1, Kind: IssueUnreadableRow, Message: err.Error()}
+	}
+	if !index.Valid || !timestamp.Valid || !previousHash.Valid || !hash.Valid {
+		return blockID, Block{}, &VerificationIssue{BlockID: blockID, Index: int(index.Int64), Kind: IssueUnreadableRow, Message: "block has NULL columns"}
+	}
+
+	block := Block{
+		Version:        version,
+		Index:          int(index.Int64),
+		Timestamp:      timestamp.Time,
+		PreviousHash:   previousHash.String,
+		Hash:           hash.String,
+		Signature:      signature.String,
+		KeyFingerprint: fingerprint.String,
+	}
+	if err := json.Unmarshal(transactionJSON, &block.Transaction); err != nil {
+		return blockID, Block{}, &VerificationIssue{BlockID: blockID, Index: block.Index, Kind: IssueInvalidTransaction, Message: err.Error()}
+	}
+	return blockID, block, nil
+}
+
+// Verifier accumulates a VerificationReport one block at a time, in index
+// order. It needs no database, so archives can be verified offline.
+type Verifier struct {
+	keys           KeyResolver
+	legacyLocation *time.Location
+	report         VerificationReport
+	prev           *Block
+}
+
+// NewVerifier creates a Verifier that resolves signing keys with keys.
+// legacyLocation is the zone version 1 blocks were written in.
+func NewVerifier(keys KeyResolver, legacyLocation *time.Location) *Verifier {
+	return &Verifier{keys: keys, legacyLocation: legacyLocation, report: VerificationReport{HeadIndex: -1, Issues: []VerificationIssue{}}}
+}
+
+// Issue records a problem that was found outside of Check, such as an unreadable row
+func (v *Verifier) Issue(blockID, index int, kind, message string) {
+	v.report.Issues = append(v.report.Issues, VerificationIssue{
+		BlockID: blockID,
+		Index:   index,
+		Kind:    kind,
+		Message: message,
+	})
+}
+
+// Check verifies the next block of the chain
+func (v *Verifier) Check(blockID int, block Block) {
+	v.report.BlocksChecked++
+
+	switch block.Version {
+	case SchemaLegacy:
+		v.report.LegacyBlocks++
+		v.report.LegacyGenesis = v.report.LegacyGenesis || isLegacyGenesis(block)
+		if !verifyLegacyHash(block, v.legacyLocation) {
+			v.Issue(blockID, block.Index, IssueHashMismatch,
+				fmt.Sprintf("stored hash %s cannot be reproduced from the block contents", block.Hash))
+		}
+	default:
+		expected, err := blockHash(block)
+		if err != nil {
+			v.Issue(blockID, block.Index, IssueHashMismatch, err.Error())
+		} else if expected != block.Hash {
+			v.Issue(blockID, block.Index, IssueHashMismatch,
+				fmt.Sprintf("stored hash %s, recomputed %s", block.Hash, expected))
+		}
+	}
+
+	switch {
+	case block.Signature != "" || block.KeyFingerprint != "":
+		if err := verifySignature(v.keys, block); err != nil {
+			v.Issue(blockID, block.Index, IssueInvalidSignature, err.Error())
+		}
+	case block.Index != 0:
+		v.report.UnsignedBlocks++
+	}
+
+	switch {
+	case v.prev == nil:
+		if block.Index != 0 || block.PreviousHash != "0" {
+			v.Issue(blockID, block.Index, IssueInvalidGenesis, "chain does not start with a genesis block")
+		}
+	case block.Index == v.prev.Index:
+		v.Issue(blockID, block.Index, IssueDuplicateIndex,
+			fmt.Sprintf("index %d appears more than once", block.Index))
+	case block.Index != v.prev.Index+1:
+		v.Issue(blockID, block.Index, IssueIndexGap,
+			fmt.Sprintf("expected index %d, found %d", v.prev.Index+1, block.Index))
+	}
+
+	if v.prev != nil && block.PreviousHash != v.prev.Hash {
+		v.Issue(blockID, block.Index, IssueBrokenLink,
+			fmt.Sprintf("previous_hash %s does not match hash %s of block %d", block.PreviousHash, v.prev.Hash, v.prev.Index))
+	}
+
+	v.prev = &block
+	v.report.HeadIndex = block.Index
+	v.report.HeadHash = block.Hash
+}
+
+// Finish completes and returns the report
+func (v *Verifier) Finish() *VerificationReport {
+	v.report.Valid = len(v.report.Issues) == 0
+	v.report.CheckedAt = time.Now()
+	return &v.report
+}
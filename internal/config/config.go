@@ -1,6 +1,11 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Config struct {
 	ServerPort string
@@ -9,6 +14,128 @@ type Config struct {
 	DBUser     string
 	DBPassword string
 	DBName     string
+
+	// MasterKey is the base64-encoded 32-byte key that encrypts secrets stored
+	// in the database, such as doctors' signing keys. It has no default.
+	MasterKey string
+
+	// JWTKeysFile is a JSON file of JWT keys for rotation, see auth.ParseKeySet.
+	// It takes precedence over JWTSecret.
+	JWTKeysFile string
+	// JWTSecret is a base64 HS256 secret of at least 32 bytes, used as the only
+	// JWT key when no keys file is given. One of the two is required.
+	JWTSecret string
+	// AccessTokenTTL is how long an access token is valid
+	AccessTokenTTL time.Duration
+	// RefreshTokenTTL is how long a session lasts without being refreshed
+	RefreshTokenTTL time.Duration
+	// SessionRetention is how long ended sessions are kept before they are deleted
+	SessionRetention time.Duration
+	// LoginHistoryRetention is how long login attempts are kept for administrators to review
+	LoginHistoryRetention time.Duration
+
+	// MFARequiredRoles lists the roles that must log in with a second factor
+	MFARequiredRoles []string
+	// MFAChallengeTTL is how long a login waits for its second factor
+	MFAChallengeTTL time.Duration
+	// TOTPIssuer names the service in authenticator apps
+	TOTPIssuer string
+	// TOTPMaxAttempts is how many invalid codes in a row lock a user's second factor
+	TOTPMaxAttempts int
+	// TOTPLockout is how long a locked second factor stays locked
+	TOTPLockout time.Duration
+
+	// LoginMaxFailures is how many failed logins, reset codes or password
+	// changes in a row lock an IIN
+	LoginMaxFailures int
+	// LoginIPMaxFailures is how many failures, across IINs, lock a client IP
+	LoginIPMaxFailures int
+	// LoginFailureWindow is how long failures are remembered without a new one
+	LoginFailureWindow time.Duration
+	// LoginLockout is how long a locked IIN or IP stays locked
+	LoginLockout time.Duration
+	// LoginDelayBase is the wait after a failure, doubling with each further
+	// one up to LoginDelayMax
+	LoginDelayBase time.Duration
+	LoginDelayMax  time.Duration
+
+	// PasswordMinLength is the fewest characters a new password may have
+	PasswordMinLength int
+	// PasswordMinClasses is how many of lowercase letters, uppercase letters,
+	// digits and symbols a new password must mix
+	PasswordMinClasses int
+	// PasswordHistory is how many of a user's latest passwords a new one must differ from
+	PasswordHistory int
+	// PasswordMaxAge is how long a password may be used before it must be
+	// changed, by role, as role=duration pairs such as doctor=2160h
+	PasswordMaxAge map[string]time.Duration
+	// BreachedPasswordsDir holds breached password hashes split by SHA-1
+	// prefix, one file per prefix like 5BAA6.txt. Empty skips the check.
+	BreachedPasswordsDir string
+
+	// ChainVerifyOnStartup runs a full blockchain verification at startup
+	ChainVerifyOnStartup bool
+	// ChainVerifyFailFast refuses to start when the startup verification
+	// fails. Without it the verification runs in the background while serving.
+	ChainVerifyFailFast bool
+	// ChainCacheSize is the maximum number of blocks kept in memory
+	ChainCacheSize int
+	// ChainExportKey is the base64 Ed25519 seed that signs chain archives
+	ChainExportKey string
+	// ChainLegacyTimezone is the IANA zone the server ran in while it wrote
+	// version 1 blocks, "Local" for the current zone
+	ChainLegacyTimezone string
+
+	// TSAURL is the RFC 3161 time-stamp authority the chain head is anchored
+	// to, empty disables anchoring
+	TSAURL string
+	// TSACAFile is a PEM file of certificates trusted to sign time-stamps.
+	// If empty, the certificate embedded in each token is trusted.
+	TSACAFile string
+	// ChainAnchorInterval is how often the chain head is anchored
+	ChainAnchorInterval time.Duration
+
+	// AccessGrantDuration is how long a doctor keeps access after a patient grants a request
+	AccessGrantDuration time.Duration
+	// AccessViaAppointment gives a doctor access to the records of patients
+	// they have an appointment with, without an access request
+	AccessViaAppointment bool
+	// AccessAppointmentWindow is how far before or after now that appointment may be
+	AccessAppointmentWindow time.Duration
+	// AccessExpiryInterval is how often lapsed access requests are marked expired
+	// and grants about to expire are warned of
+	AccessExpiryInterval time.Duration
+	// AccessExpiryWarning is how long before granted access expires the parties are warned
+	AccessExpiryWarning time.Duration
+	// AccessRequestRetention is how long closed access requests are kept before
+	// they are deleted. They record who was given access to whose records, so
+	// the default of 0 keeps them forever and deletion must be opted into.
+	AccessRequestRetention time.Duration
+	// PasswordResetTTL is how long an emailed password reset code is valid
+	PasswordResetTTL time.Duration
+	// PasswordResetMaxAttempts is how many wrong guesses give up a reset code
+	PasswordResetMaxAttempts int
+	// PasswordResetRetention is how long used or expired reset codes are kept before they are deleted
+	PasswordResetRetention time.Duration
+	// GuardianAgeOfMajority is the age at which guardianships of minors end
+	GuardianAgeOfMajority int
+	// EmergencyAccessDuration is how long break-glass access to a patient's records lasts
+	EmergencyAccessDuration time.Duration
+	// EmergencyRequiresStepUp makes doctors verify their face shortly before breaking the glass
+	EmergencyRequiresStepUp bool
+
+	// FaceServiceURL is the base URL of the face detection and comparison service
+	FaceServiceURL string
+	// FaceMatchThreshold is the largest face distance accepted as the same person
+	FaceMatchThreshold float64
+	// FaceMaxAttempts is how many failed face verifications a user may make within FaceAttemptWindow
+	FaceMaxAttempts int
+	// FaceAttemptWindow is the period failed face verifications are counted over
+	FaceAttemptWindow time.Duration
+	// FaceStepUpMaxAge is how long a face verification satisfies routes that require one
+	FaceStepUpMaxAge time.Duration
+	// FaceEnrollmentTTL is how long the face enrollment token returned on registration is valid
+	FaceEnrollmentTTL time.Duration
 }
 
 func LoadConfig() *Config {
@@ -19,6 +146,65 @@ func LoadConfig() *Config {
 		DBUser:     getEnv("DB_USER", "postgres"),
 		DBPassword: getEnv("DB_PASSWORD", "Doudmur2003!"),
 		DBName:     getEnv("DB_NAME", "postgres"),
+
+		MasterKey: os.Getenv("MASTER_KEY"),
+
+		JWTKeysFile: os.Getenv("JWT_KEYS_FILE"),
+		JWTSecret:   os.Getenv("JWT_SECRET"),
+
+		AccessTokenTTL:        getEnvDuration("ACCESS_TOKEN_TTL", 30*time.Minute),
+		RefreshTokenTTL:       getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		SessionRetention:      getEnvDuration("SESSION_RETENTION", 7*24*time.Hour),
+		LoginHistoryRetention: getEnvDuration("LOGIN_HISTORY_RETENTION", 180*24*time.Hour),
+
+		MFARequiredRoles: getEnvList("MFA_REQUIRED_ROLES", []string{"doctor", "admin"}),
+		MFAChallengeTTL:  getEnvDuration("MFA_CHALLENGE_TTL", 5*time.Minute),
+		TOTPIssuer:       getEnv("TOTP_ISSUER", "MedicineApp"),
+		TOTPMaxAttempts:  getEnvInt("TOTP_MAX_ATTEMPTS", 5),
+		TOTPLockout:      getEnvDuration("TOTP_LOCKOUT", 15*time.Minute),
+
+		LoginMaxFailures:   getEnvInt("LOGIN_MAX_FAILURES", 10),
+		LoginIPMaxFailures: getEnvInt("LOGIN_IP_MAX_FAILURES", 100),
+		LoginFailureWindow: getEnvDuration("LOGIN_FAILURE_WINDOW", time.Hour),
+		LoginLockout:       getEnvDuration("LOGIN_LOCKOUT", 15*time.Minute),
+		LoginDelayBase:     getEnvDuration("LOGIN_DELAY_BASE", time.Second),
+		LoginDelayMax:      getEnvDuration("LOGIN_DELAY_MAX", 30*time.Second),
+
+		PasswordMinLength:    getEnvInt("PASSWORD_MIN_LENGTH", 10),
+		PasswordMinClasses:   getEnvInt("PASSWORD_MIN_CLASSES", 3),
+		PasswordHistory:      getEnvInt("PASSWORD_HISTORY", 5),
+		PasswordMaxAge:       getEnvDurations("PASSWORD_MAX_AGE", map[string]time.Duration{"doctor": 90 * 24 * time.Hour, "admin": 90 * 24 * time.Hour}),
+		BreachedPasswordsDir: os.Getenv("BREACHED_PASSWORDS_DIR"),
+
+		ChainVerifyOnStartup: getEnvBool("CHAIN_VERIFY_ON_STARTUP", true),
+		ChainVerifyFailFast:  getEnvBool("CHAIN_VERIFY_FAIL_FAST", false),
+		ChainCacheSize:       getEnvInt("CHAIN_CACHE_SIZE", 256),
+		ChainExportKey:       os.Getenv("CHAIN_EXPORT_KEY"),
+		ChainLegacyTimezone:  getEnv("CHAIN_LEGACY_TIMEZONE", "Local"),
+
+		TSAURL:              os.Getenv("TSA_URL"),
+		TSACAFile:           os.Getenv("TSA_CA_FILE"),
+		ChainAnchorInterval: getEnvDuration("CHAIN_ANCHOR_INTERVAL", time.Hour),
+
+		AccessGrantDuration:      getEnvDuration("ACCESS_GRANT_DURATION", 24*time.Hour),
+		AccessViaAppointment:     getEnvBool("ACCESS_VIA_APPOINTMENT", false),
+		AccessAppointmentWindow:  getEnvDuration("ACCESS_APPOINTMENT_WINDOW", 30*24*time.Hour),
+		AccessExpiryInterval:     getEnvDuration("ACCESS_EXPIRY_INTERVAL", 10*time.Second),
+		AccessExpiryWarning:      getEnvDuration("ACCESS_EXPIRY_WARNING", 10*time.Minute),
+		AccessRequestRetention:   getEnvDuration("ACCESS_REQUEST_RETENTION", 0),
+		PasswordResetTTL:         getEnvDuration("PASSWORD_RESET_TTL", 15*time.Minute),
+		PasswordResetMaxAttempts: getEnvInt("PASSWORD_RESET_MAX_ATTEMPTS", 5),
+		PasswordResetRetention:   getEnvDuration("PASSWORD_RESET_RETENTION", 24*time.Hour),
+		GuardianAgeOfMajority:    getEnvInt("GUARDIAN_AGE_OF_MAJORITY", 18),
+		EmergencyAccessDuration:  getEnvDuration("EMERGENCY_ACCESS_DURATION", time.Hour),
+		EmergencyRequiresStepUp:  getEnvBool("EMERGENCY_REQUIRES_STEP_UP", false),
+
+		FaceServiceURL:     getEnv("FACE_SERVICE_URL", "http://134.122.84.85:8000"),
+		FaceMatchThreshold: getEnvFloat("FACE_MATCH_THRESHOLD", 0.6),
+		FaceMaxAttempts:    getEnvInt("FACE_MAX_ATTEMPTS", 5),
+		FaceAttemptWindow:  getEnvDuration("FACE_ATTEMPT_WINDOW", 15*time.Minute),
+		FaceStepUpMaxAge:   getEnvDuration("FACE_STEP_UP_MAX_AGE", 5*time.Minute),
+		FaceEnrollmentTTL:  getEnvDuration("FACE_ENROLLMENT_TTL", 15*time.Minute),
 	}
 }
 
@@ -29,3 +215,70 @@ func getEnv(key, defaultValue string) string {
 	}
 	return value
 }
+
+func getEnvBool(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvList reads a comma-separated list. Set the variable to "none" for an empty list.
+func getEnvList(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" && item != "none" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvDurations reads comma-separated key=duration pairs. Set the variable
+// to "none" for an empty map. Pairs that do not parse are skipped.
+func getEnvDurations(key string, defaultValue map[string]time.Duration) map[string]time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	durations := make(map[string]time.Duration)
+	for _, item := range strings.Split(value, ",") {
+		name, raw, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			continue
+		}
+		if duration, err := time.ParseDuration(strings.TrimSpace(raw)); err == nil {
+			durations[strings.TrimSpace(name)] = duration
+		}
+	}
+	return durations
+}
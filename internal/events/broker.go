@@ -0,0 +1,173 @@
+// Package events pushes access request changes to the users involved. Changes
+// are published by a database trigger with NOTIFY, so a change made through
+// any instance reaches subscribers connected to every instance.
+package events
+
+import (
+	"diploma/internal/models"
+	"encoding/json"
+	"github.com/lib/pq"
+	"log"
+	"sync"
+	"time"
+)
+
+// Channel is the notification channel the access_requests trigger publishes on
+const Channel = "access_requests"
+
+// Event types
+const (
+	TypeCreated       = "created"
+	TypeStatusChanged = "status_changed"
+	TypeExpired       = "expired"
+	// TypeExpiring warns that granted access is about to expire
+	TypeExpiring = "expiring"
+	// TypeResync tells subscribers that events may have been missed while the
+	// connection to the database was lost and they should reload their requests
+	TypeResync = "resync"
+)
+
+// subscriberBuffer is how many events a subscriber may fall behind before it is dropped
+const subscriberBuffer = 16
+
+// Event is a change to an access request, as published by the database trigger
+type Event struct {
+	Type          string                `json:"type"`
+	AccessRequest *models.AccessRequest `json:"access_request,omitempty"`
+	DoctorUserID  uint                  `json:"doctor_user_id,omitempty"`
+	PatientUserID uint                  `json:"patient_user_id,omitempty"`
+}
+
+// Broker listens for access request notifications and fans them out to the
+// subscribed doctor and patient
+type Broker struct {
+	listener *pq.Listener
+
+	mu          sync.Mutex
+	subscribers map[uint]map[chan Event]struct{}
+}
+
+// NewBroker opens a dedicated listening connection with the given connection
+// string. Call Run to start delivering events.
+func NewBroker(connStr string) (*Broker, error) {
+	listener := pq.NewListener(connStr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Access request listener: %v", err)
+		}
+	})
+	if err := listener.Listen(Channel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &Broker{listener: listener, subscribers: make(map[uint]map[chan Event]struct{})}, nil
+}
+
+// Run delivers notifications until the listener is closed
+func (b *Broker) Run() {
+	keepalive := time.NewTicker(90 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case n, ok := <-b.listener.Notify:
+			if !ok {
+				return
+			}
+			if n == nil {
+				// The connection was re-established, notifications sent meanwhile are lost
+				b.broadcast(Event{Type: TypeResync})
+				continue
+			}
+
+			var event Event
+			if err := json.Unmarshal([]byte(n.Extra), &event); err != nil {
+				log.Printf("Ignoring malformed access request notification: %v", err)
+				continue
+			}
+			b.publish(event)
+
+		case <-keepalive.C:
+			// Notice a silently dropped connection
+			go b.listener.Ping()
+		}
+	}
+}
+
+// Close stops listening and ends every subscription
+func (b *Broker) Close() error {
+	err := b.listener.Close()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for userID, channels := range b.subscribers {
+		for ch := range channels {
+			close(ch)
+		}
+		delete(b.subscribers, userID)
+	}
+	return err
+}
+
+// Subscribe returns the events of the access requests a user is a party to.
+// The channel is closed if the subscriber falls too far behind, after which
+// it should reload its requests and subscribe again. The returned function
+// ends the subscription.
+func (b *Broker) Subscribe(userID uint) (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = make(map[chan Event]struct{})
+	}
+	b.subscribers[userID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.remove(userID, ch)
+	}
+}
+
+func (b *Broker) publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.deliver(event.DoctorUserID, event)
+	if event.PatientUserID != event.DoctorUserID {
+		b.deliver(event.PatientUserID, event)
+	}
+}
+
+func (b *Broker) broadcast(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for userID := range b.subscribers {
+		b.deliver(userID, event)
+	}
+}
+
+// deliver must be called with b.mu held
+func (b *Broker) deliver(userID uint, event Event) {
+	for ch := range b.subscribers[userID] {
+		select {
+		case ch <- event:
+		default:
+			b.remove(userID, ch)
+		}
+	}
+}
+
+// remove must be called with b.mu held. Removing a channel twice is harmless.
+func (b *Broker) remove(userID uint, ch chan Event) {
+	channels := b.subscribers[userID]
+	if _, ok := channels[ch]; !ok {
+		return
+	}
+	delete(channels, ch)
+	close(ch)
+	if len(channels) == 0 {
+		delete(b.subscribers, userID)
+	}
+}
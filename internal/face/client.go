@@ -0,0 +1,92 @@
+// Package face talks to the face recognition service, which detects faces in
+// photos and measures how similar the faces in two photos are.
+package face
+
+import (
+	"bytes"
+	"diploma/internal/models"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxResponseSize bounds the JSON read from the service
+const maxResponseSize = 1 << 16
+
+// Client calls the face service over HTTP
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewClient creates a client for the service at baseURL, such as
+// http://localhost:8000
+func NewClient(baseURL string, timeout time.Duration) *Client {
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// Detect reports the faces found in a photo
+func (c *Client) Detect(photo []byte) (*models.DetectResponse, error) {
+	var result models.DetectResponse
+	if err := c.post("/detect_face/", map[string][]byte{"file": photo}, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Compare measures the distance between the faces in a reference photo and a
+// probe photo. The service reports a match when the distance is at most
+// threshold.
+func (c *Client) Compare(reference, probe []byte, threshold float64) (*models.SimilarityResponse, error) {
+	var result models.SimilarityResponse
+	files := map[string][]byte{"file1": reference, "file2": probe}
+	fields := map[string]string{"threshold": strconv.FormatFloat(threshold, 'f', -1, 64)}
+	if err := c.post("/compare_faces/", files, fields, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// post sends files and fields as a multipart form and decodes the JSON reply
+func (c *Client) post(path string, files map[string][]byte, fields map[string]string, result interface{}) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for name, content := range files {
+		fw, err := w.CreateFormFile(name, name+".jpg")
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(content); err != nil {
+			return err
+		}
+	}
+	for name, value := range fields {
+		if err := w.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Post(c.baseURL+path, w.FormDataContentType(), &body)
+	if err != nil {
+		return fmt.Errorf("face service request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("face service returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(result); err != nil {
+		return fmt.Errorf("invalid face service response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Package jobs runs periodic maintenance inside the API server. Every
+// instance runs a Runner, but only the one holding a Postgres advisory lock,
+// the leader, runs jobs. If the leader goes away its session ends, the lock
+// is released and another instance takes over.
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log"
+	"time"
+)
+
+// LeaderLockKey is the Postgres advisory lock held by the instance that runs jobs
+const LeaderLockKey = 727274002
+
+// electionInterval is how often followers try to become leader and the
+// leader checks that it still is
+const electionInterval = 15 * time.Second
+
+// Job is a task run every Interval by the leader
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func() error
+}
+
+type Runner struct {
+	db   *sql.DB
+	jobs []Job
+
+	// conn holds the session that owns the leader lock, nil while following
+	conn    *sql.Conn
+	nextRun map[string]time.Time
+}
+
+func NewRunner(db *sql.DB, jobs ...Job) *Runner {
+	return &Runner{db: db, jobs: jobs, nextRun: make(map[string]time.Time)}
+}
+
+// Run elects a leader and runs due jobs until ctx is done
+func (r *Runner) Run(ctx context.Context) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	defer r.resign()
+
+	var lastElection time.Time
+	for {
+		if time.Since(lastElection) >= electionInterval {
+			r.elect(ctx)
+			lastElection = time.Now()
+		}
+		if r.conn != nil {
+			r.runDue(time.Now())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// elect takes the leader lock if it is free, or checks that the leader
+// session is still alive
+func (r *Runner) elect(ctx context.Context) {
+	if r.conn != nil {
+		if err := r.conn.PingContext(ctx); err != nil {
+			log.Printf("Lost job leadership: %v", err)
+			r.resign()
+		}
+		return
+	}
+
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		log.Printf("Job leader election failed: %v", err)
+		return
+	}
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", LeaderLockKey).Scan(&acquired); err != nil || !acquired {
+		if err != nil {
+			log.Printf("Job leader election failed: %v", err)
+		}
+		conn.Close()
+		return
+	}
+
+	log.Printf("Became job leader, running %d jobs", len(r.jobs))
+	r.conn = conn
+	// Run every job right away, the previous leader's schedule is unknown
+	r.nextRun = make(map[string]time.Time)
+}
+
+// resign releases the leader lock by ending its session. The connection is
+// discarded rather than returned to the pool, where it would keep the lock.
+func (r *Runner) resign() {
+	if r.conn == nil {
+		return
+	}
+	r.conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	r.conn.Close()
+	r.conn = nil
+}
+
+func (r *Runner) runDue(now time.Time) {
+	for _, job := range r.jobs {
+		if now.Before(r.nextRun[job.Name]) {
+			continue
+		}
+		r.nextRun[job.Name] = now.Add(job.Interval)
+
+		started := time.Now()
+		if err := job.Run(); err != nil {
+			log.Printf("Job %s failed after %s: %v", job.Name, time.Since(started), err)
+		}
+	}
+}
@@ -4,15 +4,51 @@ import (
 	"time"
 )
 
+// Statuses of an access request. A patient moves a pending request to granted
+// or rejected and may later revoke a grant; requests that run out of time
+// become expired.
+const (
+	AccessStatusPending  = "pending"
+	AccessStatusGranted  = "granted"
+	AccessStatusRejected = "rejected"
+	AccessStatusRevoked  = "revoked"
+	AccessStatusExpired  = "expired"
+)
+
+// Record categories an access grant can be limited to
+const (
+	ScopeDiagnosis     = "diagnosis"
+	ScopeTreatmentPlan = "treatment_plan"
+	ScopeTestResult    = "test_result"
+)
+
+// RecordScopes lists every record category. A grant without scopes covers all of them.
+var RecordScopes = []string{ScopeDiagnosis, ScopeTreatmentPlan, ScopeTestResult}
+
+// StandingConsent is a patient's lasting consent for one doctor, or for every
+// doctor of a specialization, to access the given record categories
+type StandingConsent struct {
+	ID             int       `json:"id"`
+	PatientID      int       `json:"patient_id"`
+	DoctorID       int       `json:"doctor_id,omitempty"`
+	DoctorFullName string    `json:"doctor_full_name,omitempty"`
+	Specialization string    `json:"specialization,omitempty"`
+	Scopes         []string  `json:"scopes" enums:"diagnosis,treatment_plan,test_result"`
+	CreatedAt      time.Time `json:"created_at"`
+	ExpiresAt      time.Time `json:"expires_at,omitempty"`
+	RevokedAt      time.Time `json:"revoked_at,omitempty"`
+}
+
 // AccessRequestResponseSwagger represents the Swagger documentation for access request responses
 type AccessRequestResponseSwagger struct {
 	ID              int       `json:"id" example:"1"`
 	DoctorID        int       `json:"doctor_id" example:"1"`
 	DoctorName      string    `json:"doctor_name" example:"John Doe"`
 	PatientID       int       `json:"patient_id" example:"1"`
-	Status          string    `json:"status" example:"pending" enums:"pending,granted,rejected"`
+	Status          string    `json:"status" example:"pending" enums:"pending,granted,rejected,revoked,expired"`
 	CreatedAt       time.Time `json:"created_at" example:"2024-03-14T12:00:00Z"`
 	ExpiresAt       time.Time `json:"expires_at" example:"2024-03-14T13:00:00Z"`
 	AccessGrantedAt time.Time `json:"access_granted_at,omitempty" example:"2024-03-14T12:30:00Z"`
 	AccessExpiresAt time.Time `json:"access_expires_at,omitempty" example:"2024-03-14T13:30:00Z"`
+	Scopes          []string  `json:"scopes,omitempty" example:"diagnosis,test_result"`
 }
@@ -12,7 +12,7 @@ type User struct {
 	Role              string `json:"role"`
 	BiometricDataHash string `json:"biometric_data_hash"`
 	CreatedAt         string `json:"created_at"`
-	Password          string `json:"password"`
+	Password          string `json:"-"`
 	PasswordChanged   bool   `json:"password_changed"`
 	Gender            string `json:"gender"`
 	Photo             []byte `json:"photo"`
@@ -145,19 +145,13 @@ type Appointment struct {
 }
 
 type ForgotPasswordRequest struct {
-	Iin string `json:"iin"`
+	Iin string `json:"iin" binding:"required"`
 }
 
 type ResetPasswordRequest struct {
-	Iin         string `json:"iin"`
-	OTP         string `json:"otp"`
-	NewPassword string `json:"new_password"`
-}
-
-type OTPVerification struct {
-	Iin       string    `json:"iin"`
-	OTP       string    `json:"otp"`
-	ExpiresAt time.Time `json:"expires_at"`
+	Iin         string `json:"iin" binding:"required"`
+	OTP         string `json:"otp" binding:"required" example:"k3m9q-x2v7d"`
+	NewPassword string `json:"new_password" binding:"required"`
 }
 
 // UserInfoResponse represents detailed user information including role-specific details
@@ -175,6 +169,30 @@ type RecordWithDetails struct {
 	PatientIIN       string `json:"patient_iin"`
 }
 
+// RecordVersion is one committed version of a medical record, read back from the blockchain
+type RecordVersion struct {
+	BlockIndex     int           `json:"block_index"`
+	BlockHash      string        `json:"block_hash"`
+	Action         string        `json:"action"`
+	RecordId       int           `json:"record_id"`
+	PatientId      int           `json:"patient_id"`
+	DoctorId       int           `json:"doctor_id"`
+	DoctorFullName string        `json:"doctor_full_name"`
+	ChangedAt      time.Time     `json:"changed_at"`
+	Diagnosis      string        `json:"diagnosis"`
+	TreatmentPlan  string        `json:"treatment_plan"`
+	TestResult     string        `json:"test_result"`
+	Changes        []FieldChange `json:"changes"`
+	Redacted       bool          `json:"redacted,omitempty"` // Details were destroyed by shredding the patient's data key
+}
+
+// FieldChange describes how one field differs from the previous version of the record
+type FieldChange struct {
+	Field string `json:"field" example:"diagnosis"`
+	From  string `json:"from" example:"Common cold"`
+	To    string `json:"to" example:"Influenza"`
+}
+
 type AccessRequest struct {
 	ID              int       `json:"id"`
 	DoctorID        int       `json:"doctor_id"`
@@ -184,6 +202,64 @@ type AccessRequest struct {
 	ExpiresAt       time.Time `json:"expires_at"`
 	AccessGrantedAt time.Time `json:"access_granted_at,omitempty"`
 	AccessExpiresAt time.Time `json:"access_expires_at,omitempty"`
+	Scopes          []string  `json:"scopes,omitempty"` // Record categories granted, empty for all
+}
+
+// EmergencyAccess is a break-glass grant a doctor took to a patient's records
+// without consent, kept for review by an administrator
+type EmergencyAccess struct {
+	ID             int       `json:"id"`
+	DoctorID       int       `json:"doctor_id"`
+	DoctorFullName string    `json:"doctor_full_name"`
+	PatientID      int       `json:"patient_id"`
+	Justification  string    `json:"justification"`
+	GrantedAt      time.Time `json:"granted_at"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	BlockIndex     int       `json:"block_index"`
+	ReviewStatus   string    `json:"review_status" enums:"pending,approved,flagged"`
+	ReviewedBy     int       `json:"reviewed_by,omitempty"`
+	ReviewedAt     time.Time `json:"reviewed_at,omitempty"`
+	ReviewNotes    string    `json:"review_notes,omitempty"`
+}
+
+// Guardianship lets a guardian user act for a dependent patient once an
+// administrator has verified it
+type Guardianship struct {
+	ID                int       `json:"id"`
+	GuardianUserID    int       `json:"guardian_user_id"`
+	GuardianFullName  string    `json:"guardian_full_name"`
+	PatientID         int       `json:"patient_id"`
+	DependentFullName string    `json:"dependent_full_name"`
+	DependentIIN      string    `json:"dependent_iin"`
+	DependentType     string    `json:"dependent_type" enums:"minor,adult"`
+	Relationship      string    `json:"relationship" enums:"parent,legal_guardian,proxy"`
+	DocumentReference string    `json:"document_reference"`
+	Status            string    `json:"status" enums:"pending,verified,rejected,revoked,ended"`
+	RequestedAt       time.Time `json:"requested_at"`
+	VerifiedBy        int       `json:"verified_by,omitempty"`
+	VerifiedAt        time.Time `json:"verified_at,omitempty"`
+	ReviewNotes       string    `json:"review_notes,omitempty"`
+	EndedAt           time.Time `json:"ended_at,omitempty"`
+}
+
+// Lockout is an IIN or client IP locked out after repeated failed authentication attempts
+type Lockout struct {
+	Kind          string    `json:"kind" enums:"iin,ip"`
+	Subject       string    `json:"subject"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"`
+}
+
+// Session is a login on one device, kept alive by refreshing its tokens
+type Session struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
 }
 
 type CreateAccessRequestRequest struct {
@@ -195,3 +271,20 @@ type AccessRequestResponse struct {
 	Status    string    `json:"status"`
 	ExpiresAt time.Time `json:"expires_at"`
 }
+
+// Suspension is an account an administrator has barred from logging in
+type Suspension struct {
+	UserID      int       `json:"user_id"`
+	Reason      string    `json:"reason"`
+	SuspendedBy *int      `json:"suspended_by"`
+	SuspendedAt time.Time `json:"suspended_at"`
+}
+
+// LoginEvent is a login attempt on a user's account
+type LoginEvent struct {
+	Method    string    `json:"method" enums:"password,face"`
+	Outcome   string    `json:"outcome" enums:"succeeded,failed,mfa_failed,suspended"`
+	IPAddress string    `json:"ip_address"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
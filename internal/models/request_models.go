@@ -23,11 +23,72 @@ type AccessRequestCreate struct {
 
 // AccessRequestStatusUpdate represents the request for updating access request status
 type AccessRequestStatusUpdate struct {
-	Status string `json:"status" example:"granted" enums:"granted,rejected"`
+	Status string   `json:"status" binding:"required" example:"granted" enums:"granted,rejected,revoked"`
+	Scopes []string `json:"scopes" binding:"omitempty,dive,oneof=diagnosis treatment_plan test_result" example:"diagnosis,test_result"` // Record categories to grant, all when empty
 }
 
-// VerifyOTPRequest represents the request for verifying OTP
-type VerifyOTPRequest struct {
-	Iin string `json:"iin" example:"123456789012"`
-	OTP string `json:"otp" example:"123456"`
+// StandingConsentRequest represents a patient's request to create a standing consent.
+// Exactly one of doctor_iin and specialization must be set.
+type StandingConsentRequest struct {
+	DoctorIIN      string     `json:"doctor_iin" example:"987654321098"`
+	Specialization string     `json:"specialization" example:"Cardiology"`
+	Scopes         []string   `json:"scopes" binding:"required,min=1,dive,oneof=diagnosis treatment_plan test_result" example:"diagnosis,test_result"`
+	ExpiresAt      *time.Time `json:"expires_at" example:"2026-01-01T00:00:00Z"`
+}
+
+// EmergencyAccessRequest represents a doctor's break-glass request for a patient's records
+type EmergencyAccessRequest struct {
+	Iin           string `json:"iin" binding:"required" example:"123456789012"`
+	Justification string `json:"justification" binding:"required,min=20" example:"Patient brought in unconscious, allergy history needed before surgery"`
+}
+
+// EmergencyReviewRequest represents an administrator's review of a break-glass access
+type EmergencyReviewRequest struct {
+	Outcome string `json:"outcome" binding:"required,oneof=approved flagged" example:"approved" enums:"approved,flagged"`
+	Notes   string `json:"notes" example:"Confirmed with the emergency department on duty"`
+}
+
+// GuardianshipRequest represents a user's request to become a patient's guardian
+type GuardianshipRequest struct {
+	DependentIIN      string `json:"dependent_iin" binding:"required" example:"201234567890"`
+	DependentType     string `json:"dependent_type" binding:"required,oneof=minor adult" example:"minor" enums:"minor,adult"`
+	Relationship      string `json:"relationship" binding:"required,oneof=parent legal_guardian proxy" example:"parent" enums:"parent,legal_guardian,proxy"`
+	DocumentReference string `json:"document_reference" binding:"required" example:"Birth certificate No. 123456"`
+}
+
+// GuardianshipReviewRequest represents an administrator's verification of a guardianship
+type GuardianshipReviewRequest struct {
+	Outcome string `json:"outcome" binding:"required,oneof=verified rejected" example:"verified" enums:"verified,rejected"`
+	Notes   string `json:"notes" example:"Birth certificate checked in person"`
+}
+
+// RefreshTokenRequest represents a request for new tokens
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// LogoutRequest represents a logout, of the current session or of every session
+type LogoutRequest struct {
+	All bool `json:"all" example:"false"`
+}
+
+// MFAVerifyRequest completes a login with a second factor
+type MFAVerifyRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required" example:"123456"`
+}
+
+// TOTPCodeRequest carries a code from the user's authenticator app, or a recovery code
+type TOTPCodeRequest struct {
+	Code string `json:"code" binding:"required" example:"123456"`
+}
+
+// SpecializationRequest changes a doctor's specialization
+type SpecializationRequest struct {
+	Specialization string `json:"specialization" binding:"required" example:"Cardiology"`
+}
+
+// SuspendUserRequest represents an administrator's suspension of an account
+type SuspendUserRequest struct {
+	Reason string `json:"reason" binding:"required" example:"Left the clinic"`
 }
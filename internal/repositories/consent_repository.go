@@ -0,0 +1,159 @@
+package repositories
+
+import (
+	"database/sql"
+	"diploma/internal/models"
+	"errors"
+	"github.com/lib/pq"
+	"time"
+)
+
+var (
+	ErrConsentNotFound = errors.New("standing consent not found")
+	ErrConsentNotOwned = errors.New("standing consent belongs to another patient")
+)
+
+// AccessScope is the set of record categories a doctor may see of a
+// patient's records. An empty scope means no access at all.
+type AccessScope map[string]bool
+
+// FullAccessScope covers every record category
+func FullAccessScope() AccessScope {
+	scope := AccessScope{}
+	scope.Add(models.RecordScopes)
+	return scope
+}
+
+func (s AccessScope) Add(categories []string) {
+	for _, category := range categories {
+		s[category] = true
+	}
+}
+
+// FilterRecord blanks the fields of a record outside the scope
+func (s AccessScope) FilterRecord(record *models.Record) {
+	if !s[models.ScopeDiagnosis] {
+		record.Diagnosis = ""
+	}
+	if !s[models.ScopeTreatmentPlan] {
+		record.TreatmentPlan = ""
+	}
+	if !s[models.ScopeTestResult] {
+		record.TestResult = ""
+	}
+}
+
+// FilterVersion blanks the fields of a record version outside the scope and
+// drops their changes
+func (s AccessScope) FilterVersion(version *models.RecordVersion) {
+	if !s[models.ScopeDiagnosis] {
+		version.Diagnosis = ""
+	}
+	if !s[models.ScopeTreatmentPlan] {
+		version.TreatmentPlan = ""
+	}
+	if !s[models.ScopeTestResult] {
+		version.TestResult = ""
+	}
+
+	changes := version.Changes[:0]
+	for _, change := range version.Changes {
+		if s[change.Field] {
+			changes = append(changes, change)
+		}
+	}
+	version.Changes = changes
+}
+
+// StandingConsentRepository stores consents a patient gives once, to a doctor
+// or to every doctor of a specialization, instead of granting a request per visit
+type StandingConsentRepository struct {
+	db *sql.DB
+}
+
+func NewStandingConsentRepository(db *sql.DB) *StandingConsentRepository {
+	return &StandingConsentRepository{db: db}
+}
+
+// Create stores a standing consent. Exactly one of doctorID and
+// specialization is set; expiresAt is nil for a consent without end.
+func (r *StandingConsentRepository) Create(patientID, doctorID int, specialization string, scopes []string, expiresAt *time.Time) (*models.StandingConsent, error) {
+	var id int
+	err := r.db.QueryRow(`
+		INSERT INTO public.standing_consents (patient_id, doctor_id, specialization, scopes, expires_at)
+		VALUES ($1, NULLIF($2, 0), NULLIF($3, ''), $4, $5)
+		RETURNING id`, patientID, doctorID, specialization, pq.Array(scopes), expiresAt).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	consents, err := r.query(standingConsentQuery+" WHERE sc.id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	return &consents[0], nil
+}
+
+// ListByPatient returns a patient's consents that are neither revoked nor expired
+func (r *StandingConsentRepository) ListByPatient(patientID int) ([]models.StandingConsent, error) {
+	return r.query(standingConsentQuery+`
+		WHERE sc.patient_id = $1 AND sc.revoked_at IS NULL
+		AND (sc.expires_at IS NULL OR sc.expires_at > NOW())
+		ORDER BY sc.created_at DESC`, patientID)
+}
+
+// Revoke ends one of a patient's standing consents
+func (r *StandingConsentRepository) Revoke(id, patientID int) error {
+	var owner int
+	err := r.db.QueryRow("SELECT patient_id FROM public.standing_consents WHERE id = $1", id).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return ErrConsentNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if owner != patientID {
+		return ErrConsentNotOwned
+	}
+
+	_, err = r.db.Exec(`
+		UPDATE public.standing_consents SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND revoked_at IS NULL`, id)
+	return err
+}
+
+const standingConsentQuery = `
+	SELECT sc.id, sc.patient_id, sc.doctor_id, CONCAT(u.first_name, ' ', u.last_name), sc.specialization,
+	       sc.scopes, sc.created_at, sc.expires_at, sc.revoked_at
+	FROM public.standing_consents sc
+	LEFT JOIN public.doctor d ON d.doctor_id = sc.doctor_id
+	LEFT JOIN public.user u ON u.user_id = d.user_id`
+
+func (r *StandingConsentRepository) query(query string, args ...interface{}) ([]models.StandingConsent, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	consents := []models.StandingConsent{}
+	for rows.Next() {
+		var c models.StandingConsent
+		var doctorID sql.NullInt64
+		var doctorName, specialization sql.NullString
+		var expiresAt, revokedAt sql.NullTime
+		if err := rows.Scan(&c.ID, &c.PatientID, &doctorID, &doctorName, &specialization,
+			pq.Array(&c.Scopes), &c.CreatedAt, &expiresAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		c.DoctorID = int(doctorID.Int64)
+		if doctorID.Valid {
+			c.DoctorFullName = doctorName.String
+		}
+		c.Specialization = specialization.String
+		c.ExpiresAt = expiresAt.Time
+		c.RevokedAt = revokedAt.Time
+		consents = append(consents, c)
+	}
+	return consents, rows.Err()
+}
@@ -8,11 +8,14 @@ import (
 	_ "github.com/lib/pq"
 )
 
-func ConnectDB(cfg *config.Config) (*sql.DB, error) {
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+// ConnString returns the lib/pq connection string for the configured database
+func ConnString(cfg *config.Config) string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName)
+}
 
-	db, err := sql.Open("postgres", connStr)
+func ConnectDB(cfg *config.Config) (*sql.DB, error) {
+	db, err := sql.Open("postgres", ConnString(cfg))
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %v", err)
 	}
@@ -0,0 +1,165 @@
+package repositories
+
+import (
+	"database/sql"
+	"diploma/internal/blockchain"
+	"diploma/internal/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	ErrEmergencyAccessNotFound  = errors.New("emergency access not found")
+	ErrEmergencyAlreadyReviewed = errors.New("emergency access has already been reviewed")
+)
+
+// EmergencyAccessRepository stores break-glass access. Each emergency is
+// written to emergency_access and access_log and appended to the blockchain
+// in one transaction, so it cannot happen without leaving a trace.
+type EmergencyAccessRepository struct {
+	db          *sql.DB
+	blockchain  *blockchain.Blockchain
+	patientKeys *PatientKeyRepository
+}
+
+func NewEmergencyAccessRepository(db *sql.DB, chain *blockchain.Blockchain, patientKeys *PatientKeyRepository) *EmergencyAccessRepository {
+	return &EmergencyAccessRepository{db: db, blockchain: chain, patientKeys: patientKeys}
+}
+
+// emergencyDetails is the encrypted on-chain payload of an "EmergencyAccess" block
+type emergencyDetails struct {
+	EmergencyAccessID int       `json:"emergency_access_id"`
+	Justification     string    `json:"justification"`
+	ExpiresAt         time.Time `json:"expires_at"`
+}
+
+// BreakGlass gives a doctor access to a patient's records for the given
+// duration and queues the event for review
+func (r *EmergencyAccessRepository) BreakGlass(doctorID, patientID int, justification string, duration time.Duration) (*models.EmergencyAccess, error) {
+	var id int
+	block, err := r.blockchain.Append(func(tx *sql.Tx) (blockchain.Transaction, error) {
+		var expiresAt time.Time
+		err := tx.QueryRow(`
+			INSERT INTO public.emergency_access (doctor_id, patient_id, justification, expires_at)
+			VALUES ($1, $2, $3, NOW() + $4 * INTERVAL '1 second')
+			RETURNING id, expires_at`,
+			doctorID, patientID, justification, int64(duration/time.Second)).Scan(&id, &expiresAt)
+		if err != nil {
+			return blockchain.Transaction{}, err
+		}
+
+		if _, err := tx.Exec(`
+			INSERT INTO access_log (doctor_id, patient_id, record_id, access_type)
+			VALUES ($1, $2, NULL, 'EmergencyAccess')`, doctorID, patientID); err != nil {
+			return blockchain.Transaction{}, err
+		}
+
+		detailsJSON, err := json.Marshal(emergencyDetails{
+			EmergencyAccessID: id,
+			Justification:     justification,
+			ExpiresAt:         expiresAt,
+		})
+		if err != nil {
+			return blockchain.Transaction{}, err
+		}
+		encrypted, hash, err := r.patientKeys.SealDetails(tx, patientID, detailsJSON)
+		if err != nil {
+			return blockchain.Transaction{}, fmt.Errorf("failed to encrypt emergency details: %w", err)
+		}
+
+		return blockchain.Transaction{
+			Action:           "EmergencyAccess",
+			DoctorID:         doctorID,
+			PatientID:        patientID,
+			DetailsHash:      hash,
+			EncryptedDetails: encrypted,
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The block index is only known once the block is committed. The block
+	// itself names the emergency, so a failure here loses only the shortcut.
+	if _, err := r.db.Exec("UPDATE public.emergency_access SET block_index = $1 WHERE id = $2", block.Index, id); err != nil {
+		log.Printf("Failed to link emergency access %d to block %d: %v", id, block.Index, err)
+	}
+
+	return r.GetByID(id)
+}
+
+const emergencyAccessQuery = `
+	SELECT e.id, e.doctor_id, u.first_name || ' ' || u.last_name, e.patient_id, e.justification,
+	       e.granted_at, e.expires_at, e.block_index, e.review_status, e.reviewed_by, e.reviewed_at, e.review_notes
+	FROM public.emergency_access e
+	JOIN public.doctor d ON d.doctor_id = e.doctor_id
+	JOIN public.user u ON u.user_id = d.user_id`
+
+// GetByID returns one emergency access
+func (r *EmergencyAccessRepository) GetByID(id int) (*models.EmergencyAccess, error) {
+	accesses, err := r.query(emergencyAccessQuery+" WHERE e.id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(accesses) == 0 {
+		return nil, ErrEmergencyAccessNotFound
+	}
+	return &accesses[0], nil
+}
+
+// ListByReviewStatus returns emergency accesses with the given review status,
+// oldest first so the review queue is worked in order. An empty status lists all.
+func (r *EmergencyAccessRepository) ListByReviewStatus(status string) ([]models.EmergencyAccess, error) {
+	if status == "" {
+		return r.query(emergencyAccessQuery + " ORDER BY e.granted_at ASC")
+	}
+	return r.query(emergencyAccessQuery+" WHERE e.review_status = $1 ORDER BY e.granted_at ASC", status)
+}
+
+// Review records an administrator's outcome for a pending emergency access
+func (r *EmergencyAccessRepository) Review(id, reviewerID int, outcome, notes string) (*models.EmergencyAccess, error) {
+	result, err := r.db.Exec(`
+		UPDATE public.emergency_access
+		SET review_status = $1, reviewed_by = $2, reviewed_at = CURRENT_TIMESTAMP, review_notes = NULLIF($3, '')
+		WHERE id = $4 AND review_status = 'pending'`, outcome, reviewerID, notes, id)
+	if err != nil {
+		return nil, err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		// Tell a missing emergency apart from one that was already reviewed
+		if _, err := r.GetByID(id); err != nil {
+			return nil, err
+		}
+		return nil, ErrEmergencyAlreadyReviewed
+	}
+	return r.GetByID(id)
+}
+
+func (r *EmergencyAccessRepository) query(query string, args ...interface{}) ([]models.EmergencyAccess, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accesses []models.EmergencyAccess
+	for rows.Next() {
+		var a models.EmergencyAccess
+		var blockIndex, reviewedBy sql.NullInt64
+		var reviewedAt sql.NullTime
+		var reviewNotes sql.NullString
+		if err := rows.Scan(&a.ID, &a.DoctorID, &a.DoctorFullName, &a.PatientID, &a.Justification,
+			&a.GrantedAt, &a.ExpiresAt, &blockIndex, &a.ReviewStatus, &reviewedBy, &reviewedAt, &reviewNotes); err != nil {
+			return nil, err
+		}
+		a.BlockIndex = int(blockIndex.Int64)
+		a.ReviewedBy = int(reviewedBy.Int64)
+		a.ReviewedAt = reviewedAt.Time
+		a.ReviewNotes = reviewNotes.String
+		accesses = append(accesses, a)
+	}
+	return accesses, rows.Err()
+}
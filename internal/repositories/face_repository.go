@@ -0,0 +1,84 @@
+package repositories
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Face verification purposes and outcomes
+const (
+	FacePurposeLogin  = "login"
+	FacePurposeStepUp = "step_up"
+
+	// FacePending marks an attempt whose comparison has not finished. It
+	// counts as a failure until it completes, and stays one if it never does.
+	FacePending    = "pending"
+	FaceMatched    = "matched"
+	FaceMismatched = "mismatched"
+	FaceError      = "error"
+)
+
+// ErrFaceAttemptsExceeded is returned when a user has used up their failed face verifications
+var ErrFaceAttemptsExceeded = errors.New("too many failed face verifications")
+
+// FaceVerificationRepository records face comparisons, for auditing and to
+// limit failed attempts
+type FaceVerificationRepository struct {
+	db *sql.DB
+}
+
+func NewFaceVerificationRepository(db *sql.DB) *FaceVerificationRepository {
+	return &FaceVerificationRepository{db: db}
+}
+
+// Reserve records a pending attempt unless the user already has maxAttempts
+// failures within the window since their last match. Attempts of the same
+// user are serialized, so concurrent comparisons cannot all pass the limit.
+// It returns the attempt and the failures counted before it.
+func (r *FaceVerificationRepository) Reserve(userID int, purpose, ipAddress string, maxAttempts int, window time.Duration) (int64, int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT 1 FROM public.user WHERE user_id = $1 FOR UPDATE", userID); err != nil {
+		return 0, 0, err
+	}
+	var failures int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM public.face_verification_attempts
+		WHERE user_id = $1 AND verification_status IN ('mismatched', 'pending')
+		AND created_at > NOW() - $2 * INTERVAL '1 second'
+		AND created_at > COALESCE((
+			SELECT MAX(created_at) FROM public.face_verification_attempts
+			WHERE user_id = $1 AND verification_status = 'matched'), '-infinity')`,
+		userID, int64(window/time.Second)).Scan(&failures)
+	if err != nil {
+		return 0, 0, err
+	}
+	if failures >= maxAttempts {
+		return 0, failures, ErrFaceAttemptsExceeded
+	}
+
+	var id int64
+	if err := tx.QueryRow(`
+		INSERT INTO public.face_verification_attempts (user_id, purpose, verification_status, ip_address)
+		VALUES ($1, $2, $3, $4) RETURNING id`,
+		userID, purpose, FacePending, ipAddress).Scan(&id); err != nil {
+		return 0, 0, err
+	}
+	return id, failures, tx.Commit()
+}
+
+// Complete stores the outcome of a reserved attempt. The distance is only
+// known when the face service answered.
+func (r *FaceVerificationRepository) Complete(attemptID int64, status string, distance sql.NullFloat64) error {
+	_, err := r.db.Exec(`
+		UPDATE public.face_verification_attempts
+		SET verification_status = $2, similarity_score = $3, verified_at = CASE WHEN $4 THEN NOW() END
+		WHERE id = $1`,
+		attemptID, status, distance, status == FaceMatched)
+	return err
+}
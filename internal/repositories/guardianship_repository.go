@@ -0,0 +1,204 @@
+package repositories
+
+import (
+	"database/sql"
+	"diploma/internal/models"
+	"errors"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrGuardianshipNotFound        = errors.New("guardianship not found")
+	ErrGuardianshipExists          = errors.New("an open guardianship for this dependent already exists")
+	ErrGuardianshipReviewed        = errors.New("guardianship has already been reviewed")
+	ErrGuardianshipNotOwned        = errors.New("guardianship belongs to another guardian")
+	ErrGuardianshipClosed          = errors.New("guardianship is no longer open")
+	ErrDependentNotMinor           = errors.New("dependent has reached the age of majority")
+	ErrGuardianOfSelf              = errors.New("a user cannot be their own guardian")
+	ErrGuardianshipDependentAbsent = errors.New("dependent patient not found")
+)
+
+// GuardianshipRepository stores guardians who may act for dependent patients.
+// A guardianship is active once verified, until it is revoked or, for a
+// minor, the dependent reaches the age of majority.
+type GuardianshipRepository struct {
+	db            *sql.DB
+	ageOfMajority int
+}
+
+func NewGuardianshipRepository(db *sql.DB, ageOfMajority int) *GuardianshipRepository {
+	return &GuardianshipRepository{db: db, ageOfMajority: ageOfMajority}
+}
+
+// Create records a pending guardianship of the patient with the given IIN
+func (r *GuardianshipRepository) Create(guardianUserID int, dependentIIN, dependentType, relationship, documentReference string) (*models.Guardianship, error) {
+	var patientID, dependentUserID int
+	var isMinor bool
+	err := r.db.QueryRow(`
+		SELECT p.patient_id, p.user_id, p.date_of_birth::date + make_interval(years => $2) > CURRENT_DATE
+		FROM public.patient p
+		JOIN public.user u ON u.user_id = p.user_id
+		WHERE u.iin = $1`, dependentIIN, r.ageOfMajority).Scan(&patientID, &dependentUserID, &isMinor)
+	if err == sql.ErrNoRows {
+		return nil, ErrGuardianshipDependentAbsent
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dependentUserID == guardianUserID {
+		return nil, ErrGuardianOfSelf
+	}
+	if dependentType == "minor" && !isMinor {
+		return nil, ErrDependentNotMinor
+	}
+
+	var id int
+	err = r.db.QueryRow(`
+		INSERT INTO public.guardianships (guardian_user_id, patient_id, dependent_type, relationship, document_reference)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`, guardianUserID, patientID, dependentType, relationship, documentReference).Scan(&id)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return nil, ErrGuardianshipExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.GetByID(id)
+}
+
+// GetByID returns one guardianship
+func (r *GuardianshipRepository) GetByID(id int) (*models.Guardianship, error) {
+	guardianships, err := r.query(guardianshipQuery+" WHERE g.id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(guardianships) == 0 {
+		return nil, ErrGuardianshipNotFound
+	}
+	return &guardianships[0], nil
+}
+
+// ListByUser returns the guardianships a user is the guardian or the dependent of, newest first
+func (r *GuardianshipRepository) ListByUser(userID int) ([]models.Guardianship, error) {
+	return r.query(guardianshipQuery+`
+		WHERE g.guardian_user_id = $1 OR p.user_id = $1
+		ORDER BY g.requested_at DESC`, userID)
+}
+
+// ListByStatus returns guardianships with the given status, oldest first so
+// the verification queue is worked in order. An empty status lists all.
+func (r *GuardianshipRepository) ListByStatus(status string) ([]models.Guardianship, error) {
+	if status == "" {
+		return r.query(guardianshipQuery + " ORDER BY g.requested_at ASC")
+	}
+	return r.query(guardianshipQuery+" WHERE g.status = $1 ORDER BY g.requested_at ASC", status)
+}
+
+// Review verifies or rejects a pending guardianship
+func (r *GuardianshipRepository) Review(id, reviewerID int, outcome, notes string) (*models.Guardianship, error) {
+	result, err := r.db.Exec(`
+		UPDATE public.guardianships
+		SET status = $1, verified_by = $2, verified_at = CURRENT_TIMESTAMP, review_notes = NULLIF($3, '')
+		WHERE id = $4 AND status = 'pending'`, outcome, reviewerID, notes, id)
+	if err != nil {
+		return nil, err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		if _, err := r.GetByID(id); err != nil {
+			return nil, err
+		}
+		return nil, ErrGuardianshipReviewed
+	}
+	return r.GetByID(id)
+}
+
+// Revoke ends an open guardianship. Only its guardian may revoke it unless
+// asAdmin is set.
+func (r *GuardianshipRepository) Revoke(id, userID int, asAdmin bool) error {
+	guardianship, err := r.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if !asAdmin && guardianship.GuardianUserID != userID {
+		return ErrGuardianshipNotOwned
+	}
+
+	result, err := r.db.Exec(`
+		UPDATE public.guardianships SET status = 'revoked', ended_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status IN ('pending', 'verified')`, id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrGuardianshipClosed
+	}
+	return nil
+}
+
+// IsActiveGuardian reports whether a user may currently act for a patient.
+// Minors who have come of age are excluded even before EndAgedOut marks them.
+func (r *GuardianshipRepository) IsActiveGuardian(guardianUserID, patientID int) (bool, error) {
+	var active bool
+	err := r.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM public.guardianships g
+			JOIN public.patient p ON p.patient_id = g.patient_id
+			WHERE g.guardian_user_id = $1 AND g.patient_id = $2
+			AND g.status = 'verified'
+			AND (g.dependent_type = 'adult' OR p.date_of_birth::date + make_interval(years => $3) > CURRENT_DATE)
+		)`, guardianUserID, patientID, r.ageOfMajority).Scan(&active)
+	return active, err
+}
+
+// EndAgedOut ends the guardianships of minors who have reached the age of
+// majority and returns how many were ended
+func (r *GuardianshipRepository) EndAgedOut() (int64, error) {
+	result, err := r.db.Exec(`
+		UPDATE public.guardianships g SET status = 'ended', ended_at = CURRENT_TIMESTAMP
+		FROM public.patient p
+		WHERE p.patient_id = g.patient_id
+		AND g.dependent_type = 'minor'
+		AND g.status IN ('pending', 'verified')
+		AND p.date_of_birth::date + make_interval(years => $1) <= CURRENT_DATE`, r.ageOfMajority)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const guardianshipQuery = `
+	SELECT g.id, g.guardian_user_id, CONCAT(gu.first_name, ' ', gu.last_name), g.patient_id,
+	       CONCAT(pu.first_name, ' ', pu.last_name), pu.iin, g.dependent_type, g.relationship,
+	       g.document_reference, g.status, g.requested_at, g.verified_by, g.verified_at, g.review_notes, g.ended_at
+	FROM public.guardianships g
+	JOIN public.user gu ON gu.user_id = g.guardian_user_id
+	JOIN public.patient p ON p.patient_id = g.patient_id
+	JOIN public.user pu ON pu.user_id = p.user_id`
+
+func (r *GuardianshipRepository) query(query string, args ...interface{}) ([]models.Guardianship, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	guardianships := []models.Guardianship{}
+	for rows.Next() {
+		var g models.Guardianship
+		var verifiedBy sql.NullInt64
+		var verifiedAt, endedAt sql.NullTime
+		var reviewNotes sql.NullString
+		if err := rows.Scan(&g.ID, &g.GuardianUserID, &g.GuardianFullName, &g.PatientID,
+			&g.DependentFullName, &g.DependentIIN, &g.DependentType, &g.Relationship,
+			&g.DocumentReference, &g.Status, &g.RequestedAt, &verifiedBy, &verifiedAt, &reviewNotes, &endedAt); err != nil {
+			return nil, err
+		}
+		g.VerifiedBy = int(verifiedBy.Int64)
+		g.VerifiedAt = verifiedAt.Time
+		g.ReviewNotes = reviewNotes.String
+		g.EndedAt = endedAt.Time
+		guardianships = append(guardianships, g)
+	}
+	return guardianships, rows.Err()
+}
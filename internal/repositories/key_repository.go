@@ -0,0 +1,121 @@
+package repositories
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"diploma/internal/blockchain"
+	"diploma/internal/vault"
+	"encoding/hex"
+	"fmt"
+)
+
+// KeyRepository stores doctors' Ed25519 signing keys and signs blockchain
+// transactions with them. It implements blockchain.Signer and blockchain.KeyLister.
+type KeyRepository struct {
+	db    *sql.DB
+	vault *vault.Vault
+}
+
+func NewKeyRepository(db *sql.DB, vault *vault.Vault) *KeyRepository {
+	return &KeyRepository{db: db, vault: vault}
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// KeyFingerprint identifies a public key by the hex SHA-256 of its bytes
+func KeyFingerprint(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:])
+}
+
+// createDoctorKey generates a key pair for a doctor and stores the private key encrypted
+func createDoctorKey(q queryer, v *vault.Vault, doctorID int) (string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	encryptedKey, err := v.Seal(privateKey.Seed())
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt signing key: %v", err)
+	}
+
+	fingerprint := KeyFingerprint(publicKey)
+	_, err = q.Exec(`
+		INSERT INTO public.doctor_keys (doctor_id, public_key, encrypted_private_key, fingerprint)
+		VALUES ($1, $2, $3, $4)`,
+		doctorID, []byte(publicKey), encryptedKey, fingerprint)
+	if err != nil {
+		return "", err
+	}
+	return fingerprint, nil
+}
+
+// Sign signs payload with the doctor's active key. Doctors registered before
+// signing keys existed get a key on their first signature.
+func (r *KeyRepository) Sign(doctorID int, payload []byte) ([]byte, string, error) {
+	var encryptedKey []byte
+	var fingerprint string
+	err := r.db.QueryRow(`
+		SELECT encrypted_private_key, fingerprint
+		FROM public.doctor_keys
+		WHERE doctor_id = $1 AND revoked_at IS NULL`, doctorID).Scan(&encryptedKey, &fingerprint)
+	if err == sql.ErrNoRows {
+		if _, err := createDoctorKey(r.db, r.vault, doctorID); err != nil {
+			return nil, "", fmt.Errorf("failed to create signing key for doctor %d: %v", doctorID, err)
+		}
+		return r.Sign(doctorID, payload)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	seed, err := r.vault.Open(encryptedKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decrypt signing key %s: %v", fingerprint, err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, "", fmt.Errorf("signing key %s is malformed", fingerprint)
+	}
+
+	return ed25519.Sign(ed25519.NewKeyFromSeed(seed), payload), fingerprint, nil
+}
+
+// PublicKey returns a stored public key, revoked or not, and the doctor it belongs to
+func (r *KeyRepository) PublicKey(fingerprint string) (int, ed25519.PublicKey, error) {
+	var doctorID int
+	var publicKey []byte
+	err := r.db.QueryRow(`
+		SELECT doctor_id, public_key
+		FROM public.doctor_keys
+		WHERE fingerprint = $1`, fingerprint).Scan(&doctorID, &publicKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	return doctorID, ed25519.PublicKey(publicKey), nil
+}
+
+// PublicKeys lists every doctor public key, revoked or not, for chain archives
+func (r *KeyRepository) PublicKeys() ([]blockchain.PublicKeyRecord, error) {
+	rows, err := r.db.Query("SELECT fingerprint, doctor_id, public_key FROM public.doctor_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []blockchain.PublicKeyRecord
+	for rows.Next() {
+		var key blockchain.PublicKeyRecord
+		if err := rows.Scan(&key.Fingerprint, &key.DoctorID, &key.PublicKey); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
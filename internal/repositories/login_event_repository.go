@@ -0,0 +1,74 @@
+package repositories
+
+import (
+	"database/sql"
+	"diploma/internal/models"
+	"time"
+)
+
+// How a login was attempted
+const (
+	LoginMethodPassword = "password"
+	LoginMethodFace     = "face"
+)
+
+// How a login attempt ended
+const (
+	LoginSucceeded = "succeeded"
+	LoginFailed    = "failed"
+	LoginMFAFailed = "mfa_failed"
+	LoginSuspended = "suspended"
+)
+
+// LoginEventRepository keeps the login history of each account
+type LoginEventRepository struct {
+	db *sql.DB
+}
+
+func NewLoginEventRepository(db *sql.DB) *LoginEventRepository {
+	return &LoginEventRepository{db: db}
+}
+
+// Record adds a login attempt to a user's history
+func (r *LoginEventRepository) Record(userID int, method, outcome, ip, userAgent string) error {
+	_, err := r.db.Exec(`
+		INSERT INTO public.login_events (user_id, method, outcome, ip_address, user_agent)
+		VALUES ($1, $2, $3, $4, $5)`, userID, method, outcome, ip, userAgent)
+	return err
+}
+
+// ListByUser returns a user's latest login attempts, newest first
+func (r *LoginEventRepository) ListByUser(userID, limit int) ([]models.LoginEvent, error) {
+	rows, err := r.db.Query(`
+		SELECT method, outcome, COALESCE(ip_address, ''), COALESCE(user_agent, ''), created_at
+		FROM public.login_events
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.LoginEvent{}
+	for rows.Next() {
+		var e models.LoginEvent
+		if err := rows.Scan(&e.Method, &e.Outcome, &e.IPAddress, &e.UserAgent, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// DeleteOlderThan deletes login attempts older than retention and returns how
+// many were deleted
+func (r *LoginEventRepository) DeleteOlderThan(retention time.Duration) (int64, error) {
+	result, err := r.db.Exec(`
+		DELETE FROM public.login_events
+		WHERE created_at < NOW() - $1 * INTERVAL '1 second'`, int64(retention/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
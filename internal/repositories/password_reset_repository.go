@@ -0,0 +1,140 @@
+package repositories
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrPasswordResetTooSoon = errors.New("a password reset was requested moments ago")
+	ErrPasswordResetInvalid = errors.New("invalid or already used reset code")
+	ErrPasswordResetExpired = errors.New("reset code has expired")
+)
+
+// resetRequestInterval is how long a user must wait between reset requests,
+// so the endpoint cannot be used to flood their inbox
+const resetRequestInterval = time.Minute
+
+// PasswordResetRepository stores single-use password reset codes. Only their
+// SHA-256 is kept. A code expires after ttl and is given up after
+// maxAttempts wrong guesses.
+type PasswordResetRepository struct {
+	db          *sql.DB
+	ttl         time.Duration
+	maxAttempts int
+}
+
+func NewPasswordResetRepository(db *sql.DB, ttl time.Duration, maxAttempts int) *PasswordResetRepository {
+	return &PasswordResetRepository{db: db, ttl: ttl, maxAttempts: maxAttempts}
+}
+
+// Create returns a new reset code for a user, replacing their earlier ones
+func (r *PasswordResetRepository) Create(userID int, ip string) (string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// Serialize requests of the same user
+	if _, err := tx.Exec("SELECT 1 FROM public.user WHERE user_id = $1 FOR UPDATE", userID); err != nil {
+		return "", err
+	}
+	var recent bool
+	if err := tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM public.password_resets
+		WHERE user_id = $1 AND created_at > NOW() - $2 * INTERVAL '1 second')`,
+		userID, int64(resetRequestInterval/time.Second)).Scan(&recent); err != nil {
+		return "", err
+	}
+	if recent {
+		return "", ErrPasswordResetTooSoon
+	}
+
+	code, err := readableCode()
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("DELETE FROM public.password_resets WHERE user_id = $1", userID); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO public.password_resets (user_id, token_hash, requested_ip, expires_at)
+		VALUES ($1, $2, $3, NOW() + $4 * INTERVAL '1 second')`,
+		userID, hashToken(normalizeCode(code)), ip, int64(r.ttl/time.Second)); err != nil {
+		return "", err
+	}
+	return code, tx.Commit()
+}
+
+// Consume checks a reset code for the user with the given IIN and, if it is
+// valid, spends it and sets the password hash newPassword returns for the
+// user. An error from newPassword is returned and leaves the code unspent.
+// A wrong code counts against the code's attempts; the last one spends it.
+func (r *PasswordResetRepository) Consume(iin, code string, newPassword func(userID int) (string, error)) (int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id, userID int
+	var tokenHash []byte
+	var expired bool
+	err = tx.QueryRow(`
+		SELECT pr.id, pr.user_id, pr.token_hash, pr.expires_at <= NOW()
+		FROM public.password_resets pr
+		JOIN public.user u ON u.user_id = pr.user_id
+		WHERE u.iin = $1 AND pr.used_at IS NULL AND pr.failed_attempts < $2
+		ORDER BY pr.created_at DESC
+		LIMIT 1
+		FOR UPDATE OF pr`, iin, r.maxAttempts).Scan(&id, &userID, &tokenHash, &expired)
+	if err == sql.ErrNoRows {
+		return 0, ErrPasswordResetInvalid
+	}
+	if err != nil {
+		return 0, err
+	}
+	if expired {
+		return 0, ErrPasswordResetExpired
+	}
+
+	if subtle.ConstantTimeCompare(tokenHash, hashToken(normalizeCode(code))) != 1 {
+		if _, err := tx.Exec(`
+			UPDATE public.password_resets SET failed_attempts = failed_attempts + 1,
+				used_at = CASE WHEN failed_attempts + 1 >= $2 THEN NOW() END
+			WHERE id = $1`, id, r.maxAttempts); err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+		return 0, ErrPasswordResetInvalid
+	}
+
+	passwordHash, err := newPassword(userID)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE public.password_resets SET used_at = NOW() WHERE id = $1", id); err != nil {
+		return 0, err
+	}
+	if err := setPassword(tx, userID, passwordHash); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+// DeleteExpired deletes reset codes that expired or were used longer ago
+// than retention, and returns how many were deleted
+func (r *PasswordResetRepository) DeleteExpired(retention time.Duration) (int64, error) {
+	result, err := r.db.Exec(`
+		DELETE FROM public.password_resets
+		WHERE COALESCE(used_at, expires_at) < NOW() - $1 * INTERVAL '1 second'`, int64(retention/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,166 @@
+package repositories
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"diploma/internal/blockchain"
+	"diploma/internal/vault"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrDataKeyShredded is returned for patients whose data key has been destroyed
+var ErrDataKeyShredded = errors.New("patient data key has been shredded")
+
+// PatientKeyRepository stores per-patient data keys that encrypt the record
+// details kept on the blockchain. Data keys are encrypted under the master
+// key. Shredding a patient's data key makes every encrypted detail of that
+// patient unreadable while the chain still verifies.
+type PatientKeyRepository struct {
+	db    *sql.DB
+	vault *vault.Vault
+}
+
+func NewPatientKeyRepository(db *sql.DB, vault *vault.Vault) *PatientKeyRepository {
+	return &PatientKeyRepository{db: db, vault: vault}
+}
+
+// dataKey returns a patient's data key, creating it on first use
+func (r *PatientKeyRepository) dataKey(q queryer, patientID int) ([]byte, error) {
+	key, err := r.storedKey(q, patientID)
+	if err != sql.ErrNoRows {
+		return key, err
+	}
+
+	newKey := make([]byte, vault.KeySize)
+	if _, err := io.ReadFull(rand.Reader, newKey); err != nil {
+		return nil, err
+	}
+	sealedKey, err := r.vault.Seal(newKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt data key: %v", err)
+	}
+
+	// Concurrent writers for the same patient agree on whichever key was stored first
+	if _, err := q.Exec(`
+		INSERT INTO public.patient_keys (patient_id, encrypted_key)
+		VALUES ($1, $2)
+		ON CONFLICT (patient_id) DO NOTHING`, patientID, sealedKey); err != nil {
+		return nil, err
+	}
+
+	return r.storedKey(q, patientID)
+}
+
+// storedKey reads and decrypts an existing data key
+func (r *PatientKeyRepository) storedKey(q queryer, patientID int) ([]byte, error) {
+	var sealedKey []byte
+	err := q.QueryRow("SELECT encrypted_key FROM public.patient_keys WHERE patient_id = $1", patientID).Scan(&sealedKey)
+	if err != nil {
+		return nil, err
+	}
+	if sealedKey == nil {
+		return nil, ErrDataKeyShredded
+	}
+
+	key, err := r.vault.Open(sealedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key of patient %d: %v", patientID, err)
+	}
+	return key, nil
+}
+
+// SealDetails encrypts record details for the blockchain and returns the
+// base64 ciphertext and the hex content hash that the block hash covers
+func (r *PatientKeyRepository) SealDetails(q queryer, patientID int, details []byte) (string, string, error) {
+	key, err := r.dataKey(q, patientID)
+	if err != nil {
+		return "", "", err
+	}
+
+	v, err := vault.New(key)
+	if err != nil {
+		return "", "", err
+	}
+	ciphertext, err := v.Seal(details)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(ciphertext), contentHash(key, details), nil
+}
+
+// OpenDetails decrypts record details and checks them against their content hash
+func (r *PatientKeyRepository) OpenDetails(patientID int, encrypted, hash string) ([]byte, error) {
+	key, err := r.storedKey(r.db, patientID)
+	if err == sql.ErrNoRows {
+		return nil, ErrDataKeyShredded
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted details are not valid base64: %v", err)
+	}
+	v, err := vault.New(key)
+	if err != nil {
+		return nil, err
+	}
+	details, err := v.Open(ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt details: %v", err)
+	}
+	if !hmac.Equal([]byte(contentHash(key, details)), []byte(hash)) {
+		return nil, errors.New("decrypted details do not match their content hash")
+	}
+	return details, nil
+}
+
+// Shred destroys a patient's data key. Record details written with schema
+// version 3 or later become unreadable; details in older blocks were stored
+// in plaintext and are not affected.
+func (r *PatientKeyRepository) Shred(patientID int) error {
+	result, err := r.db.Exec(`
+		UPDATE public.patient_keys
+		SET encrypted_key = NULL, shredded_at = CURRENT_TIMESTAMP
+		WHERE patient_id = $1 AND encrypted_key IS NOT NULL`, patientID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		// Also block keys from being created later for a patient with no key yet
+		_, err = r.db.Exec(`
+			INSERT INTO public.patient_keys (patient_id, encrypted_key, shredded_at)
+			VALUES ($1, NULL, CURRENT_TIMESTAMP)
+			ON CONFLICT (patient_id) DO NOTHING`, patientID)
+		return err
+	}
+	return nil
+}
+
+// PlaintextBlocks counts a patient's blocks from before schema version 3,
+// whose record details are stored in plaintext and survive Shred. They
+// cannot be rewritten without breaking the hash chain.
+func (r *PatientKeyRepository) PlaintextBlocks(patientID int) (int, error) {
+	var count int
+	err := r.db.QueryRow(`
+		SELECT COUNT(*) FROM public.blocks
+		WHERE (transaction->>'patient_id')::int = $1 AND schema_version < $2
+			AND COALESCE(transaction->>'details', '') <> ''`,
+		patientID, blockchain.SchemaEncrypted).Scan(&count)
+	return count, err
+}
+
+// contentHash keys the hash with the data key, so short or guessable details
+// cannot be confirmed by hashing candidates once the key is shredded
+func contentHash(key, details []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(details)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -5,15 +5,31 @@ import (
 	"diploma/internal/blockchain"
 	"diploma/internal/models"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"time"
 )
 
 type RecordRepository struct {
-	db         *sql.DB
-	blockchain *blockchain.Blockchain
+	db           *sql.DB
+	blockchain   *blockchain.Blockchain
+	patientKeys  *PatientKeyRepository
+	accessPolicy AccessPolicy
 }
 
-func NewRecordRepository(db *sql.DB) *RecordRepository {
-	return &RecordRepository{db: db, blockchain: blockchain.NewBlockchain(db)}
+// AccessPolicy decides what, besides a granted access request, gives a doctor
+// access to a patient's records
+type AccessPolicy struct {
+	// AppointmentGrantsAccess treats an appointment between the doctor and
+	// the patient as implicit consent
+	AppointmentGrantsAccess bool
+	// AppointmentWindow is how far before or after now the appointment may be
+	AppointmentWindow time.Duration
+}
+
+func NewRecordRepository(db *sql.DB, chain *blockchain.Blockchain, patientKeys *PatientKeyRepository, accessPolicy AccessPolicy) *RecordRepository {
+	return &RecordRepository{db: db, blockchain: chain, patientKeys: patientKeys, accessPolicy: accessPolicy}
 }
 
 func (r *RecordRepository) GetRecordByPatientID(UserId int) (*models.Record, error) {
@@ -60,43 +76,60 @@ func (r *RecordRepository) GetRecordByID(recordID int) (*models.Record, error) {
 	return &record, nil
 }
 
+// UpdateRecord updates a record and appends an "Update" block in the same transaction
 func (r *RecordRepository) UpdateRecord(record *models.Record) error {
-	// Convert updated record to JSON string for blockchain
-	recordJSON, err := json.Marshal(record)
-	if err != nil {
-		return err
-	}
+	_, err := r.blockchain.Append(func(tx *sql.Tx) (blockchain.Transaction, error) {
+		// Update in database
+		result, err := tx.Exec("UPDATE public.medical_record SET diagnosis=$1, treatment_plan=$2, test_result=$3 WHERE record_id=$4",
+			record.Diagnosis, record.TreatmentPlan, record.TestResult, record.RecordId)
+		if err != nil {
+			return blockchain.Transaction{}, err
+		}
+		if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+			return blockchain.Transaction{}, sql.ErrNoRows
+		}
 
-	// Update in database
-	_, err = r.db.Exec("UPDATE public.medical_record SET diagnosis=$1, treatment_plan=$2, test_result=$3 WHERE record_id=$4",
-		record.Diagnosis, record.TreatmentPlan, record.TestResult, record.RecordId)
-	if err != nil {
-		return err
-	}
+		return r.recordTransaction(tx, "Update", record)
+	})
+	return err
+}
 
-	// Add to blockchain
-	r.blockchain.AddBlock("Update", record.RecordId, record.DoctorId, record.PatientId, string(recordJSON))
+// CreateRecord inserts a record and appends a "Create" block in the same transaction
+func (r *RecordRepository) CreateRecord(record *models.Record) error {
+	_, err := r.blockchain.Append(func(tx *sql.Tx) (blockchain.Transaction, error) {
+		// Store in database
+		err := tx.QueryRow("INSERT INTO public.medical_record(patient_id, doctor_id, diagnosis, treatment_plan, test_result) VALUES ($1, $2, $3, $4, $5) RETURNING record_id", record.PatientId, record.DoctorId, record.Diagnosis, record.TreatmentPlan, record.TestResult).Scan(&record.RecordId)
+		if err != nil {
+			return blockchain.Transaction{}, err
+		}
 
-	return nil
+		return r.recordTransaction(tx, "Create", record)
+	})
+	return err
 }
 
-func (r *RecordRepository) CreateRecord(record *models.Record) error {
+// recordTransaction builds the blockchain transaction for a record write.
+// The record is encrypted with the patient's data key before it goes on-chain.
+func (r *RecordRepository) recordTransaction(tx *sql.Tx, action string, record *models.Record) (blockchain.Transaction, error) {
 	// Convert record to JSON string for blockchain
 	recordJSON, err := json.Marshal(record)
 	if err != nil {
-		return err
+		return blockchain.Transaction{}, err
 	}
 
-	// Store in database
-	err = r.db.QueryRow("INSERT INTO public.medical_record(patient_id, doctor_id, diagnosis, treatment_plan, test_result) VALUES ($1, $2, $3, $4, $5) RETURNING record_id", record.PatientId, record.DoctorId, record.Diagnosis, record.TreatmentPlan, record.TestResult).Scan(&record.RecordId)
+	encrypted, hash, err := r.patientKeys.SealDetails(tx, record.PatientId, recordJSON)
 	if err != nil {
-		return err
+		return blockchain.Transaction{}, fmt.Errorf("failed to encrypt record details: %w", err)
 	}
 
-	// Add to blockchain
-	r.blockchain.AddBlock("Create", record.RecordId, record.DoctorId, record.PatientId, string(recordJSON))
-
-	return nil
+	return blockchain.Transaction{
+		Action:           action,
+		RecordID:         record.RecordId,
+		DoctorID:         record.DoctorId,
+		PatientID:        record.PatientId,
+		DetailsHash:      hash,
+		EncryptedDetails: encrypted,
+	}, nil
 }
 
 func (r *RecordRepository) CreateAccessLog(accessLog *models.AccessLog) error {
@@ -104,18 +137,63 @@ func (r *RecordRepository) CreateAccessLog(accessLog *models.AccessLog) error {
 	return err
 }
 
-func (r *RecordRepository) HasValidAccess(doctorID, patientID int) (bool, error) {
-	query := `
+// AccessScope returns the record categories a doctor may access of a
+// patient's records: the union of every access request the patient granted
+// that is still running and every standing consent for the doctor or their
+// specialization. Break-glass emergencies that have not yet ended and, if the
+// access policy allows it, an appointment between the two cover all
+// categories. An empty scope means the doctor has no access.
+func (r *RecordRepository) AccessScope(doctorID, patientID int) (AccessScope, error) {
+	rows, err := r.db.Query(`
+		SELECT COALESCE(scopes, $3::text[]) FROM access_requests
+		WHERE doctor_id = $1 AND patient_id = $2
+		AND status = 'granted'
+		AND access_expires_at > NOW()
+		UNION ALL
+		SELECT sc.scopes FROM public.standing_consents sc
+		JOIN public.doctor d ON d.doctor_id = $1
+		WHERE sc.patient_id = $2
+		AND sc.revoked_at IS NULL
+		AND (sc.expires_at IS NULL OR sc.expires_at > NOW())
+		AND (sc.doctor_id = d.doctor_id OR LOWER(sc.specialization) = LOWER(d.specialization))
+		UNION ALL
+		SELECT $3::text[] FROM public.emergency_access
+		WHERE doctor_id = $1 AND patient_id = $2
+		AND expires_at > NOW()`, doctorID, patientID, pq.Array(models.RecordScopes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scope := AccessScope{}
+	for rows.Next() {
+		var categories []string
+		if err := rows.Scan(pq.Array(&categories)); err != nil {
+			return nil, err
+		}
+		scope.Add(categories)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(scope) == len(models.RecordScopes) || !r.accessPolicy.AppointmentGrantsAccess {
+		return scope, nil
+	}
+
+	var hasAppointment bool
+	err = r.db.QueryRow(`
 		SELECT EXISTS (
-			SELECT 1 FROM access_requests
+			SELECT 1 FROM public.appointment
 			WHERE doctor_id = $1 AND patient_id = $2
-			AND status = 'granted'
-			AND access_expires_at > NOW()
-		)`
-
-	var exists bool
-	err := r.db.QueryRow(query, doctorID, patientID).Scan(&exists)
-	return exists, err
+			AND date BETWEEN NOW() - $3 * INTERVAL '1 second' AND NOW() + $3 * INTERVAL '1 second'
+		)`, doctorID, patientID, int64(r.accessPolicy.AppointmentWindow/time.Second)).Scan(&hasAppointment)
+	if err != nil {
+		return nil, err
+	}
+	if hasAppointment {
+		return FullAccessScope(), nil
+	}
+	return scope, nil
 }
 
 func (r *RecordRepository) GetRecordsByPatientID(UserId int) ([]models.RecordWithDetails, error) {
@@ -169,7 +247,8 @@ func (r *RecordRepository) GetRecordsByPatientID(UserId int) ([]models.RecordWit
 	return records, nil
 }
 
-func (r *RecordRepository) GetRecordsByIIN(iin string) ([]models.RecordWithDetails, error) {
+// GetRecordsByIIN returns a patient's records with the fields outside scope blanked
+func (r *RecordRepository) GetRecordsByIIN(iin string, scope AccessScope) ([]models.RecordWithDetails, error) {
 	var userId int
 	var passwordChanged bool
 	if err := r.db.QueryRow("SELECT user_id, password_changed FROM public.user WHERE iin=$1", iin).Scan(&userId, &passwordChanged); err != nil {
@@ -219,7 +298,171 @@ func (r *RecordRepository) GetRecordsByIIN(iin string) ([]models.RecordWithDetai
 		); err != nil {
 			return nil, err
 		}
+		scope.FilterRecord(&record.Record)
 		records = append(records, record)
 	}
 	return records, nil
 }
+
+// GetRecordHistory returns every version of a record committed to the
+// blockchain, oldest first, with the fields outside scope blanked
+func (r *RecordRepository) GetRecordHistory(recordID int, scope AccessScope) ([]models.RecordVersion, error) {
+	blocks, err := r.blockchain.BlocksByRecordID(recordID)
+	if err != nil {
+		return nil, err
+	}
+	return r.buildHistory(blocks, scope)
+}
+
+// GetPatientHistory returns every version of every record of a patient,
+// oldest first, with the fields outside scope blanked
+func (r *RecordRepository) GetPatientHistory(patientID int, scope AccessScope) ([]models.RecordVersion, error) {
+	blocks, err := r.blockchain.BlocksByPatientID(patientID)
+	if err != nil {
+		return nil, err
+	}
+	return r.buildHistory(blocks, scope)
+}
+
+// GetRecordProof returns a block holding a version of the record together with
+// its Merkle inclusion proof. A negative blockIndex selects the latest version.
+func (r *RecordRepository) GetRecordProof(recordID, blockIndex int) (*blockchain.Block, *blockchain.InclusionProof, error) {
+	var block *blockchain.Block
+	if blockIndex < 0 {
+		blocks, err := r.blockchain.BlocksByRecordID(recordID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(blocks) == 0 {
+			return nil, nil, sql.ErrNoRows
+		}
+		block = &blocks[len(blocks)-1]
+	} else {
+		var err error
+		block, err = r.blockchain.BlockByIndex(blockIndex)
+		if err != nil {
+			return nil, nil, err
+		}
+		if block.Transaction.RecordID != recordID {
+			return nil, nil, sql.ErrNoRows
+		}
+	}
+
+	proof, err := r.blockchain.InclusionProof(block.Index)
+	if err != nil {
+		return nil, nil, err
+	}
+	return block, proof, nil
+}
+
+// buildHistory decodes record snapshots from blocks and diffs each one against
+// the previous snapshot of the same record
+func (r *RecordRepository) buildHistory(blocks []blockchain.Block, scope AccessScope) ([]models.RecordVersion, error) {
+	versions := make([]models.RecordVersion, 0, len(blocks))
+	previous := make(map[int]*models.Record)
+	doctorNames := make(map[int]string)
+
+	for _, block := range blocks {
+		// Patient blocks also log events such as emergency access, which are not record versions
+		if action := block.Transaction.Action; action != "Create" && action != "Update" {
+			continue
+		}
+
+		details, err := r.blockDetails(block)
+		if errors.Is(err, ErrDataKeyShredded) {
+			versions = append(versions, redactedVersion(block))
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("block %d: %w", block.Index, err)
+		}
+
+		var snapshot models.Record
+		if err := json.Unmarshal(details, &snapshot); err != nil {
+			return nil, fmt.Errorf("block %d has invalid record details: %v", block.Index, err)
+		}
+
+		doctorName, ok := doctorNames[block.Transaction.DoctorID]
+		if !ok {
+			doctorName, _ = r.getDoctorFullName(block.Transaction.DoctorID)
+			doctorNames[block.Transaction.DoctorID] = doctorName
+		}
+
+		version := models.RecordVersion{
+			BlockIndex:     block.Index,
+			BlockHash:      block.Hash,
+			Action:         block.Transaction.Action,
+			RecordId:       block.Transaction.RecordID,
+			PatientId:      block.Transaction.PatientID,
+			DoctorId:       block.Transaction.DoctorID,
+			DoctorFullName: doctorName,
+			ChangedAt:      block.Transaction.Timestamp,
+			Diagnosis:      snapshot.Diagnosis,
+			TreatmentPlan:  snapshot.TreatmentPlan,
+			TestResult:     snapshot.TestResult,
+			Changes:        diffRecords(previous[block.Transaction.RecordID], &snapshot),
+		}
+		scope.FilterVersion(&version)
+		versions = append(versions, version)
+		previous[block.Transaction.RecordID] = &snapshot
+	}
+	return versions, nil
+}
+
+// blockDetails returns the record JSON of a block, decrypting it if needed
+func (r *RecordRepository) blockDetails(block blockchain.Block) ([]byte, error) {
+	if block.Version < blockchain.SchemaEncrypted {
+		return []byte(block.Transaction.Details), nil
+	}
+	return r.patientKeys.OpenDetails(block.Transaction.PatientID, block.Transaction.EncryptedDetails, block.Transaction.DetailsHash)
+}
+
+// redactedVersion describes a version whose details were crypto-shredded
+func redactedVersion(block blockchain.Block) models.RecordVersion {
+	return models.RecordVersion{
+		BlockIndex: block.Index,
+		BlockHash:  block.Hash,
+		Action:     block.Transaction.Action,
+		RecordId:   block.Transaction.RecordID,
+		PatientId:  block.Transaction.PatientID,
+		DoctorId:   block.Transaction.DoctorID,
+		ChangedAt:  block.Transaction.Timestamp,
+		Redacted:   true,
+		Changes:    []models.FieldChange{},
+	}
+}
+
+func (r *RecordRepository) getDoctorFullName(doctorID int) (string, error) {
+	var fullName string
+	err := r.db.QueryRow(`
+		SELECT CONCAT(u.first_name, ' ', u.last_name)
+		FROM public.doctor d
+		JOIN public.user u ON d.user_id = u.user_id
+		WHERE d.doctor_id = $1`, doctorID).Scan(&fullName)
+	return fullName, err
+}
+
+// diffRecords lists the clinical fields that differ between two versions.
+// The first version of a record is diffed against empty values.
+func diffRecords(before, after *models.Record) []models.FieldChange {
+	if before == nil {
+		before = &models.Record{}
+	}
+
+	fields := []struct {
+		name     string
+		from, to string
+	}{
+		{"diagnosis", before.Diagnosis, after.Diagnosis},
+		{"treatment_plan", before.TreatmentPlan, after.TreatmentPlan},
+		{"test_result", before.TestResult, after.TestResult},
+	}
+
+	changes := []models.FieldChange{}
+	for _, field := range fields {
+		if field.from != field.to {
+			changes = append(changes, models.FieldChange{Field: field.name, From: field.from, To: field.to})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,284 @@
+package repositories
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"diploma/internal/auth"
+	"diploma/internal/models"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used, the session has been revoked")
+	ErrSessionNotFound     = errors.New("session not found")
+)
+
+// SessionRepository stores login sessions and their refresh tokens. A refresh
+// token is used once: refreshing replaces it, and presenting a replaced token
+// again means it was stolen, so the whole session is revoked. Revoking a
+// session revokes the access tokens issued in it through their sid claim.
+type SessionRepository struct {
+	db         *sql.DB
+	refreshTTL time.Duration
+}
+
+func NewSessionRepository(db *sql.DB, refreshTTL time.Duration) *SessionRepository {
+	return &SessionRepository{db: db, refreshTTL: refreshTTL}
+}
+
+// Create starts a session for a user and returns its ID and first refresh
+// token. Suspended users get ErrAccountSuspended.
+func (r *SessionRepository) Create(userID int, userAgent, ipAddress string) (string, string, error) {
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	var suspended bool
+	if err := tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM public.account_suspensions WHERE user_id = $1)`, userID).Scan(&suspended); err != nil {
+		return "", "", err
+	}
+	if suspended {
+		return "", "", ErrAccountSuspended
+	}
+
+	ttl := int64(r.refreshTTL / time.Second)
+	if _, err := tx.Exec(`
+		INSERT INTO public.sessions (id, user_id, user_agent, ip_address, expires_at)
+		VALUES ($1, $2, $3, $4, NOW() + $5 * INTERVAL '1 second')`,
+		sessionID, userID, userAgent, ipAddress, ttl); err != nil {
+		return "", "", err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO public.refresh_tokens (token_hash, session_id, expires_at)
+		VALUES ($1, $2, NOW() + $3 * INTERVAL '1 second')`,
+		hashToken(refreshToken), sessionID, ttl); err != nil {
+		return "", "", err
+	}
+	return sessionID, refreshToken, tx.Commit()
+}
+
+// Rotate exchanges a refresh token for a new one in the same session and
+// returns the session's user. Reusing a replaced token, or refreshing as a
+// suspended user, revokes the session.
+func (r *SessionRepository) Rotate(refreshToken, userAgent, ipAddress string) (*models.User, string, string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer tx.Rollback()
+
+	var sessionID string
+	var used, expired, revoked, suspended bool
+	user := &models.User{}
+	err = tx.QueryRow(`
+		SELECT t.session_id, t.used_at IS NOT NULL, t.expires_at <= NOW() OR s.expires_at <= NOW(),
+			s.revoked_at IS NOT NULL, u.user_id, u.role,
+			EXISTS (SELECT 1 FROM public.account_suspensions a WHERE a.user_id = u.user_id)
+		FROM public.refresh_tokens t
+		JOIN public.sessions s ON s.id = t.session_id
+		JOIN public.user u ON u.user_id = s.user_id
+		WHERE t.token_hash = $1
+		FOR UPDATE OF t, s`, hashToken(refreshToken)).Scan(&sessionID, &used, &expired, &revoked, &user.UserId, &user.Role, &suspended)
+	if err == sql.ErrNoRows {
+		return nil, "", "", ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, "", "", err
+	}
+	if revoked || expired {
+		return nil, "", "", ErrRefreshTokenInvalid
+	}
+	if used || suspended {
+		if _, err := tx.Exec("UPDATE public.sessions SET revoked_at = NOW() WHERE id = $1", sessionID); err != nil {
+			return nil, "", "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, "", "", err
+		}
+		if suspended {
+			return nil, "", "", ErrAccountSuspended
+		}
+		return nil, "", "", ErrRefreshTokenReused
+	}
+
+	next, err := randomToken(32)
+	if err != nil {
+		return nil, "", "", err
+	}
+	ttl := int64(r.refreshTTL / time.Second)
+	if _, err := tx.Exec("UPDATE public.refresh_tokens SET used_at = NOW() WHERE token_hash = $1", hashToken(refreshToken)); err != nil {
+		return nil, "", "", err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO public.refresh_tokens (token_hash, session_id, expires_at)
+		VALUES ($1, $2, NOW() + $3 * INTERVAL '1 second')`,
+		hashToken(next), sessionID, ttl); err != nil {
+		return nil, "", "", err
+	}
+	if _, err := tx.Exec(`
+		UPDATE public.sessions
+		SET last_used_at = NOW(), expires_at = NOW() + $2 * INTERVAL '1 second', user_agent = $3, ip_address = $4
+		WHERE id = $1`, sessionID, ttl, userAgent, ipAddress); err != nil {
+		return nil, "", "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, "", "", err
+	}
+	return user, sessionID, next, nil
+}
+
+// ListActive returns a user's sessions that are neither revoked nor expired,
+// most recently used first
+func (r *SessionRepository) ListActive(userID int) ([]models.Session, error) {
+	rows, err := r.db.Query(`
+		SELECT id, user_agent, ip_address, created_at, last_used_at, expires_at
+		FROM public.sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_used_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var s models.Session
+		var userAgent, ipAddress sql.NullString
+		if err := rows.Scan(&s.ID, &userAgent, &ipAddress, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		s.UserAgent = userAgent.String
+		s.IPAddress = ipAddress.String
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// Revoke ends one of a user's sessions
+func (r *SessionRepository) Revoke(userID int, sessionID string) error {
+	result, err := r.db.Exec(`
+		UPDATE public.sessions SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeAll ends every session of a user and returns how many were open
+func (r *SessionRepository) RevokeAll(userID int) (int64, error) {
+	result, err := r.db.Exec(`
+		UPDATE public.sessions SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// RevokeToken revokes a single access token until it expires. It reports
+// whether this call revoked it, so a single-use token is spent only once even
+// by concurrent requests; an expired or already revoked token reports false.
+func (r *SessionRepository) RevokeToken(claims *auth.Claims) (bool, error) {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return false, nil
+	}
+	remaining := time.Until(claims.ExpiresAt.Time)
+	if remaining <= 0 {
+		return false, nil
+	}
+	result, err := r.db.Exec(`
+		INSERT INTO public.revoked_tokens (jti, user_id, expires_at)
+		VALUES ($1, $2, NOW() + $3 * INTERVAL '1 second')
+		ON CONFLICT (jti) DO NOTHING`, claims.ID, claims.UserID, int64(remaining/time.Second)+1)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// IsRevoked reports whether an access token, or the session it was issued
+// in, has been revoked. A session that no longer exists counts as revoked.
+// It implements auth.RevocationList.
+func (r *SessionRepository) IsRevoked(claims *auth.Claims) (bool, error) {
+	if claims.ID == "" && claims.SessionID == "" {
+		return false, nil
+	}
+	var revoked bool
+	err := r.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM public.revoked_tokens WHERE jti = $1)
+			OR ($2 <> '' AND NOT EXISTS (SELECT 1 FROM public.sessions WHERE id = $2 AND revoked_at IS NULL))`,
+		claims.ID, claims.SessionID).Scan(&revoked)
+	return revoked, err
+}
+
+// DeleteExpired deletes sessions that expired or were revoked longer ago than
+// retention, with their refresh tokens, and revoked access tokens that have
+// expired. It returns how many sessions were deleted.
+func (r *SessionRepository) DeleteExpired(retention time.Duration) (int64, error) {
+	if _, err := r.db.Exec("DELETE FROM public.revoked_tokens WHERE expires_at < NOW()"); err != nil {
+		return 0, err
+	}
+	result, err := r.db.Exec(`
+		DELETE FROM public.sessions
+		WHERE LEAST(expires_at, COALESCE(revoked_at, expires_at)) < NOW() - $1 * INTERVAL '1 second'`,
+		int64(retention/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// randomToken returns size random bytes encoded for use in URLs and JSON
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// readableCode returns a random code for users to type: ten base32
+// characters, 50 bits, in two groups of five
+func readableCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	encoded := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+	return encoded[:5] + "-" + encoded[5:], nil
+}
+
+// normalizeCode ignores case, spaces and dashes in typed codes
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// hashToken is how refresh tokens are stored, they are random enough that a
+// plain SHA-256 cannot be reversed
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
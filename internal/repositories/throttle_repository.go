@@ -0,0 +1,204 @@
+package repositories
+
+import (
+	"database/sql"
+	"diploma/internal/models"
+	"errors"
+	"time"
+)
+
+// Subjects attempts are counted for
+const (
+	ThrottleIIN = "iin"
+	ThrottleIP  = "ip"
+)
+
+var ErrLockoutNotFound = errors.New("no lockout for this subject")
+
+// ThrottlePolicy limits failed authentication attempts
+type ThrottlePolicy struct {
+	// MaxFailures locks an IIN after this many failures in a row
+	MaxFailures int
+	// IPMaxFailures locks a client IP after this many failures, across IINs
+	IPMaxFailures int
+	// Window is how long failures are remembered without a new one
+	Window time.Duration
+	// Lockout is how long a locked IIN or IP stays locked
+	Lockout time.Duration
+	// DelayBase is the wait after the first failure, doubling with each
+	// further one up to DelayMax
+	DelayBase time.Duration
+	DelayMax  time.Duration
+}
+
+// LoginThrottleRepository counts failed logins, reset codes and password
+// changes per IIN and per client IP, slowing down and then locking out
+// whoever keeps failing
+type LoginThrottleRepository struct {
+	db     *sql.DB
+	policy ThrottlePolicy
+}
+
+func NewLoginThrottleRepository(db *sql.DB, policy ThrottlePolicy) *LoginThrottleRepository {
+	return &LoginThrottleRepository{db: db, policy: policy}
+}
+
+// Check returns how long the IIN and IP must wait before their next attempt,
+// and whether that is because one of them is locked out. An empty iin or ip
+// is not checked.
+func (r *LoginThrottleRepository) Check(iin, ip string) (time.Duration, bool, error) {
+	var wait time.Duration
+	var locked bool
+	for _, subject := range [][2]string{{ThrottleIIN, iin}, {ThrottleIP, ip}} {
+		if subject[1] == "" {
+			continue
+		}
+		var failures int
+		var sinceFailure, lockRemaining float64
+		err := r.db.QueryRow(`
+			SELECT failures, EXTRACT(EPOCH FROM NOW() - last_failure_at),
+				COALESCE(EXTRACT(EPOCH FROM locked_until - NOW()), 0)
+			FROM public.auth_throttle WHERE kind = $1 AND subject = $2`,
+			subject[0], subject[1]).Scan(&failures, &sinceFailure, &lockRemaining)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, false, err
+		}
+
+		if lockRemaining > 0 {
+			locked = true
+			wait = maxDuration(wait, seconds(lockRemaining))
+			continue
+		}
+		// Only IINs are slowed down, an IP shared by a whole clinic would stall everyone
+		if subject[0] == ThrottleIIN && failures > 0 && seconds(sinceFailure) < r.policy.Window {
+			wait = maxDuration(wait, r.delay(failures)-seconds(sinceFailure))
+		}
+	}
+	return wait, locked, nil
+}
+
+// delay is how long to wait after the given number of failures in a row
+func (r *LoginThrottleRepository) delay(failures int) time.Duration {
+	delay := r.policy.DelayBase
+	for i := 1; i < failures && delay < r.policy.DelayMax; i++ {
+		delay *= 2
+	}
+	if delay > r.policy.DelayMax {
+		delay = r.policy.DelayMax
+	}
+	return delay
+}
+
+// RecordFailure counts a failed attempt against the IIN and IP and locks
+// those over their limit. It reports whether this failure locked the IIN.
+func (r *LoginThrottleRepository) RecordFailure(iin, ip string) (bool, error) {
+	iinLocked := false
+	for _, subject := range []struct {
+		kind, value string
+		max         int
+	}{{ThrottleIIN, iin, r.policy.MaxFailures}, {ThrottleIP, ip, r.policy.IPMaxFailures}} {
+		if subject.value == "" {
+			continue
+		}
+		var lockedNow bool
+		err := r.db.QueryRow(`
+			INSERT INTO public.auth_throttle AS t (kind, subject, failures, last_failure_at)
+			VALUES ($1, $2, 1, NOW())
+			ON CONFLICT (kind, subject) DO UPDATE
+			SET failures = CASE
+					WHEN t.last_failure_at < NOW() - $3 * INTERVAL '1 second' OR t.locked_until <= NOW() THEN 1
+					ELSE t.failures + 1
+				END,
+				locked_until = CASE WHEN t.locked_until <= NOW() THEN NULL ELSE t.locked_until END,
+				last_failure_at = NOW()
+			RETURNING failures >= $4 AND locked_until IS NULL`,
+			subject.kind, subject.value, int64(r.policy.Window/time.Second), subject.max).Scan(&lockedNow)
+		if err != nil {
+			return false, err
+		}
+		if !lockedNow {
+			continue
+		}
+		if _, err := r.db.Exec(`
+			UPDATE public.auth_throttle SET locked_until = NOW() + $3 * INTERVAL '1 second'
+			WHERE kind = $1 AND subject = $2`,
+			subject.kind, subject.value, int64(r.policy.Lockout/time.Second)); err != nil {
+			return false, err
+		}
+		if subject.kind == ThrottleIIN {
+			iinLocked = true
+		}
+	}
+	return iinLocked, nil
+}
+
+// RecordSuccess clears the failures of an IIN. Those of the IP are kept, so
+// a valid account among many guesses does not hide credential stuffing.
+func (r *LoginThrottleRepository) RecordSuccess(iin string) error {
+	_, err := r.db.Exec(`
+		DELETE FROM public.auth_throttle
+		WHERE kind = 'iin' AND subject = $1 AND (locked_until IS NULL OR locked_until <= NOW())`, iin)
+	return err
+}
+
+// ListLocked returns the IINs and IPs currently locked out, longest remaining first
+func (r *LoginThrottleRepository) ListLocked() ([]models.Lockout, error) {
+	rows, err := r.db.Query(`
+		SELECT kind, subject, failures, last_failure_at, locked_until
+		FROM public.auth_throttle
+		WHERE locked_until > NOW()
+		ORDER BY locked_until DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lockouts := []models.Lockout{}
+	for rows.Next() {
+		var l models.Lockout
+		if err := rows.Scan(&l.Kind, &l.Subject, &l.Failures, &l.LastFailureAt, &l.LockedUntil); err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, l)
+	}
+	return lockouts, rows.Err()
+}
+
+// Unlock lifts a lockout and forgets the subject's failures
+func (r *LoginThrottleRepository) Unlock(kind, subject string) error {
+	result, err := r.db.Exec("DELETE FROM public.auth_throttle WHERE kind = $1 AND subject = $2", kind, subject)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrLockoutNotFound
+	}
+	return nil
+}
+
+// DeleteStale deletes counters that are no longer locked and whose last
+// failure is outside the window, and returns how many were deleted
+func (r *LoginThrottleRepository) DeleteStale() (int64, error) {
+	result, err := r.db.Exec(`
+		DELETE FROM public.auth_throttle
+		WHERE last_failure_at < NOW() - $1 * INTERVAL '1 second'
+		AND (locked_until IS NULL OR locked_until <= NOW())`, int64(r.policy.Window/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
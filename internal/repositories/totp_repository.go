@@ -0,0 +1,283 @@
+package repositories
+
+import (
+	"database/sql"
+	"diploma/internal/auth"
+	"diploma/internal/vault"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTOTPNotEnrolled    = errors.New("two-factor authentication is not set up")
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTOTPInvalidCode    = errors.New("invalid authentication code")
+	ErrTOTPLocked         = errors.New("too many invalid authentication codes, try again later")
+)
+
+// recoveryCodeCount is how many recovery codes a user is given at a time
+const recoveryCodeCount = 10
+
+// TOTPRepository stores TOTP second factors and recovery codes. Secrets are
+// encrypted under the master key. After maxAttempts invalid codes in a row
+// verification is locked until lockout has passed since the last one.
+type TOTPRepository struct {
+	db          *sql.DB
+	vault       *vault.Vault
+	maxAttempts int
+	lockout     time.Duration
+}
+
+func NewTOTPRepository(db *sql.DB, vault *vault.Vault, maxAttempts int, lockout time.Duration) *TOTPRepository {
+	return &TOTPRepository{db: db, vault: vault, maxAttempts: maxAttempts, lockout: lockout}
+}
+
+// IsEnabled reports whether a user has a confirmed TOTP second factor
+func (r *TOTPRepository) IsEnabled(userID int) (bool, error) {
+	var enabled bool
+	err := r.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM public.user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL)`,
+		userID).Scan(&enabled)
+	return enabled, err
+}
+
+// EverEnabled reports whether a user has ever confirmed a TOTP second
+// factor, including one since turned off
+func (r *TOTPRepository) EverEnabled(userID int) (bool, error) {
+	var enrolled bool
+	err := r.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM public.totp_enrollments WHERE user_id = $1)`,
+		userID).Scan(&enrolled)
+	return enrolled, err
+}
+
+// Enroll creates a new secret for a user, replacing one that was never
+// confirmed. It takes effect once confirmed with Confirm.
+func (r *TOTPRepository) Enroll(userID int) ([]byte, error) {
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := r.vault.Seal(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := r.db.Exec(`
+		INSERT INTO public.user_totp (user_id, encrypted_secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET encrypted_secret = EXCLUDED.encrypted_secret, created_at = NOW(),
+			last_used_step = 0, failed_attempts = 0, last_failed_at = NULL
+		WHERE public.user_totp.enabled_at IS NULL`, userID, sealed)
+	if err != nil {
+		return nil, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	return secret, nil
+}
+
+// Confirm enables a pending second factor with a code from the user's
+// authenticator and returns their first recovery codes
+func (r *TOTPRepository) Confirm(userID int, code string) ([]string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	state, err := r.lockState(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if state.enabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	if err := r.checkTOTP(tx, userID, state, code); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("UPDATE public.user_totp SET enabled_at = NOW() WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO public.totp_enrollments (user_id) VALUES ($1)
+		ON CONFLICT (user_id) DO NOTHING`, userID); err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// Verify checks a second factor: a code from the authenticator or an unused
+// recovery code, which is then spent. It reports whether a recovery code was used.
+func (r *TOTPRepository) Verify(userID int, code string) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	state, err := r.lockState(tx, userID)
+	if err != nil {
+		return false, err
+	}
+	if !state.enabled {
+		return false, ErrTOTPNotEnrolled
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) == auth.TOTPDigits {
+		if err := r.checkTOTP(tx, userID, state, code); err != nil {
+			return false, err
+		}
+		return false, tx.Commit()
+	}
+
+	if state.locked {
+		return false, ErrTOTPLocked
+	}
+	result, err := tx.Exec(`
+		UPDATE public.recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`, userID, hashToken(normalizeCode(code)))
+	if err != nil {
+		return false, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return false, r.fail(tx, userID, state)
+	}
+	if _, err := tx.Exec("UPDATE public.user_totp SET failed_attempts = 0 WHERE user_id = $1", userID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes, spent or not
+func (r *TOTPRepository) RegenerateRecoveryCodes(userID int) ([]string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// Disable removes a user's second factor and recovery codes
+func (r *TOTPRepository) Disable(userID int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM public.user_totp WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrTOTPNotEnrolled
+	}
+	if _, err := tx.Exec("DELETE FROM public.recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type totpState struct {
+	secret   []byte
+	enabled  bool
+	lastStep int64
+	failed   int
+	locked   bool
+}
+
+// lockState reads and locks a user's TOTP row. Failures older than the
+// lockout no longer count.
+func (r *TOTPRepository) lockState(tx *sql.Tx, userID int) (*totpState, error) {
+	var sealed []byte
+	var recentFailure bool
+	state := &totpState{}
+	err := tx.QueryRow(`
+		SELECT encrypted_secret, enabled_at IS NOT NULL, last_used_step, failed_attempts,
+			COALESCE(last_failed_at > NOW() - $2 * INTERVAL '1 second', false)
+		FROM public.user_totp WHERE user_id = $1
+		FOR UPDATE`, userID, int64(r.lockout/time.Second)).Scan(&sealed, &state.enabled, &state.lastStep, &state.failed, &recentFailure)
+	if err == sql.ErrNoRows {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !recentFailure {
+		state.failed = 0
+	}
+	state.locked = state.failed >= r.maxAttempts
+
+	state.secret, err = r.vault.Open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// checkTOTP validates an authenticator code, recording the step it used or
+// the failure
+func (r *TOTPRepository) checkTOTP(tx *sql.Tx, userID int, state *totpState, code string) error {
+	if state.locked {
+		return ErrTOTPLocked
+	}
+	step, ok := auth.ValidateTOTP(state.secret, code, time.Now(), state.lastStep)
+	if !ok {
+		return r.fail(tx, userID, state)
+	}
+	_, err := tx.Exec(`
+		UPDATE public.user_totp SET last_used_step = $2, failed_attempts = 0
+		WHERE user_id = $1`, userID, step)
+	return err
+}
+
+// fail counts an invalid code and commits, so the count survives the error
+func (r *TOTPRepository) fail(tx *sql.Tx, userID int, state *totpState) error {
+	if _, err := tx.Exec(`
+		UPDATE public.user_totp SET failed_attempts = $2, last_failed_at = NOW()
+		WHERE user_id = $1`, userID, state.failed+1); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return ErrTOTPInvalidCode
+}
+
+// replaceRecoveryCodes deletes a user's recovery codes and stores new ones
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM public.recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := readableCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		if _, err := tx.Exec(`
+			INSERT INTO public.recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			userID, hashToken(normalizeCode(code))); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
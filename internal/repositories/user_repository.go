@@ -2,18 +2,23 @@ package repositories
 
 import (
 	"database/sql"
+	"diploma/internal/auth"
 	"diploma/internal/models"
+	"diploma/internal/vault"
+	"errors"
 	"fmt"
+	"github.com/lib/pq"
 	"strconv"
 	"time"
 )
 
 type UserRepository struct {
-	db *sql.DB
+	db    *sql.DB
+	vault *vault.Vault
 }
 
-func NewUserRepository(db *sql.DB) *UserRepository {
-	return &UserRepository{db: db}
+func NewUserRepository(db *sql.DB, vault *vault.Vault) *UserRepository {
+	return &UserRepository{db: db, vault: vault}
 }
 
 func (r *UserRepository) GetUsers() ([]models.User, error) {
@@ -35,11 +40,10 @@ func (r *UserRepository) GetUsers() ([]models.User, error) {
 }
 
 func (r *UserRepository) GetUserByID(id int) (*models.User, error) {
-	fmt.Print(id)
 	row := r.db.QueryRow("SELECT * FROM public.user WHERE user_id=$1", id)
 
 	var user models.User
-	if err := row.Scan(&user.UserId, &user.FirstName, &user.LastName, &user.Email, &user.PhoneNumber, &user.Iin, &user.Role, &user.BiometricDataHash, &user.CreatedAt, &user.Password, &user.PasswordChanged); err != nil {
+	if err := row.Scan(&user.UserId, &user.FirstName, &user.LastName, &user.Email, &user.PhoneNumber, &user.Iin, &user.Role, &user.BiometricDataHash, &user.CreatedAt, &user.Password, &user.PasswordChanged, &user.Gender, &user.Photo); err != nil {
 		return nil, err
 	}
 	return &user, nil
@@ -59,7 +63,7 @@ func (r *UserRepository) GetUserByEmail(email string) (*models.User, error) {
 	row := r.db.QueryRow("SELECT * FROM public.user WHERE email=$1", email)
 
 	var user models.User
-	if err := row.Scan(&user.UserId, &user.FirstName, &user.LastName, &user.Email, &user.PhoneNumber, &user.Iin, &user.Role, &user.BiometricDataHash, &user.CreatedAt, &user.Password, &user.PasswordChanged, &user.Gender); err != nil {
+	if err := row.Scan(&user.UserId, &user.FirstName, &user.LastName, &user.Email, &user.PhoneNumber, &user.Iin, &user.Role, &user.BiometricDataHash, &user.CreatedAt, &user.Password, &user.PasswordChanged, &user.Gender, &user.Photo); err != nil {
 		return nil, err
 	}
 	return &user, nil
@@ -118,13 +122,20 @@ func (r *UserRepository) CreateUser(user *models.UserRequest) error {
 			return fmt.Errorf("doctor details are required")
 		}
 		user.DoctorDetails.UserId = user.UserId
+		var doctorID int
 		err = tx.QueryRow(
 			"INSERT INTO public.doctor (user_id, specialization) VALUES ($1, $2) RETURNING doctor_id",
 			user.DoctorDetails.UserId, user.DoctorDetails.Specialization,
-		).Scan(&user.DoctorDetails.DoctorId)
+		).Scan(&doctorID)
 		if err != nil {
 			return err
 		}
+		user.DoctorDetails.DoctorId = strconv.Itoa(doctorID)
+
+		// Give the doctor a signing key for the blockchain
+		if _, err = createDoctorKey(tx, r.vault, doctorID); err != nil {
+			return err
+		}
 	}
 
 	return tx.Commit()
@@ -150,39 +161,62 @@ func (r *UserRepository) DeleteDoctor(id int) error {
 	return err
 }
 
-func (r *UserRepository) UpdatePassword(iin string, password string) error {
-	_, err := r.db.Exec("UPDATE public.user SET password = $1, password_changed = true WHERE iin = $2", password, iin)
-	return err
+// UpdatePassword sets a password chosen by the user and records it in their
+// password history
+func (r *UserRepository) UpdatePassword(userID int, password string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setPassword(tx, userID, password); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (r *UserRepository) StoreOTP(iin string, otp string, expiresAt time.Time) error {
-	_, err := r.db.Exec("INSERT INTO public.otp_verification (iin, otp, expires_at) VALUES ($1, $2, $3) ON CONFLICT (iin) DO UPDATE SET otp = $2, expires_at = $3", iin, otp, expiresAt)
+// setPassword sets a password chosen by the user and records it in their
+// password history
+func setPassword(tx *sql.Tx, userID int, password string) error {
+	if _, err := tx.Exec("UPDATE public.user SET password = $1, password_changed = true WHERE user_id = $2", password, userID); err != nil {
+		return err
+	}
+	_, err := tx.Exec("INSERT INTO public.password_history (user_id, password_hash) VALUES ($1, $2)", userID, password)
 	return err
 }
 
-func (r *UserRepository) VerifyOTP(iin string, otp string) (bool, error) {
-	var storedOTP string
-	var expiresAt time.Time
-	err := r.db.QueryRow("SELECT otp, expires_at FROM public.otp_verification WHERE iin = $1", iin).Scan(&storedOTP, &expiresAt)
+// PasswordHistory returns the hashes of a user's latest n passwords, newest first
+func (r *UserRepository) PasswordHistory(userID, n int) ([]string, error) {
+	rows, err := r.db.Query(`
+		SELECT password_hash FROM public.password_history
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2`, userID, n)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
+	defer rows.Close()
 
-	if time.Now().After(expiresAt) {
-		return false, nil
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
 	}
-
-	return storedOTP == otp, nil
-}
-
-func (r *UserRepository) DeleteOTP(iin string) error {
-	_, err := r.db.Exec("DELETE FROM public.otp_verification WHERE iin = $1", iin)
-	return err
+	return hashes, rows.Err()
 }
 
-func (r *UserRepository) ResetPassword(iin string, newPassword string) error {
-	_, err := r.db.Exec("UPDATE public.user SET password = $1, password_changed = false WHERE iin = $2", newPassword, iin)
-	return err
+// PasswordChangedAt returns when a user last set their password, or when the
+// account was created if they never have
+func (r *UserRepository) PasswordChangedAt(userID int) (time.Time, error) {
+	var changedAt time.Time
+	err := r.db.QueryRow(`
+		SELECT COALESCE((SELECT MAX(created_at) FROM public.password_history WHERE user_id = u.user_id), u.created_at)
+		FROM public.user u WHERE u.user_id = $1`, userID).Scan(&changedAt)
+	return changedAt, err
 }
 
 func (r *UserRepository) SetPasswordChanged(iin string, changed bool) error {
@@ -190,41 +224,6 @@ func (r *UserRepository) SetPasswordChanged(iin string, changed bool) error {
 	return err
 }
 
-// CreateOTPVerification creates a new OTP verification record
-func (r *UserRepository) CreateOTPVerification(otp *models.OTPVerification) error {
-	query := `
-		INSERT INTO otp_verifications (iin, otp, expires_at)
-		VALUES ($1, $2, $3)
-	`
-	_, err := r.db.Exec(query, otp.Iin, otp.OTP, otp.ExpiresAt)
-	return err
-}
-
-// GetOTPVerification retrieves an OTP verification record by IIN
-func (r *UserRepository) GetOTPVerification(iin string) (*models.OTPVerification, error) {
-	query := `
-		SELECT iin, otp, expires_at
-		FROM otp_verifications
-		WHERE iin = $1
-	`
-	var otp models.OTPVerification
-	err := r.db.QueryRow(query, iin).Scan(&otp.Iin, &otp.OTP, &otp.ExpiresAt)
-	if err != nil {
-		return nil, err
-	}
-	return &otp, nil
-}
-
-// DeleteOTPVerification deletes an OTP verification record by IIN
-func (r *UserRepository) DeleteOTPVerification(iin string) error {
-	query := `
-		DELETE FROM otp_verifications
-		WHERE iin = $1
-	`
-	_, err := r.db.Exec(query, iin)
-	return err
-}
-
 // GetDoctorByID retrieves a doctor by their ID
 func (r *UserRepository) GetDoctorByID(doctorID int) (*models.Doctor, error) {
 	row := r.db.QueryRow("SELECT * FROM public.doctor WHERE doctor_id=$1", doctorID)
@@ -276,9 +275,54 @@ func (r *UserRepository) GetPatientByUserID(userID int) (*models.Patient, error)
 	return &patient, nil
 }
 
-func (r *UserRepository) UpdateUserPhoto(userID int, photo []byte) error {
-	_, err := r.db.Exec("UPDATE public.user SET photo = $1 WHERE user_id = $2", photo, userID)
-	return err
+// How a face photo was enrolled
+const (
+	FaceEnrolledWithAccessToken = "access_token"
+	FaceEnrolledOnRegistration  = "registration"
+)
+
+var ErrFaceAlreadyEnrolled = errors.New("a photo is already enrolled for this user")
+
+// EnrollPhoto stores the face photo a user enrolled themselves. It replaces a
+// photo that was never enrolled this way, but not an enrolled one.
+func (r *UserRepository) EnrollPhoto(userID int, photo []byte, method string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		INSERT INTO public.face_enrollments (user_id, method) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO NOTHING`, userID, method)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrFaceAlreadyEnrolled
+	}
+	result, err = tx.Exec("UPDATE public.user SET photo = $1 WHERE user_id = $2", photo, userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrUserNotFound
+	}
+	return tx.Commit()
+}
+
+// GetEnrolledPhoto returns the face photo a user enrolled themselves, nil if
+// there is none. Photos uploaded without authentication are not returned.
+func (r *UserRepository) GetEnrolledPhoto(userID int) ([]byte, error) {
+	var photo []byte
+	err := r.db.QueryRow(`
+		SELECT u.photo FROM public.user u
+		JOIN public.face_enrollments e ON e.user_id = u.user_id
+		WHERE u.user_id = $1`, userID).Scan(&photo)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return photo, err
 }
 
 func (r *UserRepository) CreateAccessRequest(doctorID int, patientIIN string) (*models.AccessRequest, error) {
@@ -325,7 +369,7 @@ func (r *UserRepository) GetDoctorIDByUserID(userID int) (int, error) {
 func (r *UserRepository) GetDoctorAccessRequests(doctorID int) ([]models.AccessRequest, error) {
 	rows, err := r.db.Query(`
 		SELECT ar.id, ar.doctor_id, ar.patient_id, ar.status, ar.created_at, ar.expires_at, 
-		       ar.access_granted_at, ar.access_expires_at
+		       ar.access_granted_at, ar.access_expires_at, ar.scopes
 		FROM access_requests ar
 		WHERE ar.doctor_id = $1 
 		AND (
@@ -352,6 +396,7 @@ func (r *UserRepository) GetDoctorAccessRequests(doctorID int) ([]models.AccessR
 			&request.ExpiresAt,
 			&accessGrantedAt,
 			&accessExpiresAt,
+			pq.Array(&request.Scopes),
 		)
 		if err != nil {
 			return nil, err
@@ -370,7 +415,7 @@ func (r *UserRepository) GetDoctorAccessRequests(doctorID int) ([]models.AccessR
 func (r *UserRepository) GetPatientAccessRequests(patientID int) ([]models.AccessRequest, error) {
 	rows, err := r.db.Query(`
 		SELECT ar.id, ar.doctor_id, ar.patient_id, ar.status, ar.created_at, ar.expires_at, 
-		       ar.access_granted_at, ar.access_expires_at
+		       ar.access_granted_at, ar.access_expires_at, ar.scopes
 		FROM access_requests ar
 		WHERE ar.patient_id = $1 
 		AND (
@@ -397,6 +442,7 @@ func (r *UserRepository) GetPatientAccessRequests(patientID int) ([]models.Acces
 			&request.ExpiresAt,
 			&accessGrantedAt,
 			&accessExpiresAt,
+			pq.Array(&request.Scopes),
 		)
 		if err != nil {
 			return nil, err
@@ -412,6 +458,261 @@ func (r *UserRepository) GetPatientAccessRequests(patientID int) ([]models.Acces
 	return requests, nil
 }
 
+// ExpireAccessRequests marks pending requests whose answer window has passed
+// and grants whose access period has ended as expired, and returns how many
+// were marked
+func (r *UserRepository) ExpireAccessRequests() (int64, error) {
+	result, err := r.db.Exec(`
+		UPDATE access_requests SET status = 'expired'
+		WHERE (status = 'pending' AND expires_at <= NOW())
+		OR (status = 'granted' AND access_expires_at <= NOW())`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// WarnExpiringAccess marks granted access that expires within the given time
+// as warned, which notifies the parties, and returns how many were marked
+func (r *UserRepository) WarnExpiringAccess(within time.Duration) (int64, error) {
+	result, err := r.db.Exec(`
+		UPDATE access_requests SET expiry_warned_at = NOW()
+		WHERE status = 'granted' AND expiry_warned_at IS NULL
+		AND access_expires_at > NOW()
+		AND access_expires_at <= NOW() + $1 * INTERVAL '1 second'`, int64(within/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteClosedAccessRequests deletes expired, rejected and revoked requests
+// that closed longer ago than retention, and returns how many were deleted
+func (r *UserRepository) DeleteClosedAccessRequests(retention time.Duration) (int64, error) {
+	result, err := r.db.Exec(`
+		DELETE FROM access_requests
+		WHERE status IN ('expired', 'rejected', 'revoked')
+		AND COALESCE(access_expires_at, expires_at) < NOW() - $1 * INTERVAL '1 second'`, int64(retention/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+var (
+	ErrUserNotFound     = errors.New("user not found")
+	ErrDoctorNotFound   = errors.New("user is not a doctor")
+	ErrAccountSuspended = errors.New("account is suspended")
+	ErrNotSuspended     = errors.New("account is not suspended")
+)
+
+// UpdateSpecialization changes the specialization of the doctor with the given user ID
+func (r *UserRepository) UpdateSpecialization(userID int, specialization string) error {
+	result, err := r.db.Exec("UPDATE public.doctor SET specialization = $1 WHERE user_id = $2", specialization, userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrDoctorNotFound
+	}
+	return nil
+}
+
+// Suspend bars a user from logging in. Suspending a suspended user keeps
+// the original suspension.
+func (r *UserRepository) Suspend(userID, adminID int, reason string) error {
+	_, err := r.db.Exec(`
+		INSERT INTO public.account_suspensions (user_id, reason, suspended_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO NOTHING`, userID, reason, adminID)
+	return err
+}
+
+// Reactivate lifts a user's suspension
+func (r *UserRepository) Reactivate(userID int) error {
+	result, err := r.db.Exec("DELETE FROM public.account_suspensions WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrNotSuspended
+	}
+	return nil
+}
+
+// GetSuspension returns a user's suspension, or nil if they are not suspended
+func (r *UserRepository) GetSuspension(userID int) (*models.Suspension, error) {
+	var s models.Suspension
+	var suspendedBy sql.NullInt64
+	err := r.db.QueryRow(`
+		SELECT user_id, reason, suspended_by, suspended_at
+		FROM public.account_suspensions WHERE user_id = $1`, userID).Scan(&s.UserID, &s.Reason, &suspendedBy, &s.SuspendedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if suspendedBy.Valid {
+		id := int(suspendedBy.Int64)
+		s.SuspendedBy = &id
+	}
+	return &s, nil
+}
+
+// ForcePasswordReset replaces a user's password with a random one nobody
+// knows, so they can only get in again through a password reset
+func (r *UserRepository) ForcePasswordReset(userID int) error {
+	random, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	hash, err := auth.HashPassword(random)
+	if err != nil {
+		return err
+	}
+	result, err := r.db.Exec("UPDATE public.user SET password = $1, password_changed = false WHERE user_id = $2", hash, userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// Errors returned by UpdateAccessRequestStatus
+var (
+	ErrAccessRequestNotFound  = errors.New("access request not found")
+	ErrAccessRequestNotOwned  = errors.New("access request belongs to another patient")
+	ErrAccessRequestExpired   = errors.New("access request has expired")
+	ErrInvalidAccessStatus    = errors.New("invalid access request status")
+	ErrAccessStatusTransition = errors.New("access request cannot change to this status")
+)
+
+// accessTransitions lists the statuses a patient may move a request to from
+// each status. Expired is set by the server, never by the patient.
+var accessTransitions = map[string][]string{
+	models.AccessStatusPending: {models.AccessStatusGranted, models.AccessStatusRejected},
+	models.AccessStatusGranted: {models.AccessStatusRevoked},
+}
+
+// UpdateAccessRequestStatus lets a patient answer or revoke one of their
+// access requests. Granting opens access to the record categories in scopes,
+// or to all of them if scopes is empty, for grantDuration. A request whose
+// answer window or access period has passed is marked expired and
+// ErrAccessRequestExpired is returned.
+func (r *UserRepository) UpdateAccessRequestStatus(requestID, patientID int, status string, scopes []string, grantDuration time.Duration) (*models.AccessRequest, error) {
+	switch status {
+	case models.AccessStatusGranted, models.AccessStatusRejected, models.AccessStatusRevoked:
+	default:
+		return nil, ErrInvalidAccessStatus
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Times are stored without a zone, so expiry is decided by the database clock
+	var request models.AccessRequest
+	var accessGrantedAt, accessExpiresAt sql.NullTime
+	var expired bool
+	err = tx.QueryRow(`
+		SELECT id, doctor_id, patient_id, status, created_at, expires_at, access_granted_at, access_expires_at, scopes,
+		       CASE status
+		           WHEN 'pending' THEN expires_at <= NOW()
+		           WHEN 'granted' THEN access_expires_at IS NULL OR access_expires_at <= NOW()
+		           ELSE FALSE
+		       END
+		FROM access_requests
+		WHERE id = $1
+		FOR UPDATE`, requestID).Scan(
+		&request.ID,
+		&request.DoctorID,
+		&request.PatientID,
+		&request.Status,
+		&request.CreatedAt,
+		&request.ExpiresAt,
+		&accessGrantedAt,
+		&accessExpiresAt,
+		pq.Array(&request.Scopes),
+		&expired,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrAccessRequestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if request.PatientID != patientID {
+		return nil, ErrAccessRequestNotOwned
+	}
+
+	if expired {
+		if _, err := tx.Exec("UPDATE access_requests SET status = 'expired' WHERE id = $1", requestID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrAccessRequestExpired
+	}
+	if request.Status == models.AccessStatusExpired {
+		return nil, ErrAccessRequestExpired
+	}
+
+	allowed := false
+	for _, next := range accessTransitions[request.Status] {
+		if next == status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, fmt.Errorf("%w: %s to %s", ErrAccessStatusTransition, request.Status, status)
+	}
+
+	switch status {
+	case models.AccessStatusGranted:
+		// NULL scopes grant every category
+		var grantedScopes interface{}
+		if len(scopes) > 0 {
+			grantedScopes = pq.Array(scopes)
+		}
+		err = tx.QueryRow(`
+			UPDATE access_requests
+			SET status = 'granted', access_granted_at = NOW(), access_expires_at = NOW() + $2 * INTERVAL '1 second', scopes = $3
+			WHERE id = $1
+			RETURNING status, access_granted_at, access_expires_at, scopes`,
+			requestID, int64(grantDuration/time.Second), grantedScopes).Scan(&request.Status, &accessGrantedAt, &accessExpiresAt, pq.Array(&request.Scopes))
+	case models.AccessStatusRevoked:
+		err = tx.QueryRow(`
+			UPDATE access_requests SET status = 'revoked', access_expires_at = NOW()
+			WHERE id = $1
+			RETURNING status, access_expires_at`, requestID).Scan(&request.Status, &accessExpiresAt)
+	case models.AccessStatusRejected:
+		err = tx.QueryRow(`
+			UPDATE access_requests SET status = 'rejected'
+			WHERE id = $1
+			RETURNING status`, requestID).Scan(&request.Status)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if accessGrantedAt.Valid {
+		request.AccessGrantedAt = accessGrantedAt.Time
+	}
+	if accessExpiresAt.Valid {
+		request.AccessExpiresAt = accessExpiresAt.Time
+	}
+	return &request, nil
+}
+
 func (r *UserRepository) GetPatientIDByUserID(userID int) (int, error) {
 	var patientID int
 	err := r.db.QueryRow("SELECT patient_id FROM patient WHERE user_id = $1", userID).Scan(&patientID)
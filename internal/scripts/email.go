@@ -1,8 +1,8 @@
 package scripts
 
 import (
+	"fmt"
 	"gopkg.in/gomail.v2"
-	"log"
 )
 
 func SendMail(to string, subject string, body string) error {
@@ -29,8 +29,7 @@ func SendMail(to string, subject string, body string) error {
 
 	// Send the email
 	if err := d.DialAndSend(m); err != nil {
-		log.Fatal("Could not send email: ", err)
-		return err
+		return fmt.Errorf("could not send email: %v", err)
 	}
 	return nil
 }
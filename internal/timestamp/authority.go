@@ -0,0 +1,233 @@
+package timestamp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// LocalPolicy is the policy OID of tokens issued by Authority, under the
+// arc reserved for examples so it is never mistaken for a real TSA policy
+var LocalPolicy = asn1.ObjectIdentifier{2, 999, 3161}
+
+var (
+	oidExtKeyUsage  = asn1.ObjectIdentifier{2, 5, 29, 37}
+	oidTimeStamping = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 8}
+)
+
+// Authority is a minimal RFC 3161 time-stamp authority that signs with an
+// ECDSA P-256 key and a self-signed certificate. It stands in for a real TSA
+// in development and tests and serves requests over HTTP.
+type Authority struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+// NewAuthority creates an authority for key. If cert is nil a self-signed
+// certificate is issued; keep it, clients need it to verify old tokens.
+func NewAuthority(key *ecdsa.PrivateKey, cert *x509.Certificate) (*Authority, error) {
+	if cert != nil {
+		if !key.PublicKey.Equal(cert.PublicKey) {
+			return nil, errors.New("certificate does not match the authority key")
+		}
+		return &Authority{key: key, cert: cert}, nil
+	}
+
+	// RFC 3161 requires a critical extended key usage of time-stamping only,
+	// the x509 package marks ExtKeyUsage non-critical
+	extKeyUsage, err := asn1.Marshal([]asn1.ObjectIdentifier{oidTimeStamping})
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Local Time-Stamp Authority"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtraExtensions:       []pkix.Extension{{Id: oidExtKeyUsage, Critical: true, Value: extKeyUsage}},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		return nil, err
+	}
+	return &Authority{key: key, cert: cert}, nil
+}
+
+// Certificate returns the authority's self-signed certificate, to be trusted by clients
+func (a *Authority) Certificate() *x509.Certificate {
+	return a.cert
+}
+
+// ServeHTTP answers a DER TimeStampReq with a DER TimeStampResp
+func (a *Authority) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxResponseSize))
+	if err != nil {
+		http.Error(w, "failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	reply, err := asn1.Marshal(a.respond(body))
+	if err != nil {
+		log.Printf("Failed to encode time-stamp response: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeReply)
+	w.Write(reply)
+}
+
+func (a *Authority) respond(body []byte) timeStampResp {
+	var request timeStampReq
+	if rest, err := asn1.Unmarshal(body, &request); err != nil || len(rest) > 0 {
+		return rejection(failureBadDataFormat, "malformed request")
+	}
+	if request.Version != 1 {
+		return rejection(failureBadRequest, "unsupported request version")
+	}
+	if !request.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) || len(request.MessageImprint.HashedMessage) != sha256.Size {
+		return rejection(failureBadAlg, "only SHA-256 message imprints are supported")
+	}
+
+	token, err := a.issue(request)
+	if err != nil {
+		log.Printf("Failed to issue time-stamp token: %v", err)
+		return rejection(failureSystemFailure, "failed to issue token")
+	}
+	return timeStampResp{
+		Status:         pkiStatusInfo{Status: statusGranted},
+		TimeStampToken: asn1.RawValue{FullBytes: token},
+	}
+}
+
+func rejection(failure int, reason string) timeStampResp {
+	failInfo := asn1.BitString{Bytes: make([]byte, failure/8+1), BitLength: failure + 1}
+	failInfo.Bytes[failure/8] = 0x80 >> (failure % 8)
+	return timeStampResp{Status: pkiStatusInfo{
+		Status:       statusRejection,
+		StatusString: []string{reason},
+		FailInfo:     failInfo,
+	}}
+}
+
+// issue builds a CMS SignedData token over a TSTInfo for the request
+func (a *Authority) issue(request timeStampReq) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	if err != nil {
+		return nil, err
+	}
+	tst, err := asn1.Marshal(tstInfo{
+		Version:        1,
+		Policy:         LocalPolicy,
+		MessageImprint: request.MessageImprint,
+		SerialNumber:   serial,
+		GenTime:        time.Now().UTC().Truncate(time.Second),
+		Accuracy:       accuracy{Seconds: 1},
+		Nonce:          request.Nonce,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(tst)
+	certHash := sha256.Sum256(a.cert.Raw)
+	attributes, err := encodeAttributes(
+		oidContentType, oidTSTInfo,
+		oidMessageDigest, digest[:],
+		oidSigningCertificateV2, signingCertificateV2{Certs: []essCertIDv2{{CertHash: certHash[:]}}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: attributes})
+	if err != nil {
+		return nil, err
+	}
+
+	sid, err := asn1.Marshal(issuerAndSerialNumber{
+		Issuer:       asn1.RawValue{FullBytes: a.cert.RawIssuer},
+		SerialNumber: a.cert.SerialNumber,
+	})
+	if err != nil {
+		return nil, err
+	}
+	signedDigest := sha256.Sum256(signed)
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, signedDigest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	sha256Algorithm := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	sd, err := asn1.Marshal(signedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+		EncapContentInfo: encapsulatedContentInfo{EContentType: oidTSTInfo, EContent: tst},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: a.cert.Raw},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm:    sha256Algorithm,
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attributes},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+			Signature:          signature,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd},
+	})
+}
+
+// encodeAttributes encodes (type, value) pairs as the contents of a DER SET
+// OF Attribute, each with a single value
+func encodeAttributes(pairs ...interface{}) ([]byte, error) {
+	var encoded [][]byte
+	for i := 0; i < len(pairs); i += 2 {
+		value, err := asn1.Marshal(pairs[i+1])
+		if err != nil {
+			return nil, err
+		}
+		attr, err := asn1.Marshal(attribute{
+			Type:   pairs[i].(asn1.ObjectIdentifier),
+			Values: []asn1.RawValue{{FullBytes: value}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, attr)
+	}
+
+	// DER orders the elements of a SET OF by their encoding
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+	return bytes.Join(encoded, nil), nil
+}
@@ -0,0 +1,105 @@
+package timestamp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxResponseSize bounds the time-stamp response read from an authority
+const maxResponseSize = 1 << 20
+
+// Client requests time-stamp tokens from an RFC 3161 authority over HTTP
+type Client struct {
+	url        string
+	roots      *x509.CertPool
+	httpClient *http.Client
+}
+
+// NewClient creates a client for the authority at url. Tokens must chain to
+// roots, or if roots is nil, to the certificate the authority embeds.
+func NewClient(url string, roots *x509.CertPool) *Client {
+	return &Client{
+		url:        url,
+		roots:      roots,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// URL returns the address of the time-stamp authority
+func (c *Client) URL() string {
+	return c.url
+}
+
+// Timestamp obtains a verified token for a SHA-256 digest
+func (c *Client) Timestamp(digest []byte) (*Token, error) {
+	if len(digest) != sha256.Size {
+		return nil, fmt.Errorf("digest must be %d bytes, got %d", sha256.Size, len(digest))
+	}
+
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	request, err := asn1.Marshal(timeStampReq{
+		Version: 1,
+		MessageImprint: messageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: digest,
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Post(c.url, contentTypeQuery, bytes.NewReader(request))
+	if err != nil {
+		return nil, fmt.Errorf("time-stamp request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("time-stamp authority returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read time-stamp response: %v", err)
+	}
+
+	var reply timeStampResp
+	if _, err := asn1.Unmarshal(body, &reply); err != nil {
+		return nil, fmt.Errorf("malformed time-stamp response: %v", err)
+	}
+	if reply.Status.Status != statusGranted && reply.Status.Status != statusGrantedWithMods {
+		return nil, fmt.Errorf("time-stamp request rejected with status %d: %s",
+			reply.Status.Status, strings.Join(reply.Status.StatusString, "; "))
+	}
+	if len(reply.TimeStampToken.FullBytes) == 0 {
+		return nil, errors.New("time-stamp response has no token")
+	}
+
+	token, err := Verify(reply.TimeStampToken.FullBytes, digest, c.roots)
+	if err != nil {
+		return nil, err
+	}
+	if token.Nonce == nil || token.Nonce.Cmp(nonce) != 0 {
+		return nil, errors.New("time-stamp token does not echo the request nonce")
+	}
+	return token, nil
+}
+
+// Verify checks a stored token against a SHA-256 digest with the client's roots
+func (c *Client) Verify(der, digest []byte) (*Token, error) {
+	return Verify(der, digest, c.roots)
+}
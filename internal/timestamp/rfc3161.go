@@ -0,0 +1,383 @@
+// Package timestamp requests and verifies RFC 3161 time-stamp tokens, and
+// provides a minimal local time-stamp authority for development and tests.
+package timestamp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+var (
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidSignedData           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningCertificateV2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECPublicKey     = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// PKIStatus values and PKIFailureInfo bits of a time-stamp response
+const (
+	statusGranted         = 0
+	statusGrantedWithMods = 1
+	statusRejection       = 2
+
+	failureBadAlg        = 0
+	failureBadRequest    = 2
+	failureBadDataFormat = 5
+	failureSystemFailure = 25
+)
+
+// Media types of time-stamp requests and responses sent over HTTP (RFC 3161 section 3.4)
+const (
+	contentTypeQuery = "application/timestamp-query"
+	contentTypeReply = "application/timestamp-reply"
+)
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional,default:false"`
+	Extensions     []pkix.Extension      `asn1:"optional,tag:0"`
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional,utf8"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue // [0] EXPLICIT, the tag is part of the raw value
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapsulatedContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type encapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,tag:0"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue // IssuerAndSerialNumber or [0] SubjectKeyIdentifier
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type essCertIDv2 struct {
+	CertHash []byte // SHA-256, the default hash algorithm
+}
+
+type signingCertificateV2 struct {
+	Certs []essCertIDv2
+}
+
+type accuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time        `asn1:"generalized"`
+	Accuracy       accuracy         `asn1:"optional"`
+	Ordering       bool             `asn1:"optional,default:false"`
+	Nonce          *big.Int         `asn1:"optional"`
+	TSA            asn1.RawValue    `asn1:"optional,tag:0"`
+	Extensions     []pkix.Extension `asn1:"optional,tag:1"`
+}
+
+// Token is a time-stamp token whose signature has been verified
+type Token struct {
+	Raw           []byte // DER encoding of the token, a CMS ContentInfo
+	GenTime       time.Time
+	SerialNumber  *big.Int
+	Policy        asn1.ObjectIdentifier
+	HashedMessage []byte
+	Nonce         *big.Int
+	Certificate   *x509.Certificate // Certificate of the authority that signed the token
+}
+
+// Verify parses a DER time-stamp token and checks that it was signed by a
+// time-stamping certificate and that it covers the given SHA-256 digest.
+// If roots is nil the certificate embedded in the token is trusted as is,
+// otherwise it must chain to one of roots.
+func Verify(der, digest []byte, roots *x509.CertPool) (*Token, error) {
+	token, err := parseToken(der, roots)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(token.HashedMessage, digest) {
+		return nil, errors.New("time-stamp token covers a different digest")
+	}
+	return token, nil
+}
+
+func parseToken(der []byte, roots *x509.CertPool) (*Token, error) {
+	var info contentInfo
+	if rest, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("malformed time-stamp token: %v", err)
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after time-stamp token")
+	}
+	if !info.ContentType.Equal(oidSignedData) || info.Content.Class != asn1.ClassContextSpecific || info.Content.Tag != 0 {
+		return nil, errors.New("time-stamp token is not CMS signed data")
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("malformed signed data: %v", err)
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return nil, errors.New("signed data does not contain TSTInfo")
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("time-stamp token has %d signers, expected 1", len(sd.SignerInfos))
+	}
+
+	var tst tstInfo
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent, &tst); err != nil {
+		return nil, fmt.Errorf("malformed TSTInfo: %v", err)
+	}
+	if !tst.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) {
+		return nil, errors.New("time-stamp token does not use SHA-256")
+	}
+
+	var certificates []*x509.Certificate
+	if len(sd.Certificates.Bytes) > 0 {
+		var err error
+		if certificates, err = x509.ParseCertificates(sd.Certificates.Bytes); err != nil {
+			return nil, fmt.Errorf("malformed certificates: %v", err)
+		}
+	}
+
+	signer := sd.SignerInfos[0]
+	cert, err := signerCertificate(signer, certificates)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSignerInfo(signer, cert, sd.EncapContentInfo.EContent); err != nil {
+		return nil, err
+	}
+	if err := checkTimeStampingCertificate(cert, certificates, roots, tst.GenTime); err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		Raw:           der,
+		GenTime:       tst.GenTime,
+		SerialNumber:  tst.SerialNumber,
+		Policy:        tst.Policy,
+		HashedMessage: tst.MessageImprint.HashedMessage,
+		Nonce:         tst.Nonce,
+		Certificate:   cert,
+	}, nil
+}
+
+// signerCertificate finds the certificate named by a signer's identifier
+func signerCertificate(signer signerInfo, certificates []*x509.Certificate) (*x509.Certificate, error) {
+	if signer.SID.Class == asn1.ClassContextSpecific && signer.SID.Tag == 0 {
+		for _, cert := range certificates {
+			if bytes.Equal(cert.SubjectKeyId, signer.SID.Bytes) {
+				return cert, nil
+			}
+		}
+		return nil, errors.New("signer certificate not included in time-stamp token")
+	}
+
+	var sid issuerAndSerialNumber
+	if _, err := asn1.Unmarshal(signer.SID.FullBytes, &sid); err != nil {
+		return nil, fmt.Errorf("malformed signer identifier: %v", err)
+	}
+	for _, cert := range certificates {
+		if cert.SerialNumber.Cmp(sid.SerialNumber) == 0 && bytes.Equal(cert.RawIssuer, sid.Issuer.FullBytes) {
+			return cert, nil
+		}
+	}
+	return nil, errors.New("signer certificate not included in time-stamp token")
+}
+
+// checkSignerInfo checks the signed attributes against the content and the
+// signature over the signed attributes against the certificate
+func checkSignerInfo(signer signerInfo, cert *x509.Certificate, content []byte) error {
+	if len(signer.SignedAttrs.Bytes) == 0 {
+		return errors.New("time-stamp token has no signed attributes")
+	}
+
+	hash, ok := hashFor(signer.DigestAlgorithm.Algorithm)
+	if !ok {
+		return fmt.Errorf("unsupported digest algorithm %v", signer.DigestAlgorithm.Algorithm)
+	}
+
+	// The signature covers the attributes encoded as a SET, not with their [0] tag
+	signed := append([]byte{}, signer.SignedAttrs.FullBytes...)
+	signed[0] = 0x31
+
+	var attributes []attribute
+	if _, err := asn1.UnmarshalWithParams(signed, &attributes, "set"); err != nil {
+		return fmt.Errorf("malformed signed attributes: %v", err)
+	}
+	var contentType asn1.ObjectIdentifier
+	var messageDigest []byte
+	for _, attr := range attributes {
+		if len(attr.Values) != 1 {
+			continue
+		}
+		switch {
+		case attr.Type.Equal(oidContentType):
+			if _, err := asn1.Unmarshal(attr.Values[0].FullBytes, &contentType); err != nil {
+				return fmt.Errorf("malformed content type attribute: %v", err)
+			}
+		case attr.Type.Equal(oidMessageDigest):
+			if _, err := asn1.Unmarshal(attr.Values[0].FullBytes, &messageDigest); err != nil {
+				return fmt.Errorf("malformed message digest attribute: %v", err)
+			}
+		}
+	}
+	if !contentType.Equal(oidTSTInfo) {
+		return errors.New("signed content type is not TSTInfo")
+	}
+	h := hash.New()
+	h.Write(content)
+	if !bytes.Equal(h.Sum(nil), messageDigest) {
+		return errors.New("message digest does not match TSTInfo")
+	}
+
+	algorithm, ok := signatureAlgorithm(signer.SignatureAlgorithm.Algorithm, hash)
+	if !ok {
+		return fmt.Errorf("unsupported signature algorithm %v", signer.SignatureAlgorithm.Algorithm)
+	}
+	if err := cert.CheckSignature(algorithm, signed, signer.Signature); err != nil {
+		return fmt.Errorf("invalid time-stamp signature: %v", err)
+	}
+	return nil
+}
+
+// checkTimeStampingCertificate makes sure the signer may issue time-stamps
+func checkTimeStampingCertificate(cert *x509.Certificate, certificates []*x509.Certificate, roots *x509.CertPool, genTime time.Time) error {
+	timeStamping := false
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageTimeStamping {
+			timeStamping = true
+		}
+	}
+	if !timeStamping {
+		return errors.New("signer certificate is not valid for time-stamping")
+	}
+	if roots == nil {
+		return nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certificates {
+		intermediates.AddCert(c)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   genTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	})
+	if err != nil {
+		return fmt.Errorf("untrusted time-stamp authority: %v", err)
+	}
+	return nil
+}
+
+func hashFor(oid asn1.ObjectIdentifier) (crypto.Hash, bool) {
+	switch {
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, true
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, true
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+// signatureAlgorithm maps a CMS signature algorithm, which may name only the
+// key type, and the signer's digest algorithm to an x509 signature algorithm
+func signatureAlgorithm(oid asn1.ObjectIdentifier, hash crypto.Hash) (x509.SignatureAlgorithm, bool) {
+	switch {
+	case oid.Equal(oidEd25519):
+		return x509.PureEd25519, true
+	case oid.Equal(oidRSAEncryption), oid.Equal(oidSHA256WithRSA), oid.Equal(oidSHA384WithRSA), oid.Equal(oidSHA512WithRSA):
+		switch hash {
+		case crypto.SHA256:
+			return x509.SHA256WithRSA, true
+		case crypto.SHA384:
+			return x509.SHA384WithRSA, true
+		case crypto.SHA512:
+			return x509.SHA512WithRSA, true
+		}
+	case oid.Equal(oidECPublicKey), oid.Equal(oidECDSAWithSHA256), oid.Equal(oidECDSAWithSHA384), oid.Equal(oidECDSAWithSHA512):
+		switch hash {
+		case crypto.SHA256:
+			return x509.ECDSAWithSHA256, true
+		case crypto.SHA384:
+			return x509.ECDSAWithSHA384, true
+		case crypto.SHA512:
+			return x509.ECDSAWithSHA512, true
+		}
+	}
+	return x509.UnknownSignatureAlgorithm, false
+}
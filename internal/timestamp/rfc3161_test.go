@@ -0,0 +1,182 @@
+package timestamp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuthority(t *testing.T) *Authority {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, err := NewAuthority(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authority
+}
+
+func certPool(certs ...*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
+// issueToken obtains a token for digest from authority through a client
+func issueToken(t *testing.T, authority *Authority, digest []byte) *Token {
+	t.Helper()
+	server := httptest.NewServer(authority)
+	defer server.Close()
+
+	token, err := NewClient(server.URL, certPool(authority.Certificate())).Timestamp(digest)
+	if err != nil {
+		t.Fatalf("Timestamp: %v", err)
+	}
+	return token
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	authority := newTestAuthority(t)
+	digest := sha256.Sum256([]byte("chain head"))
+
+	before := time.Now().Add(-2 * time.Second)
+	token := issueToken(t, authority, digest[:])
+
+	if !bytes.Equal(token.HashedMessage, digest[:]) {
+		t.Errorf("HashedMessage = %x, want %x", token.HashedMessage, digest)
+	}
+	if !token.Policy.Equal(LocalPolicy) {
+		t.Errorf("Policy = %v, want %v", token.Policy, LocalPolicy)
+	}
+	if token.GenTime.Before(before) || token.GenTime.After(time.Now().Add(time.Second)) {
+		t.Errorf("GenTime = %v, not around now", token.GenTime)
+	}
+	if !token.Certificate.Equal(authority.Certificate()) {
+		t.Error("token names a different certificate than the authority's")
+	}
+
+	// A stored token verifies again later, against the roots or as is
+	for name, roots := range map[string]*x509.CertPool{"roots": certPool(authority.Certificate()), "embedded": nil} {
+		again, err := Verify(token.Raw, digest[:], roots)
+		if err != nil {
+			t.Fatalf("Verify with %s certificate: %v", name, err)
+		}
+		if again.SerialNumber.Cmp(token.SerialNumber) != 0 {
+			t.Errorf("Verify with %s certificate: serial %v, want %v", name, again.SerialNumber, token.SerialNumber)
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	authority := newTestAuthority(t)
+	digest := sha256.Sum256([]byte("chain head"))
+	token := issueToken(t, authority, digest[:])
+	other := sha256.Sum256([]byte("another head"))
+
+	// The same token with the digest inside TSTInfo replaced, leaving the signature as it was
+	i := bytes.Index(token.Raw, digest[:])
+	if i < 0 {
+		t.Fatal("digest not found in token")
+	}
+	tampered := append([]byte(nil), token.Raw...)
+	copy(tampered[i:], other[:])
+
+	tests := []struct {
+		name   string
+		der    []byte
+		digest []byte
+		roots  *x509.CertPool
+		want   string
+	}{
+		{"different digest", token.Raw, other[:], nil, "different digest"},
+		{"tampered imprint", tampered, other[:], nil, "message digest"},
+		{"wrong signer certificate", token.Raw, digest[:], certPool(newTestAuthority(t).Certificate()), "certificate"},
+		{"truncated", token.Raw[:len(token.Raw)/2], digest[:], nil, "malformed"},
+		{"trailing data", append(append([]byte(nil), token.Raw...), 0), digest[:], nil, "trailing data"},
+		{"garbage", []byte("not a time-stamp token"), digest[:], nil, "malformed"},
+		{"empty", nil, digest[:], nil, "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Verify(tt.der, tt.digest, tt.roots)
+			if err == nil {
+				t.Fatal("Verify succeeded")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Verify error %q does not mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorityRejectsRequests(t *testing.T) {
+	authority := newTestAuthority(t)
+	shortImprint, err := asn1.Marshal(timeStampReq{
+		Version:        1,
+		MessageImprint: messageImprint{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256}, HashedMessage: make([]byte, 16)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	badVersion, err := asn1.Marshal(timeStampReq{
+		Version:        2,
+		MessageImprint: messageImprint{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256}, HashedMessage: make([]byte, sha256.Size)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		body    []byte
+		failure int
+	}{
+		{"garbage", []byte("garbage"), failureBadDataFormat},
+		{"truncated", shortImprint[:len(shortImprint)-3], failureBadDataFormat},
+		{"unsupported version", badVersion, failureBadRequest},
+		{"short imprint", shortImprint, failureBadAlg},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := authority.respond(tt.body)
+			if reply.Status.Status != statusRejection {
+				t.Fatalf("status = %d, want rejection", reply.Status.Status)
+			}
+			info := reply.Status.FailInfo
+			if info.BitLength != tt.failure+1 || info.At(tt.failure) != 1 {
+				t.Errorf("failure info %v does not set bit %d", info, tt.failure)
+			}
+		})
+	}
+
+	recorder := httptest.NewRecorder()
+	authority.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET answered %d, want %d", recorder.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestNewAuthorityRejectsForeignCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewAuthority(key, newTestAuthority(t).Certificate()); err == nil {
+		t.Error("NewAuthority accepted a certificate for another key")
+	}
+}
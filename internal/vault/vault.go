@@ -0,0 +1,67 @@
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// KeySize is the length in bytes of the master key (AES-256)
+const KeySize = 32
+
+// Vault encrypts small secrets, such as private keys, under a master key
+// using AES-256-GCM. Ciphertexts are the random nonce followed by the sealed data.
+type Vault struct {
+	aead cipher.AEAD
+}
+
+// New creates a Vault from a raw 32-byte master key
+func New(masterKey []byte) (*Vault, error) {
+	if len(masterKey) != KeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", KeySize, len(masterKey))
+	}
+
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Vault{aead: aead}, nil
+}
+
+// NewFromBase64 creates a Vault from a base64-encoded master key, as stored in configuration
+func NewFromBase64(encoded string) (*Vault, error) {
+	if encoded == "" {
+		return nil, errors.New("master key is not configured")
+	}
+	masterKey, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid base64: %v", err)
+	}
+	return New(masterKey)
+}
+
+// Seal encrypts plaintext
+func (v *Vault) Seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return v.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open decrypts a ciphertext produced by Seal
+func (v *Vault) Open(ciphertext []byte) ([]byte, error) {
+	nonceSize := v.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return v.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], nil)
+}
@@ -0,0 +1,17 @@
+-- Per-doctor Ed25519 signing keys for blockchain transactions.
+-- Private keys are encrypted with the server master key (MASTER_KEY).
+CREATE TABLE IF NOT EXISTS public.doctor_keys (
+    id                    SERIAL PRIMARY KEY,
+    doctor_id             INTEGER NOT NULL REFERENCES public.doctor (doctor_id) ON DELETE CASCADE,
+    public_key            BYTEA NOT NULL,
+    encrypted_private_key BYTEA NOT NULL,
+    fingerprint           TEXT NOT NULL UNIQUE,
+    created_at            TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    revoked_at            TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS doctor_keys_active_idx
+    ON public.doctor_keys (doctor_id) WHERE revoked_at IS NULL;
+
+ALTER TABLE public.blocks ADD COLUMN IF NOT EXISTS signature TEXT;
+ALTER TABLE public.blocks ADD COLUMN IF NOT EXISTS key_fingerprint TEXT;
@@ -0,0 +1,5 @@
+-- Two blocks can never share an index. Appends also take an advisory lock,
+-- this index is the last line of defence against forks.
+-- Creating it fails if the chain is already forked: find the duplicates with
+-- GET /api/v1/blockchain/verify and repair them first.
+CREATE UNIQUE INDEX IF NOT EXISTS blocks_index_key ON public.blocks (index);
@@ -0,0 +1,3 @@
+-- Records the hashing format of each block. Existing blocks were hashed with
+-- the legacy JSON format (version 1); new blocks use the canonical format.
+ALTER TABLE public.blocks ADD COLUMN IF NOT EXISTS schema_version INTEGER NOT NULL DEFAULT 1;
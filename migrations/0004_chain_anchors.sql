@@ -0,0 +1,14 @@
+-- RFC 3161 time-stamp tokens over chain head hashes. Each token proves the
+-- chain contained the named block no later than gen_time.
+CREATE TABLE IF NOT EXISTS public.chain_anchors (
+    id            SERIAL PRIMARY KEY,
+    block_index   INTEGER NOT NULL,
+    block_hash    TEXT NOT NULL,
+    tsa_url       TEXT NOT NULL,
+    token         BYTEA NOT NULL,
+    gen_time      TIMESTAMPTZ NOT NULL,
+    serial_number TEXT NOT NULL,
+    created_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS chain_anchors_block_index_idx ON public.chain_anchors (block_index);
@@ -0,0 +1,11 @@
+-- Per-patient data keys that encrypt record details stored on the blockchain.
+-- Keys are encrypted with the server master key (MASTER_KEY). Shredding a key
+-- sets encrypted_key to NULL, which makes the patient's encrypted details
+-- unreadable without touching the hashed blocks.
+-- Blocks written before schema version 3 keep their details in plaintext.
+CREATE TABLE IF NOT EXISTS public.patient_keys (
+    patient_id    INTEGER PRIMARY KEY REFERENCES public.patient (patient_id) ON DELETE CASCADE,
+    encrypted_key BYTEA,
+    created_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    shredded_at   TIMESTAMP
+);
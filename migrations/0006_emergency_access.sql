@@ -0,0 +1,23 @@
+-- Break-glass access: a doctor may open a patient's records without consent
+-- for a short time after giving a justification. Every event waits in a
+-- review queue until an administrator approves or flags it.
+CREATE TABLE IF NOT EXISTS public.emergency_access (
+    id             SERIAL PRIMARY KEY,
+    doctor_id      INTEGER NOT NULL REFERENCES public.doctor (doctor_id),
+    patient_id     INTEGER NOT NULL REFERENCES public.patient (patient_id) ON DELETE CASCADE,
+    justification  TEXT NOT NULL,
+    granted_at     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at     TIMESTAMP NOT NULL,
+    block_index    INTEGER,
+    review_status  TEXT NOT NULL DEFAULT 'pending' CHECK (review_status IN ('pending', 'approved', 'flagged')),
+    reviewed_by    INTEGER REFERENCES public.user (user_id),
+    reviewed_at    TIMESTAMP,
+    review_notes   TEXT
+);
+
+CREATE INDEX IF NOT EXISTS emergency_access_active_idx ON public.emergency_access (doctor_id, patient_id, expires_at);
+CREATE INDEX IF NOT EXISTS emergency_access_review_idx ON public.emergency_access (review_status, granted_at);
+
+-- Break-glass entries in access_log name the patient rather than one record
+ALTER TABLE public.access_log ADD COLUMN IF NOT EXISTS patient_id INTEGER REFERENCES public.patient (patient_id) ON DELETE CASCADE;
+ALTER TABLE public.access_log ALTER COLUMN record_id DROP NOT NULL;
@@ -0,0 +1,20 @@
+-- Standing consents let a patient give a doctor, or every doctor of a
+-- specialization, lasting access without approving a request per visit.
+-- Both standing consents and granted access requests may be limited to
+-- record categories: diagnosis, treatment_plan and test_result.
+CREATE TABLE IF NOT EXISTS public.standing_consents (
+    id              SERIAL PRIMARY KEY,
+    patient_id      INTEGER NOT NULL REFERENCES public.patient (patient_id) ON DELETE CASCADE,
+    doctor_id       INTEGER REFERENCES public.doctor (doctor_id) ON DELETE CASCADE,
+    specialization  TEXT,
+    scopes          TEXT[] NOT NULL CHECK (cardinality(scopes) > 0),
+    created_at      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at      TIMESTAMP,
+    revoked_at      TIMESTAMP,
+    CHECK ((doctor_id IS NULL) <> (specialization IS NULL))
+);
+
+CREATE INDEX IF NOT EXISTS standing_consents_patient_idx ON public.standing_consents (patient_id) WHERE revoked_at IS NULL;
+
+-- NULL scopes cover every category, as all requests granted before this migration did
+ALTER TABLE public.access_requests ADD COLUMN IF NOT EXISTS scopes TEXT[];
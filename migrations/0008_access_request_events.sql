@@ -0,0 +1,42 @@
+-- Publish access request changes on the access_requests channel so every
+-- instance can push them to the patient and doctor involved. Notifications
+-- are delivered when the writing transaction commits.
+CREATE OR REPLACE FUNCTION public.notify_access_request() RETURNS trigger AS $$
+DECLARE
+    event TEXT;
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        event := 'created';
+    ELSIF NEW.status IS NOT DISTINCT FROM OLD.status THEN
+        RETURN NEW;
+    ELSIF NEW.status = 'expired' THEN
+        event := 'expired';
+    ELSE
+        event := 'status_changed';
+    END IF;
+
+    -- Times are stored without a zone and read back as UTC, as lib/pq does
+    PERFORM pg_notify('access_requests', json_build_object(
+        'type', event,
+        'doctor_user_id', (SELECT user_id FROM public.doctor WHERE doctor_id = NEW.doctor_id),
+        'patient_user_id', (SELECT user_id FROM public.patient WHERE patient_id = NEW.patient_id),
+        'access_request', json_build_object(
+            'id', NEW.id,
+            'doctor_id', NEW.doctor_id,
+            'patient_id', NEW.patient_id,
+            'status', NEW.status,
+            'created_at', NEW.created_at AT TIME ZONE 'UTC',
+            'expires_at', NEW.expires_at AT TIME ZONE 'UTC',
+            'access_granted_at', NEW.access_granted_at AT TIME ZONE 'UTC',
+            'access_expires_at', NEW.access_expires_at AT TIME ZONE 'UTC',
+            'scopes', NEW.scopes
+        )
+    )::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS access_requests_notify ON public.access_requests;
+CREATE TRIGGER access_requests_notify
+    AFTER INSERT OR UPDATE OF status ON public.access_requests
+    FOR EACH ROW EXECUTE FUNCTION public.notify_access_request();
@@ -0,0 +1,22 @@
+-- Guardianships let a parent, legal guardian or proxy act for a dependent
+-- patient. They take effect once an administrator has verified the supporting
+-- document. Guardianships of minors end when the dependent comes of age.
+CREATE TABLE IF NOT EXISTS public.guardianships (
+    id                  SERIAL PRIMARY KEY,
+    guardian_user_id    INTEGER NOT NULL REFERENCES public.user (user_id) ON DELETE CASCADE,
+    patient_id          INTEGER NOT NULL REFERENCES public.patient (patient_id) ON DELETE CASCADE,
+    dependent_type      TEXT NOT NULL CHECK (dependent_type IN ('minor', 'adult')),
+    relationship        TEXT NOT NULL CHECK (relationship IN ('parent', 'legal_guardian', 'proxy')),
+    document_reference  TEXT NOT NULL,
+    status              TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'verified', 'rejected', 'revoked', 'ended')),
+    requested_at        TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    verified_by         INTEGER REFERENCES public.user (user_id),
+    verified_at         TIMESTAMP,
+    review_notes        TEXT,
+    ended_at            TIMESTAMP
+);
+
+-- One open guardianship per guardian and dependent
+CREATE UNIQUE INDEX IF NOT EXISTS guardianships_open_idx ON public.guardianships (guardian_user_id, patient_id)
+    WHERE status IN ('pending', 'verified');
+CREATE INDEX IF NOT EXISTS guardianships_patient_idx ON public.guardianships (patient_id);
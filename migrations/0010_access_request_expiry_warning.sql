@@ -0,0 +1,49 @@
+-- The job runner warns the parties shortly before granted access expires.
+-- expiry_warned_at records that the warning was sent, so it is sent once.
+ALTER TABLE public.access_requests ADD COLUMN IF NOT EXISTS expiry_warned_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS access_requests_status_idx ON public.access_requests (status);
+
+CREATE OR REPLACE FUNCTION public.notify_access_request() RETURNS trigger AS $$
+DECLARE
+    event TEXT;
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        event := 'created';
+    ELSIF NEW.status IS DISTINCT FROM OLD.status THEN
+        IF NEW.status = 'expired' THEN
+            event := 'expired';
+        ELSE
+            event := 'status_changed';
+        END IF;
+    ELSIF NEW.expiry_warned_at IS DISTINCT FROM OLD.expiry_warned_at AND NEW.expiry_warned_at IS NOT NULL THEN
+        event := 'expiring';
+    ELSE
+        RETURN NEW;
+    END IF;
+
+    -- Times are stored without a zone and read back as UTC, as lib/pq does
+    PERFORM pg_notify('access_requests', json_build_object(
+        'type', event,
+        'doctor_user_id', (SELECT user_id FROM public.doctor WHERE doctor_id = NEW.doctor_id),
+        'patient_user_id', (SELECT user_id FROM public.patient WHERE patient_id = NEW.patient_id),
+        'access_request', json_build_object(
+            'id', NEW.id,
+            'doctor_id', NEW.doctor_id,
+            'patient_id', NEW.patient_id,
+            'status', NEW.status,
+            'created_at', NEW.created_at AT TIME ZONE 'UTC',
+            'expires_at', NEW.expires_at AT TIME ZONE 'UTC',
+            'access_granted_at', NEW.access_granted_at AT TIME ZONE 'UTC',
+            'access_expires_at', NEW.access_expires_at AT TIME ZONE 'UTC',
+            'scopes', NEW.scopes
+        )
+    )::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS access_requests_notify ON public.access_requests;
+CREATE TRIGGER access_requests_notify
+    AFTER INSERT OR UPDATE OF status, expiry_warned_at ON public.access_requests
+    FOR EACH ROW EXECUTE FUNCTION public.notify_access_request();
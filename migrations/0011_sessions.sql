@@ -0,0 +1,35 @@
+-- Sessions back refresh tokens. Each login starts a session; every refresh
+-- replaces its refresh token, and presenting a replaced token again revokes
+-- the whole session. Access tokens name their session in the sid claim.
+CREATE TABLE IF NOT EXISTS public.sessions (
+    id            TEXT PRIMARY KEY,
+    user_id       INTEGER NOT NULL REFERENCES public.user (user_id) ON DELETE CASCADE,
+    user_agent    TEXT,
+    ip_address    TEXT,
+    created_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at    TIMESTAMP NOT NULL,
+    revoked_at    TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_idx ON public.sessions (user_id);
+
+-- Only the SHA-256 of a refresh token is stored
+CREATE TABLE IF NOT EXISTS public.refresh_tokens (
+    token_hash  BYTEA PRIMARY KEY,
+    session_id  TEXT NOT NULL REFERENCES public.sessions (id) ON DELETE CASCADE,
+    created_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at  TIMESTAMP NOT NULL,
+    used_at     TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_session_idx ON public.refresh_tokens (session_id);
+
+-- Access tokens revoked before they expire, by jti. Rows can be deleted once
+-- the token has expired.
+CREATE TABLE IF NOT EXISTS public.revoked_tokens (
+    jti         TEXT PRIMARY KEY,
+    user_id     INTEGER NOT NULL,
+    expires_at  TIMESTAMP NOT NULL,
+    revoked_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
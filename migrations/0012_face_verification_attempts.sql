@@ -0,0 +1,20 @@
+-- Every face comparison is recorded, both to audit biometric logins and to
+-- limit how many failed attempts can be made against one user. The table
+-- predates migrations in some databases, so it is created only if missing.
+CREATE TABLE IF NOT EXISTS public.face_verification_attempts (
+    id                   SERIAL PRIMARY KEY,
+    user_id              INTEGER NOT NULL REFERENCES public.user (user_id) ON DELETE CASCADE,
+    access_request_id    INTEGER,
+    photo_url            TEXT,
+    verification_status  VARCHAR(20) NOT NULL,
+    similarity_score     DOUBLE PRECISION,
+    created_at           TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    verified_at          TIMESTAMP
+);
+
+-- purpose is login or step_up; verification_status is matched, mismatched or error
+ALTER TABLE public.face_verification_attempts ADD COLUMN IF NOT EXISTS purpose TEXT;
+ALTER TABLE public.face_verification_attempts ADD COLUMN IF NOT EXISTS ip_address TEXT;
+
+CREATE INDEX IF NOT EXISTS face_verification_attempts_user_idx
+    ON public.face_verification_attempts (user_id, created_at);
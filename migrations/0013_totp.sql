@@ -0,0 +1,24 @@
+-- TOTP second factor (RFC 6238). The secret is encrypted with the master key
+-- (MASTER_KEY) and takes effect once the user confirms a code, which sets
+-- enabled_at. last_used_step stops a code from being used twice, and failed
+-- codes lock verification for a while.
+CREATE TABLE IF NOT EXISTS public.user_totp (
+    user_id           INTEGER PRIMARY KEY REFERENCES public.user (user_id) ON DELETE CASCADE,
+    encrypted_secret  BYTEA NOT NULL,
+    enabled_at        TIMESTAMP,
+    last_used_step    BIGINT NOT NULL DEFAULT 0,
+    failed_attempts   INTEGER NOT NULL DEFAULT 0,
+    last_failed_at    TIMESTAMP,
+    created_at        TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Single-use recovery codes for a lost authenticator, stored as SHA-256
+CREATE TABLE IF NOT EXISTS public.recovery_codes (
+    id          SERIAL PRIMARY KEY,
+    user_id     INTEGER NOT NULL REFERENCES public.user (user_id) ON DELETE CASCADE,
+    code_hash   BYTEA NOT NULL UNIQUE,
+    created_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    used_at     TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS recovery_codes_user_idx ON public.recovery_codes (user_id);
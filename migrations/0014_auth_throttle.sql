@@ -0,0 +1,13 @@
+-- Failed login, OTP and password change attempts, counted per IIN and per
+-- client IP so every instance enforces the same limits. Counts reset after a
+-- quiet period or when a lockout ends.
+CREATE TABLE IF NOT EXISTS public.auth_throttle (
+    kind             TEXT NOT NULL CHECK (kind IN ('iin', 'ip')),
+    subject          TEXT NOT NULL,
+    failures         INTEGER NOT NULL DEFAULT 0,
+    last_failure_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until     TIMESTAMP,
+    PRIMARY KEY (kind, subject)
+);
+
+CREATE INDEX IF NOT EXISTS auth_throttle_locked_idx ON public.auth_throttle (locked_until);
@@ -0,0 +1,19 @@
+-- Password resets. A reset code is emailed to the user and only its SHA-256
+-- is stored; it can be used once, before it expires, and is given up after
+-- too many wrong guesses. A new request replaces the user's earlier codes.
+CREATE TABLE IF NOT EXISTS public.password_resets (
+    id               SERIAL PRIMARY KEY,
+    user_id          INTEGER NOT NULL REFERENCES public.user (user_id) ON DELETE CASCADE,
+    token_hash       BYTEA NOT NULL UNIQUE,
+    requested_ip     TEXT,
+    created_at       TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at       TIMESTAMP NOT NULL,
+    used_at          TIMESTAMP,
+    failed_attempts  INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS password_resets_user_idx ON public.password_resets (user_id);
+
+-- The plaintext OTP tables this replaces
+DROP TABLE IF EXISTS public.otp_verification;
+DROP TABLE IF EXISTS public.otp_verifications;
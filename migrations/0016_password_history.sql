@@ -0,0 +1,17 @@
+-- Every password a user sets, as its bcrypt hash. New passwords must differ
+-- from the latest ones, and the newest row tells how old the current password
+-- is. Current passwords are recorded as set now, so maximum ages count from
+-- this migration.
+CREATE TABLE IF NOT EXISTS public.password_history (
+    id             SERIAL PRIMARY KEY,
+    user_id        INTEGER NOT NULL REFERENCES public.user (user_id) ON DELETE CASCADE,
+    password_hash  TEXT NOT NULL,
+    created_at     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS password_history_user_idx ON public.password_history (user_id, created_at DESC);
+
+INSERT INTO public.password_history (user_id, password_hash)
+SELECT u.user_id, u.password FROM public.user u
+WHERE u.password_changed
+AND NOT EXISTS (SELECT 1 FROM public.password_history h WHERE h.user_id = u.user_id);
@@ -0,0 +1,25 @@
+-- Accounts suspended by an administrator. A suspended user cannot log in or
+-- refresh tokens, and suspending ends their sessions. Reactivating deletes the row.
+CREATE TABLE IF NOT EXISTS public.account_suspensions (
+    user_id       INTEGER PRIMARY KEY REFERENCES public.user (user_id) ON DELETE CASCADE,
+    reason        TEXT NOT NULL,
+    suspended_by  INTEGER REFERENCES public.user (user_id) ON DELETE SET NULL,
+    suspended_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Login attempts on known accounts, for administrators to review
+CREATE TABLE IF NOT EXISTS public.login_events (
+    id          BIGSERIAL PRIMARY KEY,
+    user_id     INTEGER NOT NULL REFERENCES public.user (user_id) ON DELETE CASCADE,
+    method      TEXT NOT NULL CHECK (method IN ('password', 'face')),
+    outcome     TEXT NOT NULL CHECK (outcome IN ('succeeded', 'failed', 'mfa_failed', 'suspended')),
+    ip_address  TEXT,
+    user_agent  TEXT,
+    created_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS login_events_user_idx ON public.login_events (user_id, created_at DESC);
+
+-- Administrators manage every other account through the API. The first one
+-- is appointed in the database:
+--   UPDATE public.user SET role = 'admin' WHERE iin = '<IIN>';
@@ -0,0 +1,9 @@
+-- Face photos enrolled by their owner: with an access token, or with the
+-- short-lived enrollment token returned on registration. Only these photos
+-- are accepted for face login and step-up. Photos uploaded before enrollment
+-- required authentication have no row here; their owners must enroll again.
+CREATE TABLE IF NOT EXISTS public.face_enrollments (
+    user_id      INTEGER PRIMARY KEY REFERENCES public.user (user_id) ON DELETE CASCADE,
+    method       TEXT NOT NULL CHECK (method IN ('access_token', 'registration')),
+    enrolled_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
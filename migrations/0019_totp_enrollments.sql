@@ -0,0 +1,11 @@
+-- Accounts that have ever enabled TOTP. Rows outlive the second factor, so
+-- an MFA challenge token can only set up a first authenticator: a challenge
+-- proves just the password, which must not be enough to replace one.
+CREATE TABLE IF NOT EXISTS public.totp_enrollments (
+    user_id           INTEGER PRIMARY KEY REFERENCES public.user (user_id) ON DELETE CASCADE,
+    first_enabled_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO public.totp_enrollments (user_id, first_enabled_at)
+SELECT user_id, enabled_at FROM public.user_totp WHERE enabled_at IS NOT NULL
+ON CONFLICT (user_id) DO NOTHING;